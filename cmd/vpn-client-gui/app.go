@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -22,14 +23,16 @@ type StatusUpdate struct {
 
 // App struct holds the GUI application state.
 type App struct {
-	ctx        context.Context
-	mu         sync.Mutex
-	cfg        *config.ClientConfig
-	cfgPath    string
-	vpnClient  *client.Client
-	status     string
-	assignedIP string
-	hidden     bool
+	ctx       context.Context
+	mu        sync.Mutex
+	cfg       *config.ClientConfig
+	cfgPath   string
+	vpnClient *client.Client
+	// cancelConnect aborts the connection attempt in progress, if any
+	cancelConnect context.CancelFunc
+	status        string
+	assignedIP    string
+	hidden        bool
 }
 
 // NewApp creates a new App instance.
@@ -74,10 +77,17 @@ func (a *App) beforeClose(ctx context.Context) bool {
 }
 
 func (a *App) shutdown(ctx context.Context) {
+	a.Cancel()
+
 	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.vpnClient != nil && a.status == "connected" {
-		a.vpnClient.Disconnect()
+	vpnClient := a.vpnClient
+	a.vpnClient = nil
+	a.mu.Unlock()
+
+	// Disconnect waits for the client's supervisor, whose state callback
+	// takes a.mu, so it must not be called with the lock held
+	if vpnClient != nil {
+		vpnClient.Disconnect()
 	}
 	cleanupTray()
 }
@@ -104,7 +114,7 @@ func (a *App) Quit() {
 // Connect starts the VPN connection asynchronously.
 func (a *App) Connect() {
 	a.mu.Lock()
-	if a.status == "connecting" || a.status == "connected" {
+	if a.status == "connecting" || a.status == "connected" || a.status == "reconnecting" {
 		a.mu.Unlock()
 		return
 	}
@@ -121,20 +131,53 @@ func (a *App) Connect() {
 		return
 	}
 
-	a.emitStatus("connecting", "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	a.mu.Lock()
+	a.cancelConnect = cancel
+	a.emitStatusLocked("connecting", "", "")
+	a.mu.Unlock()
 
-	go a.connectAsync(cfg)
+	go a.connectAsync(ctx, cancel, cfg)
 }
 
-func (a *App) connectAsync(cfg *config.ClientConfig) {
+// Cancel aborts a connection attempt that is still in progress.
+func (a *App) Cancel() {
+	a.mu.Lock()
+	cancel := a.cancelConnect
+	a.mu.Unlock()
+
+	if cancel != nil {
+		log.Println("Cancelling connection...")
+		cancel()
+	}
+}
+
+func (a *App) connectAsync(ctx context.Context, cancel context.CancelFunc, cfg *config.ClientConfig) {
+	defer cancel()
+
 	// Create a copy of the config so mutations during connect don't affect the saved one
 	cfgCopy := *cfg
 	vpnClient := client.New(&cfgCopy)
+	vpnClient.OnStateChange(func(change client.StateChange) {
+		a.handleStateChange(vpnClient, change)
+	})
+
+	err := vpnClient.Connect(ctx)
+	if err == nil && ctx.Err() != nil {
+		// Cancelled just as the connection came up
+		vpnClient.Disconnect()
+		err = ctx.Err()
+	}
 
-	err := vpnClient.Connect()
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	a.cancelConnect = nil
 
+	if errors.Is(err, context.Canceled) {
+		a.status = "disconnected"
+		a.emitStatusLocked("disconnected", "", "")
+		return
+	}
 	if err != nil {
 		a.status = "error"
 		a.emitStatusLocked("error", "", fmt.Sprintf("Connection failed: %v", err))
@@ -150,17 +193,55 @@ func (a *App) connectAsync(cfg *config.ClientConfig) {
 	sendNotification("ShikVPN", fmt.Sprintf("Connected - %s", cfgCopy.Address))
 }
 
-// Disconnect tears down the VPN connection.
-func (a *App) Disconnect() {
+// handleStateChange reflects reconnects made by the client's supervisor in
+// the UI. The initial connect and disconnect are reported by Connect and
+// Disconnect themselves.
+func (a *App) handleStateChange(vpnClient *client.Client, change client.StateChange) {
+	if change.State != client.StateReconnecting && change.State != client.StateConnected {
+		return
+	}
+
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if a.vpnClient == nil {
+	// Ignore the initial connect and clients that are being torn down
+	if a.vpnClient != vpnClient {
 		return
 	}
+	prev := a.status
 
-	a.vpnClient.Disconnect()
+	errMsg := ""
+	if change.Err != nil {
+		errMsg = fmt.Sprintf("Reconnect failed: %v", change.Err)
+	}
+	a.emitStatusLocked(string(change.State), change.AssignedIP, errMsg)
+
+	switch {
+	case change.State == client.StateReconnecting && prev == "connected":
+		sendNotification("ShikVPN", "Connection lost - reconnecting")
+	case change.State == client.StateConnected && prev == "reconnecting":
+		sendNotification("ShikVPN", fmt.Sprintf("Reconnected - %s", change.AssignedIP))
+	}
+}
+
+// Disconnect tears down the VPN connection, or cancels it if it is still
+// being established.
+func (a *App) Disconnect() {
+	a.mu.Lock()
+	vpnClient := a.vpnClient
 	a.vpnClient = nil
+	a.mu.Unlock()
+
+	if vpnClient == nil {
+		a.Cancel()
+		return
+	}
+
+	// Called without the lock; see shutdown
+	vpnClient.Disconnect()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.status = "disconnected"
 	a.assignedIP = ""
 	a.emitStatusLocked("disconnected", "", "")
@@ -168,6 +249,24 @@ func (a *App) Disconnect() {
 	sendNotification("ShikVPN", "Disconnected")
 }
 
+// SetKillSwitch turns the kill switch on or off and saves the setting. A
+// running connection picks up the change immediately.
+func (a *App) SetKillSwitch(enabled bool) error {
+	cfg := *a.GetConfig()
+	cfg.KillSwitch = enabled
+
+	a.mu.Lock()
+	vpnClient := a.vpnClient
+	a.mu.Unlock()
+
+	if vpnClient != nil {
+		if err := vpnClient.SetKillSwitch(context.Background(), enabled); err != nil {
+			return err
+		}
+	}
+	return a.SaveConfig(cfg)
+}
+
 // GetStatus returns the current VPN status.
 func (a *App) GetStatus() StatusUpdate {
 	a.mu.Lock()
@@ -207,7 +306,7 @@ func (a *App) SaveConfig(cfg config.ClientConfig) error {
 		path = filepath.Join(filepath.Dir(exe), "client.toml")
 	}
 
-	if err := writeConfigToml(path, &cfg); err != nil {
+	if err := config.SaveClientConfig(path, &cfg); err != nil {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 
@@ -270,7 +369,7 @@ func (a *App) SaveConfigFileAs(cfg config.ClientConfig) error {
 	}
 
 	config.ApplyClientDefaults(&cfg)
-	if err := writeConfigToml(path, &cfg); err != nil {
+	if err := config.SaveClientConfig(path, &cfg); err != nil {
 		return fmt.Errorf("failed to save config: %w", err)
 	}
 
@@ -20,6 +20,21 @@ export async function renderConfigEditor(container: HTMLElement) {
       interface_name: 'wg0',
       api_key: '',
       log_level: 'error',
+      unregister_on_disconnect: false,
+      allowed_ips: [],
+      exclude_ips: [],
+      api_tls: false,
+      api_ca_file: '',
+      api_cert_sha256: '',
+      register_attempts: 3,
+      register_backoff: 2,
+      register_jitter: 0,
+      kill_switch: false,
+      mode: 'tun',
+      proxy_listen: '127.0.0.1:1080',
+      transport: 'udp',
+      transport_port: 0,
+      obfuscation_key: '',
     };
   }
 
@@ -53,9 +68,26 @@ export async function renderConfigEditor(container: HTMLElement) {
         </div>
       </div>
 
+      <div class="form-group checkbox">
+        <label>
+          <input type="checkbox" id="cfg-api-tls" ${cfg.api_tls ? 'checked' : ''} />
+          Use HTTPS for the registration API
+        </label>
+      </div>
+
+      <div class="form-group">
+        <label>API CA File</label>
+        <input type="text" id="cfg-api-ca-file" value="${esc(cfg.api_ca_file)}" placeholder="Optional PEM CA bundle" />
+      </div>
+
+      <div class="form-group">
+        <label>API Certificate SHA-256</label>
+        <input type="text" id="cfg-api-cert-sha256" value="${esc(cfg.api_cert_sha256)}" placeholder="Optional pinned fingerprint" />
+      </div>
+
       <div class="form-group">
         <label>Server Public Key</label>
-        <input type="text" id="cfg-server-public-key" value="${esc(cfg.server_public_key)}" placeholder="Auto-filled after registration" />
+        <input type="text" id="cfg-server-public-key" value="${esc(cfg.server_public_key)}" placeholder="Pin to authenticate the server (auto-filled after registration)" />
       </div>
 
       <div class="form-group">
@@ -68,6 +100,16 @@ export async function renderConfigEditor(container: HTMLElement) {
         <input type="text" id="cfg-dns" value="${esc(cfg.dns)}" placeholder="1.1.1.1" />
       </div>
 
+      <div class="form-group">
+        <label>Allowed IPs</label>
+        <input type="text" id="cfg-allowed-ips" value="${esc((cfg.allowed_ips || []).join(', '))}" placeholder="All traffic (e.g. 10.20.0.0/16, 192.168.50.0/24)" />
+      </div>
+
+      <div class="form-group">
+        <label>Excluded IPs</label>
+        <input type="text" id="cfg-exclude-ips" value="${esc((cfg.exclude_ips || []).join(', '))}" placeholder="None (e.g. 192.168.1.0/24)" />
+      </div>
+
       <div class="form-group">
         <label>MTU</label>
         <input type="number" id="cfg-mtu" value="${cfg.mtu}" min="576" max="65535" />
@@ -83,6 +125,56 @@ export async function renderConfigEditor(container: HTMLElement) {
         <input type="text" id="cfg-interface" value="${esc(cfg.interface_name)}" />
       </div>
 
+      <div class="form-group">
+        <label>Registration Attempts</label>
+        <input type="number" id="cfg-register-attempts" value="${cfg.register_attempts}" min="1" />
+      </div>
+
+      <div class="form-group">
+        <label>Registration Retry Backoff (seconds)</label>
+        <input type="number" id="cfg-register-backoff" value="${cfg.register_backoff}" min="0" />
+      </div>
+
+      <div class="form-group">
+        <label>Registration Retry Jitter (0-1)</label>
+        <input type="number" id="cfg-register-jitter" value="${cfg.register_jitter}" min="0" max="1" step="0.1" />
+      </div>
+
+      <div class="form-group">
+        <label>Mode</label>
+        <select id="cfg-mode">
+          <option value="tun" ${cfg.mode !== 'proxy' ? 'selected' : ''}>TUN device (routes system traffic; needs admin rights)</option>
+          <option value="proxy" ${cfg.mode === 'proxy' ? 'selected' : ''}>Local SOCKS5/HTTP proxy (no admin rights)</option>
+        </select>
+      </div>
+
+      <div class="form-group">
+        <label>Proxy Listen Address</label>
+        <input type="text" id="cfg-proxy-listen" value="${esc(cfg.proxy_listen)}" placeholder="127.0.0.1:1080" />
+      </div>
+
+      <div class="form-group">
+        <label>Transport</label>
+        <select id="cfg-transport">
+          <option value="udp" ${cfg.transport !== 'tcp' && cfg.transport !== 'websocket' ? 'selected' : ''}>UDP (default)</option>
+          <option value="tcp" ${cfg.transport === 'tcp' ? 'selected' : ''}>TCP (for networks that block UDP)</option>
+          <option value="websocket" ${cfg.transport === 'websocket' ? 'selected' : ''}>WebSocket (through the API port)</option>
+        </select>
+      </div>
+
+      <div class="form-group">
+        <label>Transport Port (0 for the default)</label>
+        <input type="number" id="cfg-transport-port" value="${cfg.transport_port}" min="0" max="65535" />
+      </div>
+
+      <div class="form-group">
+        <label>Obfuscation Key</label>
+        <div class="input-with-toggle">
+          <input type="password" id="cfg-obfuscation-key" value="${esc(cfg.obfuscation_key)}" placeholder="Optional; must match the server's" />
+          <button class="toggle-visibility" data-target="cfg-obfuscation-key">${eyeIcon}</button>
+        </div>
+      </div>
+
       <div class="form-group">
         <label>Log Level</label>
         <select id="cfg-log-level">
@@ -92,6 +184,20 @@ export async function renderConfigEditor(container: HTMLElement) {
         </select>
       </div>
 
+      <div class="form-group checkbox">
+        <label>
+          <input type="checkbox" id="cfg-unregister" ${cfg.unregister_on_disconnect ? 'checked' : ''} />
+          Release IP on server when disconnecting
+        </label>
+      </div>
+
+      <div class="form-group checkbox">
+        <label>
+          <input type="checkbox" id="cfg-kill-switch" ${cfg.kill_switch ? 'checked' : ''} />
+          Kill switch: block traffic outside the tunnel (Linux)
+        </label>
+      </div>
+
       <div class="button-row">
         <button class="btn btn-primary" id="btn-save">Save</button>
         <button class="btn" id="btn-save-as">Save As...</button>
@@ -149,6 +255,9 @@ export async function renderConfigEditor(container: HTMLElement) {
 function readForm(): ClientConfig {
   const val = (id: string) => (document.getElementById(id) as HTMLInputElement).value;
   const num = (id: string) => parseInt((document.getElementById(id) as HTMLInputElement).value, 10) || 0;
+  const frac = (id: string) => parseFloat((document.getElementById(id) as HTMLInputElement).value) || 0;
+  const checked = (id: string) => (document.getElementById(id) as HTMLInputElement).checked;
+  const list = (id: string) => val(id).split(/[\s,]+/).filter((s) => s !== '');
 
   return {
     server: val('cfg-server'),
@@ -162,6 +271,21 @@ function readForm(): ClientConfig {
     persistent_keepalive: num('cfg-keepalive'),
     interface_name: val('cfg-interface'),
     log_level: val('cfg-log-level'),
+    unregister_on_disconnect: checked('cfg-unregister'),
+    allowed_ips: list('cfg-allowed-ips'),
+    exclude_ips: list('cfg-exclude-ips'),
+    api_tls: checked('cfg-api-tls'),
+    api_ca_file: val('cfg-api-ca-file'),
+    api_cert_sha256: val('cfg-api-cert-sha256'),
+    register_attempts: num('cfg-register-attempts'),
+    register_backoff: num('cfg-register-backoff'),
+    register_jitter: frac('cfg-register-jitter'),
+    kill_switch: checked('cfg-kill-switch'),
+    mode: val('cfg-mode'),
+    proxy_listen: val('cfg-proxy-listen'),
+    transport: val('cfg-transport'),
+    transport_port: num('cfg-transport-port'),
+    obfuscation_key: val('cfg-obfuscation-key'),
   };
 }
 
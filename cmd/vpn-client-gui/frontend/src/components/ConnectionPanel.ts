@@ -1,8 +1,11 @@
-import type { StatusUpdate } from '../types';
+import type { ClientConfig, StatusUpdate } from '../types';
 
+declare function Cancel(): Promise<void>;
 declare function Connect(): Promise<void>;
 declare function Disconnect(): Promise<void>;
+declare function GetConfig(): Promise<ClientConfig>;
 declare function GetStatus(): Promise<StatusUpdate>;
+declare function SetKillSwitch(enabled: boolean): Promise<void>;
 
 const powerIcon = `<svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2.5" stroke-linecap="round" stroke-linejoin="round">
   <path d="M18.36 6.64a9 9 0 1 1-12.73 0"/>
@@ -15,9 +18,13 @@ let currentStatus: StatusUpdate = {
   error: '',
 };
 
+let killSwitch = false;
+
 export async function renderConnectionPanel(container: HTMLElement) {
   try {
     currentStatus = await (window as any).go.main.App.GetStatus();
+    const cfg: ClientConfig = await (window as any).go.main.App.GetConfig();
+    killSwitch = !!cfg.kill_switch;
   } catch {
     // use defaults
   }
@@ -26,12 +33,13 @@ export async function renderConnectionPanel(container: HTMLElement) {
 
 function render(container: HTMLElement) {
   const s = currentStatus;
-  const isConnected = s.status === 'connected';
+  // While reconnecting the tunnel is still up, so the button disconnects
+  const isConnected = s.status === 'connected' || s.status === 'reconnecting';
   const isConnecting = s.status === 'connecting';
 
   container.innerHTML = `
     <div class="connection-panel">
-      <div class="power-button ${s.status}" id="power-btn" title="${isConnected ? 'Disconnect' : 'Connect'}">
+      <div class="power-button ${s.status}" id="power-btn" title="${isConnecting ? 'Cancel' : isConnected ? 'Disconnect' : 'Connect'}">
         ${powerIcon}
       </div>
 
@@ -49,14 +57,22 @@ function render(container: HTMLElement) {
         </div>` : ''}
         ${s.error ? `<div class="error-message">${escapeHtml(s.error)}</div>` : ''}
       </div>
+
+      <div class="form-group checkbox">
+        <label title="Block all traffic outside the tunnel, also while reconnecting">
+          <input type="checkbox" id="kill-switch" ${killSwitch ? 'checked' : ''} />
+          Kill switch
+        </label>
+      </div>
     </div>
   `;
 
   const btn = container.querySelector('#power-btn')!;
   btn.addEventListener('click', async () => {
-    if (isConnecting) return;
     try {
-      if (isConnected) {
+      if (isConnecting) {
+        await (window as any).go.main.App.Cancel();
+      } else if (isConnected) {
         await (window as any).go.main.App.Disconnect();
       } else {
         await (window as any).go.main.App.Connect();
@@ -65,6 +81,17 @@ function render(container: HTMLElement) {
       console.error('Action failed:', err);
     }
   });
+
+  const toggle = container.querySelector('#kill-switch') as HTMLInputElement;
+  toggle.addEventListener('change', async () => {
+    try {
+      await (window as any).go.main.App.SetKillSwitch(toggle.checked);
+      killSwitch = toggle.checked;
+    } catch (err: any) {
+      toggle.checked = killSwitch;
+      alert('Kill switch failed: ' + (err?.message || err));
+    }
+  });
 }
 
 export function updateConnectionStatus(status: StatusUpdate, container: HTMLElement) {
@@ -1,5 +1,5 @@
 export interface StatusUpdate {
-  status: 'disconnected' | 'connecting' | 'connected' | 'error';
+  status: 'disconnected' | 'connecting' | 'connected' | 'reconnecting' | 'error';
   assignedIP: string;
   error: string;
 }
@@ -21,6 +21,21 @@ export interface ClientConfig {
   interface_name: string;
   api_key: string;
   log_level: string;
+  unregister_on_disconnect: boolean;
+  allowed_ips: string[];
+  exclude_ips: string[];
+  api_tls: boolean;
+  api_ca_file: string;
+  api_cert_sha256: string;
+  register_attempts: number;
+  register_backoff: number;
+  register_jitter: number;
+  kill_switch: boolean;
+  mode: string;
+  proxy_listen: string;
+  transport: string;
+  transport_port: number;
+  obfuscation_key: string;
 }
 
 export type Page = 'connection' | 'config' | 'logs';
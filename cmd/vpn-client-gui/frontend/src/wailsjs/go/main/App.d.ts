@@ -3,6 +3,8 @@
 import {config} from '../models';
 import {main} from '../models';
 
+export function Cancel():Promise<void>;
+
 export function Connect():Promise<void>;
 
 export function Disconnect():Promise<void>;
@@ -19,4 +21,6 @@ export function SaveConfig(arg1:config.ClientConfig):Promise<void>;
 
 export function SaveConfigFileAs(arg1:config.ClientConfig):Promise<void>;
 
+export function SetKillSwitch(arg1:boolean):Promise<void>;
+
 export function ShowWindow():Promise<void>;
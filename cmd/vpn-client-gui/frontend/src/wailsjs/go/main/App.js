@@ -2,6 +2,10 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function Cancel() {
+  return window['go']['main']['App']['Cancel']();
+}
+
 export function Connect() {
   return window['go']['main']['App']['Connect']();
 }
@@ -34,6 +38,10 @@ export function SaveConfigFileAs(arg1) {
   return window['go']['main']['App']['SaveConfigFileAs'](arg1);
 }
 
+export function SetKillSwitch(arg1) {
+  return window['go']['main']['App']['SetKillSwitch'](arg1);
+}
+
 export function ShowWindow() {
   return window['go']['main']['App']['ShowWindow']();
 }
@@ -12,6 +12,21 @@ export namespace config {
 	    interface_name: string;
 	    api_key: string;
 	    log_level: string;
+	    unregister_on_disconnect: boolean;
+	    allowed_ips: string[];
+	    exclude_ips: string[];
+	    api_tls: boolean;
+	    api_ca_file: string;
+	    api_cert_sha256: string;
+	    register_attempts: number;
+	    register_backoff: number;
+	    register_jitter: number;
+	    kill_switch: boolean;
+	    mode: string;
+	    proxy_listen: string;
+	    transport: string;
+	    transport_port: number;
+	    obfuscation_key: string;
 
 	    static createFrom(source: any = {}) {
 	        return new ClientConfig(source);
@@ -30,6 +45,21 @@ export namespace config {
 	        this.interface_name = source["interface_name"];
 	        this.api_key = source["api_key"];
 	        this.log_level = source["log_level"];
+	        this.unregister_on_disconnect = source["unregister_on_disconnect"];
+	        this.allowed_ips = source["allowed_ips"];
+	        this.exclude_ips = source["exclude_ips"];
+	        this.api_tls = source["api_tls"];
+	        this.api_ca_file = source["api_ca_file"];
+	        this.api_cert_sha256 = source["api_cert_sha256"];
+	        this.register_attempts = source["register_attempts"];
+	        this.register_backoff = source["register_backoff"];
+	        this.register_jitter = source["register_jitter"];
+	        this.kill_switch = source["kill_switch"];
+	        this.mode = source["mode"];
+	        this.proxy_listen = source["proxy_listen"];
+	        this.transport = source["transport"];
+	        this.transport_port = source["transport_port"];
+	        this.obfuscation_key = source["obfuscation_key"];
 	    }
 	}
 
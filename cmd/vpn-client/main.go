@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/gavsh/ShikVPN/internal/client"
 	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/network"
 	"github.com/gavsh/ShikVPN/internal/version"
 	"github.com/gavsh/ShikVPN/internal/wintun"
 )
@@ -21,6 +24,8 @@ func main() {
 
 	configPath := flag.String("config", "client.toml", "path to client config file")
 	showVersion := flag.Bool("version", false, "print version and exit")
+	inviteCode := flag.String("invite", "", "join a server with a one-time invite code, writing the config to -config")
+	cleanup := flag.Bool("cleanup", false, "remove kill switch rules left behind by a client that crashed, and exit")
 	flag.Parse()
 
 	if *showVersion {
@@ -28,6 +33,26 @@ func main() {
 		return
 	}
 
+	if *cleanup {
+		if err := network.DisableKillSwitch(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove kill switch rules: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Kill switch rules removed.")
+		return
+	}
+
+	// Ctrl+C aborts a connection attempt in progress as well as an established tunnel
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *inviteCode != "" {
+		if err := joinWithInvite(ctx, *inviteCode, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to join with invite: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	cfg, err := config.LoadClientConfig(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
@@ -40,16 +65,42 @@ func main() {
 	}
 
 	vpnClient := client.New(cfg)
+	vpnClient.OnStateChange(func(change client.StateChange) {
+		// Failed attempts are logged by the client; report each outage once
+		if change.State == client.StateReconnecting && change.Err == nil {
+			log.Println("Connection lost; reconnecting until the server is reachable again (Ctrl+C to give up)")
+		}
+	})
 
-	if err := vpnClient.Connect(); err != nil {
+	if err := vpnClient.Connect(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Println("Connection cancelled")
+			os.Exit(1)
+		}
 		log.Fatalf("Failed to connect: %v", err)
 	}
 
 	// Wait for interrupt signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigCh
-	log.Printf("Received signal %v, disconnecting...", sig)
+	<-ctx.Done()
+	log.Println("Received interrupt, disconnecting...")
 
 	vpnClient.Disconnect()
 }
+
+// joinWithInvite redeems an invite code and saves the resulting config to
+// path. An existing config is never overwritten.
+func joinWithInvite(ctx context.Context, code, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists; pass a different -config path", path)
+	}
+
+	cfg, err := client.RedeemInvite(ctx, code)
+	if err != nil {
+		return err
+	}
+	if err := config.SaveClientConfig(path, cfg); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	log.Printf("Registered with %s as %s; config saved to %s", cfg.Server, cfg.Address, path)
+	return nil
+}
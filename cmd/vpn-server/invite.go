@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+)
+
+// runInvite implements the "invite" subcommand: it issues a single-use,
+// expiring invite code that carries everything a new client needs.
+func runInvite(args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	configPath := fs.String("config", "server.toml", "path to server config file")
+	name := fs.String("name", "", "name for the invite and the token it turns into (default: random)")
+	expires := fs.Duration("expires", 24*time.Hour, "how long the invite code stays valid")
+	fs.Parse(args)
+
+	if *expires <= 0 {
+		return fmt.Errorf("-expires must be positive")
+	}
+
+	cfg, store, err := openTokenStore(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := config.ValidateServerConfig(cfg); err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	inv := config.Invite{
+		Server:          cfg.ExternalHost,
+		APIPort:         cfg.APIPort,
+		ServerPublicKey: cfg.PublicKey,
+		APITLS:          cfg.TLSEnabled(),
+		ObfuscationKey:  cfg.ObfuscationKey,
+	}
+	if cfg.Transport == config.TransportTCP || cfg.Transport == config.TransportWebSocket {
+		inv.Transport, inv.TransportPort = cfg.Transport, cfg.TransportPort
+	}
+	// A self-signed certificate can only be trusted by pinning it
+	if cfg.TLSSelfSigned {
+		if cfg.StateDir == "" {
+			return fmt.Errorf("invites with tls_self_signed require state_dir so the certificate is stable")
+		}
+		cert, err := server.LoadOrCreateSelfSigned(cfg.StateDir, cfg.ExternalHost)
+		if err != nil {
+			return fmt.Errorf("failed to load self-signed certificate: %w", err)
+		}
+		inv.APICertSHA256 = crypto.CertFingerprint(cert.Certificate[0])
+	}
+
+	if *name == "" {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return fmt.Errorf("failed to generate invite name: %w", err)
+		}
+		*name = "invite-" + hex.EncodeToString(suffix)
+	}
+
+	expiresAt := time.Now().Add(*expires)
+	inv.Token, err = store.IssueInvite(*name, expiresAt)
+	if err != nil {
+		return err
+	}
+	code, err := config.EncodeInvite(inv)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Invite %q is valid until %s and works once. Join with:\n", *name, expiresAt.Format(time.DateTime))
+	fmt.Printf("  vpn-client -invite %s\n", code)
+	return nil
+}
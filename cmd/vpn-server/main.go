@@ -15,6 +15,23 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "token":
+			run = runToken
+		case "invite":
+			run = runInvite
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	if err := wintun.Extract(); err != nil {
 		log.Printf("Warning: failed to extract wintun.dll: %v", err)
 	}
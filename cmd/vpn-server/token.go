@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/server"
+)
+
+const tokenUsage = `Usage: vpn-server token <command> [flags]
+
+Commands:
+  issue   create a named token and print its secret
+  revoke  revoke a token; its peers are disconnected
+  list    show all tokens
+
+Run "vpn-server token <command> -h" for the flags of each command.
+`
+
+// runToken implements the "token" subcommand, which manages the token store
+// named by token_file in the server config.
+func runToken(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("missing token command")
+	}
+
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "server.toml", "path to server config file")
+
+	switch args[0] {
+	case "issue":
+		name := fs.String("name", "", "token name, e.g. the user or device it is for (required)")
+		scopes := fs.String("scopes", server.ScopeRegister, "comma-separated scopes: register, admin")
+		expires := fs.Duration("expires", 0, "token lifetime, e.g. 720h (0 never expires)")
+		maxPeers := fs.Int("max-peers", 0, "maximum peers registered with the token (0 is unlimited)")
+		fs.Parse(args[1:])
+
+		_, store, err := openTokenStore(*configPath)
+		if err != nil {
+			return err
+		}
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+		secret, err := store.Issue(*name, splitScopes(*scopes), expiresAt, *maxPeers)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %q issued. Put this in the client's api_key; it is not shown again:\n", *name)
+		fmt.Println(secret)
+		return nil
+
+	case "revoke":
+		name := fs.String("name", "", "name of the token to revoke (required)")
+		fs.Parse(args[1:])
+
+		_, store, err := openTokenStore(*configPath)
+		if err != nil {
+			return err
+		}
+		if err := store.Revoke(*name); err != nil {
+			return err
+		}
+		fmt.Printf("Token %q revoked.\n", *name)
+		return nil
+
+	case "list":
+		fs.Parse(args[1:])
+
+		_, store, err := openTokenStore(*configPath)
+		if err != nil {
+			return err
+		}
+		tokens, err := store.List()
+		if err != nil {
+			return err
+		}
+		printTokens(tokens, time.Now())
+		return nil
+
+	default:
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("unknown token command %q", args[0])
+	}
+}
+
+// openTokenStore loads the server config and opens its token store.
+func openTokenStore(configPath string) (*config.ServerConfig, *server.TokenStore, error) {
+	cfg, err := config.LoadServerConfig(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.TokenFile == "" {
+		return nil, nil, fmt.Errorf("token_file is not set in %s", configPath)
+	}
+	store, err := server.NewTokenStore(cfg.TokenFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, store, nil
+}
+
+func splitScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func printTokens(tokens []server.Token, now time.Time) {
+	if len(tokens) == 0 {
+		fmt.Println("No tokens.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSCOPES\tMAX PEERS\tEXPIRES\tSTATUS")
+	for _, t := range tokens {
+		maxPeers := "unlimited"
+		if t.MaxPeers > 0 {
+			maxPeers = fmt.Sprint(t.MaxPeers)
+		}
+		expires := "never"
+		if t.ExpiresAt != nil {
+			expires = t.ExpiresAt.Local().Format(time.DateTime)
+		}
+		status := "active"
+		switch {
+		case t.Invite && t.Revoked():
+			status = "invite, revoked"
+		case t.Invite && t.Expired(now):
+			status = "invite, expired"
+		case t.Invite:
+			status = "invite, unused"
+		case t.Revoked():
+			status = "revoked"
+		case t.Expired(now):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, strings.Join(t.Scopes, ","), maxPeers, expires, status)
+	}
+	w.Flush()
+}
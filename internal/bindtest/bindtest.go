@@ -0,0 +1,22 @@
+// Package bindtest holds helpers for testing conn.Bind implementations.
+package bindtest
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// Receive reads one datagram from fn and returns it with the endpoint it
+// came from, failing the test if fn does not return exactly one.
+func Receive(t testing.TB, fn conn.ReceiveFunc) (string, conn.Endpoint) {
+	t.Helper()
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fn(bufs, sizes, eps)
+	if err != nil || n != 1 {
+		t.Fatalf("receive = %d, %v", n, err)
+	}
+	return string(bufs[0][:sizes[0]]), eps[0]
+}
@@ -1,17 +1,23 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 
 	"github.com/gavsh/ShikVPN/internal/config"
 	"github.com/gavsh/ShikVPN/internal/crypto"
 	"github.com/gavsh/ShikVPN/internal/network"
+	"github.com/gavsh/ShikVPN/internal/proxy"
 	"github.com/gavsh/ShikVPN/internal/server"
 	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 // Client orchestrates the VPN client: registration, tunnel, and route management.
@@ -21,6 +27,30 @@ type Client struct {
 	tunnel    *tunnel.Tunnel
 	netConfig network.InterfaceConfigurator
 	connected bool
+	dnsSet    bool
+	gateway   string // server's VPN address, from the registration response
+	// defaultRouteSet records that the system default route was replaced,
+	// which only happens in full-tunnel mode.
+	defaultRouteSet bool
+
+	privateKey [crypto.KeySize]byte
+	regResp    *server.RegisterResponse // registration the tunnel was built from
+	peer       tunnel.PeerConfig        // the server peer as configured on the device
+	onState    StateFunc
+	cancel     context.CancelFunc // stops the supervisor and any reconnect in flight
+	wg         sync.WaitGroup
+	// reconfigure serializes changes to the running tunnel by the
+	// supervisor and the network watcher
+	reconfigure sync.Mutex
+	killSwitch  bool             // whether the kill switch rules are installed
+	apiServers  []netip.AddrPort // registration API addresses the kill switch allows
+
+	// In proxy mode, the local proxy and the userspace network stack it
+	// dials through; tunnelNet is nil while the tunnel is down
+	proxy     *proxy.Server
+	tunnelNet *netstack.Net
+
+	bind conn.Bind // transport set by UseBind, or nil for the configured one
 }
 
 // New creates a new VPN client.
@@ -31,8 +61,31 @@ func New(cfg *config.ClientConfig) *Client {
 	}
 }
 
+// OnStateChange registers fn to be called on every connection state change,
+// including reconnects made by the supervisor. It must be set before Connect.
+// fn runs on the client's goroutines and must not call Connect or Disconnect.
+func (c *Client) OnStateChange(fn StateFunc) {
+	c.mu.Lock()
+	c.onState = fn
+	c.mu.Unlock()
+}
+
 // Connect performs registration, creates the tunnel, and sets up routes.
-func (c *Client) Connect() error {
+// Once connected, a supervisor watches the tunnel and re-registers with the
+// server if handshakes stop, and on Linux the client follows network changes
+// by re-resolving the server and moving its bypass route, until Disconnect is
+// called. Cancelling ctx aborts the connection attempt and undoes any partial
+// setup; it has no effect once Connect has returned.
+//
+// With kill_switch set, traffic outside the tunnel is blocked from before
+// registration until Disconnect, including while reconnecting.
+//
+// In proxy mode no TUN device, routes or DNS settings are touched, so no
+// privileges are needed; the tunnel is instead reachable through a local
+// SOCKS5 and HTTP proxy on proxy_listen.
+func (c *Client) Connect(ctx context.Context) (err error) {
+	c.notify(StateConnecting, nil)
+
 	// Derive public key from private key for registration
 	privKey, err := crypto.KeyFromBase64(c.cfg.PrivateKey)
 	if err != nil {
@@ -42,81 +95,213 @@ func (c *Client) Connect() error {
 	if err != nil {
 		return fmt.Errorf("failed to derive public key: %w", err)
 	}
-	pubKeyB64 := crypto.KeyToBase64(pubKey)
-	log.Printf("Client public key: %s", pubKeyB64)
+	c.privateKey = privKey
+	log.Printf("Client public key: %s", crypto.KeyToBase64(pubKey))
+
+	if c.cfg.ServerPublicKey == "" {
+		log.Println("WARNING: server_public_key is not set; trusting whatever key the server reports.")
+	}
+
+	if c.cfg.ProxyMode() {
+		if err := c.startProxy(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.stopProxy()
+			}
+		}()
+	}
+
+	if c.cfg.KillSwitch {
+		if err := c.enableKillSwitch(ctx, ""); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.disableKillSwitch()
+			}
+		}()
+	}
+
+	regResp, err := c.register(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := c.setup(ctx, regResp); err != nil {
+		return err
+	}
+	// Setup itself cannot be interrupted, so check whether the caller gave up meanwhile
+	if err := ctx.Err(); err != nil {
+		c.teardown()
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.connected = true
+	c.cancel = cancel
+	c.mu.Unlock()
+	log.Println("VPN connected successfully")
+
+	// Without keepalives an idle tunnel has no handshakes to watch
+	if c.cfg.PersistentKeepalive > 0 {
+		c.wg.Add(1)
+		go c.supervise(runCtx)
+	} else {
+		log.Println("Warning: persistent_keepalive is disabled; the tunnel will not be monitored or reconnected")
+	}
 
-	// Register with server
+	changes, err := network.WatchChanges(runCtx)
+	switch {
+	case err == nil:
+		c.wg.Add(1)
+		go c.watchNetwork(runCtx, changes)
+	case !errors.Is(err, network.ErrWatchUnsupported):
+		log.Printf("Warning: cannot watch for network changes: %v", err)
+	}
+
+	c.notify(StateConnected, nil)
+	return nil
+}
+
+// register registers this client with the server and validates the response.
+func (c *Client) register(ctx context.Context) (*server.RegisterResponse, error) {
+	httpClient, err := c.newAPIClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up API client: %w", err)
+	}
 	apiURL := c.cfg.ServerAPIURL()
 	log.Printf("Registering with server at %s...", apiURL)
-	regResp, err := Register(apiURL, pubKeyB64, c.cfg.APIKey)
+	regResp, err := Register(ctx, httpClient, apiURL, c.privateKey, c.cfg.ServerPublicKey, c.cfg.APIKey, RetryPolicyFromConfig(c.cfg))
 	if err != nil {
-		return fmt.Errorf("registration failed: %w", err)
+		return nil, fmt.Errorf("registration failed: %w", err)
 	}
 	log.Printf("Registered successfully. Assigned IP: %s", regResp.AssignedIP)
 
 	// Validate server response before trusting it
 	if err := validateRegistrationResponse(regResp); err != nil {
-		return fmt.Errorf("invalid registration response: %w", err)
+		return nil, fmt.Errorf("invalid registration response: %w", err)
 	}
+	return regResp, nil
+}
 
+// setup creates and configures the tunnel, routes and DNS for a registration.
+// On failure the tunnel is closed again.
+func (c *Client) setup(ctx context.Context, regResp *server.RegisterResponse) error {
 	// Store server public key and assigned address
 	c.cfg.ServerPublicKey = regResp.ServerPublicKey
 	c.cfg.Address = regResp.AssignedIP
+	c.gateway = regResp.Gateway
 
-	// Use the endpoint returned by the server's registration response
-	serverEndpoint := regResp.ServerEndpoint
-
-	// Create TUN device
-	tun, err := tunnel.CreateTunnel(c.cfg.InterfaceName, c.cfg.MTU, c.cfg.LogLevel)
+	// Use the endpoint returned by the server's registration response;
+	// WireGuard and the bypass route both need an address, not a name
+	serverEndpoint, err := c.resolveServerEndpoint(ctx, regResp.ServerEndpoint)
 	if err != nil {
-		return fmt.Errorf("failed to create tunnel: %w", err)
+		return err
+	}
+
+	// Local DNS setting overrides the servers pushed by the server
+	dnsServers := regResp.DNSServers
+	if local := c.cfg.DNSServers(); len(local) > 0 {
+		dnsServers = local
+	}
+
+	// Create TUN device, or a userspace network stack in proxy mode
+	var tnet *netstack.Net
+	if c.cfg.ProxyMode() {
+		tun, n, err := c.createNetstackTunnel(regResp, dnsServers)
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+		c.tunnel, tnet = tun, n
+		log.Println("Created userspace network stack")
+	} else {
+		bind, err := c.newBind()
+		if err != nil {
+			return err
+		}
+		tun, err := tunnel.CreateTunnel(c.cfg.InterfaceName, c.cfg.MTU, c.cfg.LogLevel, bind)
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+		c.tunnel = tun
+		log.Printf("Created TUN device: %s", tun.Name())
+	}
+
+	// Let the handshake through before WireGuard starts sending
+	if err := c.applyKillSwitch(serverEndpoint); err != nil {
+		c.closeTunnel()
+		return err
 	}
-	c.tunnel = tun
-	log.Printf("Created TUN device: %s", tun.Name())
 
 	// Convert keys to hex for UAPI
-	privKeyHex := crypto.KeyToHex(privKey)
+	privKeyHex := crypto.KeyToHex(c.privateKey)
 	serverPubKeyHex, err := crypto.Base64ToHex(c.cfg.ServerPublicKey)
 	if err != nil {
-		c.tunnel.Close()
+		c.closeTunnel()
 		return fmt.Errorf("invalid server public key: %w", err)
 	}
 
+	// Work out what goes through the tunnel; IPv6 is only tunneled by
+	// default when the server assigned an address
+	plan, err := planRoutes(c.cfg.AllowedIPs, regResp.Routes, c.cfg.ExcludeIPs,
+		regResp.AssignedIP6 != "", endpointAddr(serverEndpoint))
+	if err != nil {
+		c.closeTunnel()
+		return fmt.Errorf("failed to plan routes: %w", err)
+	}
+	allowedIPs := make([]string, len(plan.AllowedIPs))
+	for i, p := range plan.AllowedIPs {
+		allowedIPs[i] = p.String()
+	}
+	if !plan.FullTunnel {
+		log.Printf("Split tunnel: routing %s through the VPN", strings.Join(allowedIPs, ", "))
+	}
+
 	// Configure WireGuard
 	peer := tunnel.PeerConfig{
 		PublicKeyHex:        serverPubKeyHex,
 		Endpoint:            serverEndpoint,
-		AllowedIPs:          []string{"0.0.0.0/0"},
+		AllowedIPs:          allowedIPs,
 		PersistentKeepalive: c.cfg.PersistentKeepalive,
 	}
 
 	uapi := tunnel.BuildClientUAPIConfig(privKeyHex, peer)
+	// The mark keeps WireGuard's own packets off the tunnel routes; in proxy
+	// mode there are none, and setting it would need privileges
+	if router, ok := c.netConfig.(network.PolicyRouter); ok && !c.cfg.ProxyMode() {
+		uapi = tunnel.BuildFwmarkUAPI(router.FwMark()) + uapi
+	}
 	if err := c.tunnel.Configure(uapi); err != nil {
-		c.tunnel.Close()
+		c.closeTunnel()
 		return fmt.Errorf("failed to configure WireGuard: %w", err)
 	}
 
 	// Bring device up
 	if err := c.tunnel.Up(); err != nil {
-		c.tunnel.Close()
+		c.closeTunnel()
 		return fmt.Errorf("failed to bring up WireGuard device: %w", err)
 	}
 	log.Println("WireGuard device is up")
 
-	// Configure network interface
-	if err := c.configureNetwork(serverEndpoint); err != nil {
-		c.tunnel.Close()
+	if tnet != nil {
+		// The proxy dials through the stack from now on
+		c.mu.Lock()
+		c.tunnelNet = tnet
+		c.mu.Unlock()
+	} else if err := c.configureNetwork(serverEndpoint, regResp.AssignedIP6, plan, dnsServers); err != nil {
+		c.teardown()
 		return fmt.Errorf("failed to configure network: %w", err)
 	}
 
-	c.mu.Lock()
-	c.connected = true
-	c.mu.Unlock()
-	log.Println("VPN connected successfully")
+	c.regResp = regResp
+	c.peer = peer
 	return nil
 }
 
-func (c *Client) configureNetwork(serverEndpoint string) error {
+func (c *Client) configureNetwork(serverEndpoint string, address6 string, plan routePlan, dnsServers []string) error {
 	ifaceName := c.tunnel.Name()
 
 	// Assign the VPN IP to the interface
@@ -125,24 +310,64 @@ func (c *Client) configureNetwork(serverEndpoint string) error {
 	}
 	log.Printf("Assigned address %s to %s", c.cfg.Address, ifaceName)
 
+	if address6 != "" {
+		if err := c.netConfig.AssignAddress(ifaceName, address6); err != nil {
+			return fmt.Errorf("failed to assign IPv6 address: %w", err)
+		}
+		log.Printf("Assigned address %s to %s", address6, ifaceName)
+	}
+
 	// Set interface up
 	if err := c.netConfig.SetInterfaceUp(ifaceName); err != nil {
 		return fmt.Errorf("failed to set interface up: %w", err)
 	}
 
-	// Extract gateway IP (the server's VPN IP, typically x.x.x.1)
-	gateway := extractGateway(c.cfg.Address)
+	// Servers that predate the gateway field always used the .1 address
+	gateway := c.gateway
+	if gateway == "" {
+		gateway = legacyGateway(c.cfg.Address)
+	}
 
 	// Set default route through VPN
-	if err := c.netConfig.SetDefaultRoute(ifaceName, gateway, serverEndpoint); err != nil {
-		log.Printf("Warning: failed to set default route: %v", err)
-		log.Println("VPN is connected but traffic may not be routed through it")
+	if plan.FullTunnel {
+		if err := c.netConfig.SetDefaultRoute(ifaceName, gateway, serverEndpoint); err != nil {
+			log.Printf("Warning: failed to set default route: %v", err)
+			log.Println("VPN is connected but traffic may not be routed through it")
+		} else {
+			c.defaultRouteSet = true
+		}
+	}
+
+	// Route everything else per prefix. These routes are bound to the
+	// interface and disappear with it, so Disconnect needs no cleanup.
+	for _, p := range installablePrefixes(plan.AllowedIPs) {
+		if plan.FullTunnel && p.Addr().Is4() && p.Bits() <= 1 {
+			continue // covered by the default route
+		}
+		if p.Addr().Is6() && address6 == "" {
+			log.Printf("Warning: skipping IPv6 route %s: server did not assign an IPv6 address", p)
+			continue
+		}
+		if err := c.netConfig.AddRoute(p.String(), "", ifaceName); err != nil {
+			log.Printf("Warning: failed to add route %s: %v", p, err)
+		}
+	}
+
+	// Send DNS queries through the tunnel so they do not leak
+	if len(dnsServers) > 0 {
+		if err := c.netConfig.SetDNS(ifaceName, dnsServers); err != nil {
+			log.Printf("Warning: failed to set DNS servers: %v", err)
+			log.Println("DNS queries may be resolved outside the VPN")
+		} else {
+			c.dnsSet = true
+			log.Printf("DNS servers set to %s", strings.Join(dnsServers, ", "))
+		}
 	}
 
 	return nil
 }
 
-// Disconnect tears down the VPN tunnel and restores routes.
+// Disconnect stops the supervisor, tears down the VPN tunnel and restores routes.
 func (c *Client) Disconnect() {
 	c.mu.Lock()
 	if !c.connected {
@@ -150,22 +375,80 @@ func (c *Client) Disconnect() {
 		return
 	}
 	c.connected = false
+	cancel := c.cancel
 	c.mu.Unlock()
 	log.Println("Disconnecting VPN...")
 
-	if c.tunnel != nil {
-		ifaceName := c.tunnel.Name()
+	cancel()
+	c.wg.Wait()
+
+	c.teardown()
+	c.stopProxy()
 
-		// Restore default route
+	if c.cfg.UnregisterOnDisconnect {
+		c.unregister()
+	}
+	c.disableKillSwitch()
+
+	log.Println("VPN disconnected")
+	c.notify(StateDisconnected, nil)
+}
+
+// teardown restores DNS and routes and closes the tunnel, if one is open.
+func (c *Client) teardown() {
+	if c.tunnel == nil {
+		return
+	}
+	ifaceName := c.tunnel.Name()
+
+	// Restore DNS before the interface it is bound to goes away
+	if c.dnsSet {
+		if err := c.netConfig.RestoreDNS(ifaceName); err != nil {
+			log.Printf("Warning: failed to restore DNS settings: %v", err)
+		}
+		c.dnsSet = false
+	}
+
+	// Restore default route
+	if c.defaultRouteSet {
 		if err := c.netConfig.RemoveDefaultRoute(ifaceName); err != nil {
 			log.Printf("Warning: failed to restore default route: %v", err)
 		}
-
-		c.tunnel.Close()
-		log.Println("Tunnel closed")
+		c.defaultRouteSet = false
 	}
 
-	log.Println("VPN disconnected")
+	c.closeTunnel()
+	log.Println("Tunnel closed")
+}
+
+// closeTunnel closes the tunnel device without touching routes or DNS.
+func (c *Client) closeTunnel() {
+	c.mu.Lock()
+	c.tunnelNet = nil
+	c.mu.Unlock()
+
+	c.tunnel.Close()
+	c.tunnel = nil
+}
+
+// unregister releases this client's peer and IP address on the server.
+// Failures are logged but do not block disconnecting.
+func (c *Client) unregister() {
+	privKey, err := crypto.KeyFromBase64(c.cfg.PrivateKey)
+	if err != nil {
+		log.Printf("Warning: cannot unregister: invalid private key: %v", err)
+		return
+	}
+	httpClient, err := c.newAPIClient()
+	if err != nil {
+		log.Printf("Warning: cannot unregister: %v", err)
+		return
+	}
+	if err := Unregister(httpClient, c.cfg.ServerAPIURL(), privKey, c.cfg.ServerPublicKey, c.cfg.APIKey); err != nil {
+		log.Printf("Warning: failed to unregister from server: %v", err)
+		return
+	}
+	log.Println("Unregistered from server")
 }
 
 // validateRegistrationResponse checks that all fields from the server are well-formed
@@ -175,6 +458,27 @@ func validateRegistrationResponse(resp *server.RegisterResponse) error {
 	if _, _, err := net.ParseCIDR(resp.AssignedIP); err != nil {
 		return fmt.Errorf("assigned_ip is not a valid CIDR: %w", err)
 	}
+	// Validate AssignedIP6, if present, is an IPv6 CIDR
+	if resp.AssignedIP6 != "" {
+		ip, _, err := net.ParseCIDR(resp.AssignedIP6)
+		if err != nil {
+			return fmt.Errorf("assigned_ip6 is not a valid CIDR: %w", err)
+		}
+		if ip.To4() != nil {
+			return fmt.Errorf("assigned_ip6 %q is not an IPv6 address", resp.AssignedIP6)
+		}
+	}
+	// Validate Gateway, if present, is an address inside the assigned subnet
+	if resp.Gateway != "" {
+		_, subnet, _ := net.ParseCIDR(resp.AssignedIP)
+		gw := net.ParseIP(resp.Gateway)
+		if gw == nil {
+			return fmt.Errorf("gateway %q is not a valid IP address", resp.Gateway)
+		}
+		if !subnet.Contains(gw) {
+			return fmt.Errorf("gateway %s is outside the assigned subnet %s", resp.Gateway, subnet.String())
+		}
+	}
 	// Validate ServerPublicKey is a valid 32-byte base64-encoded key
 	if _, err := crypto.KeyFromBase64(resp.ServerPublicKey); err != nil {
 		return fmt.Errorf("server_public_key is invalid: %w", err)
@@ -184,6 +488,12 @@ func validateRegistrationResponse(resp *server.RegisterResponse) error {
 	if err != nil || host == "" || port == "" {
 		return fmt.Errorf("server_endpoint %q is not a valid host:port", resp.ServerEndpoint)
 	}
+	// Validate pushed routes are CIDRs
+	for _, route := range resp.Routes {
+		if _, _, err := net.ParseCIDR(route); err != nil {
+			return fmt.Errorf("route %q is not a valid CIDR", route)
+		}
+	}
 	// Validate DNS servers are valid IPs
 	for _, dns := range resp.DNSServers {
 		if net.ParseIP(dns) == nil {
@@ -193,9 +503,23 @@ func validateRegistrationResponse(resp *server.RegisterResponse) error {
 	return nil
 }
 
-// extractGateway derives the gateway IP from a CIDR address.
-// e.g., "10.0.0.2/24" -> "10.0.0.1"
-func extractGateway(address string) string {
+// endpointAddr returns the IP address of a host:port endpoint, or the zero
+// Addr if the host is not a literal IP.
+func endpointAddr(endpoint string) netip.Addr {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// legacyGateway derives the gateway the way older servers assigned it,
+// by setting the last octet to 1. e.g., "10.0.0.2/24" -> "10.0.0.1"
+func legacyGateway(address string) string {
 	ipStr := strings.SplitN(address, "/", 2)[0]
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+)
+
+func validResponse(t *testing.T) *server.RegisterResponse {
+	t.Helper()
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error: %v", err)
+	}
+	return &server.RegisterResponse{
+		AssignedIP:      "10.8.1.7/22",
+		Gateway:         "10.8.0.254",
+		ServerPublicKey: crypto.KeyToBase64(kp.PublicKey),
+		ServerEndpoint:  "1.2.3.4:51820",
+		DNSServers:      []string{"1.1.1.1"},
+		MTU:             1420,
+	}
+}
+
+func TestValidateRegistrationResponseNon24(t *testing.T) {
+	if err := validateRegistrationResponse(validResponse(t)); err != nil {
+		t.Errorf("validateRegistrationResponse() error: %v", err)
+	}
+}
+
+func TestValidateRegistrationResponseInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(r *server.RegisterResponse)
+		want   string
+	}{
+		{
+			name:   "gateway outside subnet",
+			mutate: func(r *server.RegisterResponse) { r.Gateway = "10.8.4.1" },
+			want:   "outside the assigned subnet",
+		},
+		{
+			name:   "gateway not an IP",
+			mutate: func(r *server.RegisterResponse) { r.Gateway = "gw" },
+			want:   "gateway",
+		},
+		{
+			name:   "assigned IP without prefix",
+			mutate: func(r *server.RegisterResponse) { r.AssignedIP = "10.8.1.7" },
+			want:   "assigned_ip",
+		},
+		{
+			name:   "bad route",
+			mutate: func(r *server.RegisterResponse) { r.Routes = []string{"10.20.0.0"} },
+			want:   "route",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := validResponse(t)
+			tt.mutate(resp)
+			err := validateRegistrationResponse(resp)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want to contain %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyGateway(t *testing.T) {
+	if got := legacyGateway("10.0.0.2/24"); got != "10.0.0.1" {
+		t.Errorf("legacyGateway() = %q, want 10.0.0.1", got)
+	}
+	if got := legacyGateway("fd00::2/64"); got != "" {
+		t.Errorf("legacyGateway() = %q for IPv6, want empty", got)
+	}
+}
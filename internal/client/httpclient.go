@@ -0,0 +1,82 @@
+package client
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+)
+
+// apiTimeout bounds every request to the server API.
+const apiTimeout = 10 * time.Second
+
+// errCertificatePin is returned when the server certificate does not match api_cert_sha256.
+var errCertificatePin = errors.New("server certificate does not match api_cert_sha256")
+
+// NewHTTPClient builds the HTTP client used to talk to the server API.
+// With api_ca_file the server certificate must chain to that CA instead of
+// the system roots. With api_cert_sha256 the server's leaf certificate must
+// match the pinned fingerprint; on its own the pin replaces CA verification,
+// which is how self-signed server certificates are trusted.
+func NewHTTPClient(cfg *config.ClientConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return &http.Client{Timeout: apiTimeout}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: apiTimeout, Transport: transport}, nil
+}
+
+// newTLSConfig returns the TLS settings for connections to the server API,
+// or nil without api_tls. The WebSocket transport shares them.
+func newTLSConfig(cfg *config.ClientConfig) (*tls.Config, error) {
+	if !cfg.APITLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.APICAFile != "" {
+		caPEM, err := os.ReadFile(cfg.APICAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("api_ca_file %s contains no PEM certificates", cfg.APICAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.APICertSHA256 != "" {
+		pin, err := crypto.NormalizeFingerprint(cfg.APICertSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("api_cert_sha256 is invalid: %w", err)
+		}
+		// Without a CA the pin is the only check, so skip chain verification
+		tlsConfig.InsecureSkipVerify = cfg.APICAFile == ""
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			got := crypto.CertFingerprint(rawCerts[0])
+			if subtle.ConstantTimeCompare([]byte(got), []byte(pin)) != 1 {
+				return fmt.Errorf("%w (got %s)", errCertificatePin, got)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+)
+
+func newTLSRegisterServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	handler, _ := newRegisterHandler(t)
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testPrivateKey(t *testing.T) [crypto.KeySize]byte {
+	t.Helper()
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error: %v", err)
+	}
+	return kp.PrivateKey
+}
+
+func testTLSConfig(pin string) *config.ClientConfig {
+	return &config.ClientConfig{APITLS: true, APICertSHA256: pin}
+}
+
+func TestRegisterWithPinnedCertificate(t *testing.T) {
+	srv := newTLSRegisterServer(t)
+	pin := crypto.CertFingerprint(srv.Certificate().Raw)
+
+	httpClient, err := NewHTTPClient(testTLSConfig(strings.ToUpper(pin)))
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error: %v", err)
+	}
+	resp, err := Register(context.Background(), httpClient, srv.URL, testPrivateKey(t), "", "", DefaultRetryPolicy())
+	if err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+	if resp.AssignedIP != "10.0.0.2/24" {
+		t.Errorf("AssignedIP = %q, want 10.0.0.2/24", resp.AssignedIP)
+	}
+}
+
+func TestRegisterRejectsWrongPin(t *testing.T) {
+	srv := newTLSRegisterServer(t)
+
+	httpClient, err := NewHTTPClient(testTLSConfig(strings.Repeat("ab", 32)))
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error: %v", err)
+	}
+	_, err = Register(context.Background(), httpClient, srv.URL, testPrivateKey(t), "", "", DefaultRetryPolicy())
+	if !errors.Is(err, errCertificatePin) {
+		t.Fatalf("Register() error = %v, want certificate pin mismatch", err)
+	}
+}
+
+func TestRegisterRejectsUntrustedCertificate(t *testing.T) {
+	srv := newTLSRegisterServer(t)
+
+	httpClient, err := NewHTTPClient(&config.ClientConfig{APITLS: true})
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error: %v", err)
+	}
+	_, err = Register(context.Background(), httpClient, srv.URL, testPrivateKey(t), "", "", DefaultRetryPolicy())
+	if err == nil || !isCertificateError(err) {
+		t.Fatalf("Register() error = %v, want certificate verification error", err)
+	}
+}
+
+func TestRegisterWithCAFile(t *testing.T) {
+	srv := newTLSRegisterServer(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	httpClient, err := NewHTTPClient(&config.ClientConfig{APITLS: true, APICAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error: %v", err)
+	}
+	if _, err := Register(context.Background(), httpClient, srv.URL, testPrivateKey(t), "", "", DefaultRetryPolicy()); err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+}
+
+func TestNewHTTPClientBadCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0600)
+
+	if _, err := NewHTTPClient(&config.ClientConfig{APITLS: true, APICAFile: caFile}); err == nil {
+		t.Error("expected error for CA file without certificates")
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+)
+
+// RedeemInvite registers a new keypair with the server named in an invite
+// code and returns a complete client config for it. The server consumes the
+// invite and issues a regular token, which becomes the config's api_key.
+// Cancelling ctx abandons the registration.
+func RedeemInvite(ctx context.Context, code string) (*config.ClientConfig, error) {
+	inv, err := config.DecodeInvite(code)
+	if err != nil {
+		return nil, err
+	}
+	cfg := inv.ClientConfig()
+
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+	}
+	cfg.PrivateKey = crypto.KeyToBase64(kp.PrivateKey)
+
+	httpClient, err := NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	regResp, err := Register(ctx, httpClient, cfg.ServerAPIURL(), kp.PrivateKey, cfg.ServerPublicKey, cfg.APIKey, RetryPolicyFromConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	if regResp.APIToken == "" {
+		return nil, fmt.Errorf("server did not issue a token for the invite")
+	}
+
+	cfg.APIKey = regResp.APIToken
+	cfg.Address = regResp.AssignedIP
+	if err := config.ValidateClientConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invite produced an invalid config: %w", err)
+	}
+	return cfg, nil
+}
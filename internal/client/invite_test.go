@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// newInviteServer starts a registration API backed by a token store and
+// returns an invite code for it.
+func newInviteServer(t *testing.T) string {
+	t.Helper()
+
+	tokens, err := server.NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("NewTokenStore() error: %v", err)
+	}
+	ipam, _ := server.NewIPAM("10.0.0.1/24", nil)
+	kp, _ := crypto.GenerateKeyPair()
+	serverPub := crypto.KeyToBase64(kp.PublicKey)
+	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := server.NewAPI(ipam, kp.PrivateKey, serverPub, "1.2.3.4:51820", nil, nil, 1420, "", tokens, noop, noopRemove)
+	srv := httptest.NewServer(api.Handler())
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	secret, err := tokens.IssueInvite("newhire", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("IssueInvite() error: %v", err)
+	}
+	code, err := config.EncodeInvite(config.Invite{
+		Server:          u.Hostname(),
+		APIPort:         port,
+		Token:           secret,
+		ServerPublicKey: serverPub,
+	})
+	if err != nil {
+		t.Fatalf("EncodeInvite() error: %v", err)
+	}
+	return code
+}
+
+func TestRedeemInvite(t *testing.T) {
+	code := newInviteServer(t)
+
+	cfg, err := RedeemInvite(context.Background(), code)
+	if err != nil {
+		t.Fatalf("RedeemInvite() error: %v", err)
+	}
+	if cfg.Address != "10.0.0.2/24" {
+		t.Errorf("Address = %q, want 10.0.0.2/24", cfg.Address)
+	}
+	if cfg.PrivateKey == "" {
+		t.Error("PrivateKey not set")
+	}
+	inv, _ := config.DecodeInvite(code)
+	if cfg.APIKey == "" || cfg.APIKey == inv.Token {
+		t.Errorf("APIKey = %q, want the token issued in exchange for the invite", cfg.APIKey)
+	}
+
+	// Invites are single use
+	if _, err := RedeemInvite(context.Background(), code); err == nil {
+		t.Error("expected error redeeming the invite twice")
+	}
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/network"
+)
+
+// SetKillSwitch turns the kill switch on or off. On a connected client the
+// firewall rules change immediately; otherwise the setting applies to the
+// next Connect.
+func (c *Client) SetKillSwitch(ctx context.Context, enabled bool) error {
+	if enabled && c.cfg.ProxyMode() {
+		return fmt.Errorf("the kill switch is not available in proxy mode")
+	}
+
+	c.reconfigure.Lock()
+	defer c.reconfigure.Unlock()
+
+	c.mu.Lock()
+	c.cfg.KillSwitch = enabled
+	connected := c.connected
+	c.mu.Unlock()
+
+	if !connected {
+		return nil
+	}
+	if !enabled {
+		c.disableKillSwitch()
+		return nil
+	}
+	return c.enableKillSwitch(ctx, c.peer.Endpoint)
+}
+
+// enableKillSwitch resolves the registration API, which must stay reachable
+// for reconnects, and blocks all other traffic outside the tunnel.
+func (c *Client) enableKillSwitch(ctx context.Context, endpoint string) error {
+	servers, err := c.resolveAPIServers(ctx)
+	if err != nil {
+		return fmt.Errorf("kill switch: %w", err)
+	}
+	c.apiServers = servers
+	c.killSwitch = true
+	if err := c.applyKillSwitch(endpoint); err != nil {
+		c.disableKillSwitch()
+		return err
+	}
+	log.Println("Kill switch enabled: traffic outside the tunnel is blocked")
+	return nil
+}
+
+// applyKillSwitch updates the kill switch rules for the current tunnel and
+// the given server endpoint, if the kill switch is on.
+func (c *Client) applyKillSwitch(endpoint string) error {
+	if !c.killSwitch {
+		return nil
+	}
+	rules := network.KillSwitchRules{
+		TunnelInterface: c.cfg.InterfaceName,
+		APIServers:      c.apiServers,
+	}
+	if c.tunnel != nil {
+		rules.TunnelInterface = c.tunnel.Name()
+	}
+	if ep, err := netip.ParseAddrPort(endpoint); err == nil {
+		switch c.cfg.Transport {
+		case config.TransportTCP, config.TransportWebSocket:
+			rules.StreamEndpoints = []netip.AddrPort{c.streamEndpoint(ep)}
+		default:
+			rules.Endpoints = []netip.AddrPort{ep}
+		}
+	}
+	if err := network.EnableKillSwitch(rules); err != nil {
+		return fmt.Errorf("failed to apply kill switch: %w", err)
+	}
+	return nil
+}
+
+// disableKillSwitch removes the kill switch rules, if they are installed.
+func (c *Client) disableKillSwitch() {
+	if !c.killSwitch {
+		return
+	}
+	c.killSwitch = false
+	if err := network.DisableKillSwitch(); err != nil {
+		log.Printf("Warning: failed to remove kill switch rules: %v", err)
+		log.Println("Run \"vpn-client -cleanup\" to restore network access")
+		return
+	}
+	log.Println("Kill switch disabled")
+}
+
+// resolveAPIServers returns the addresses of the registration API.
+func (c *Client) resolveAPIServers(ctx context.Context) ([]netip.AddrPort, error) {
+	port := uint16(c.cfg.APIPort)
+	if addr, err := netip.ParseAddr(c.cfg.Server); err == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(addr.Unmap(), port)}, nil
+	}
+
+	addrs, err := lookupHost(ctx, "ip", c.cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server %s: %w", c.cfg.Server, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("server %s has no addresses", c.cfg.Server)
+	}
+	servers := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		servers[i] = netip.AddrPortFrom(addr.Unmap(), port)
+	}
+	return servers, nil
+}
+
+// newAPIClient returns the HTTP client for the server API. The kill switch
+// blocks DNS outside the tunnel, so while it is on connections go to the
+// addresses it allows instead of looking up the server's name; the URL, and
+// with it the Host header and TLS server name, keeps the name.
+func (c *Client) newAPIClient() (*http.Client, error) {
+	httpClient, err := NewHTTPClient(c.cfg)
+	if err != nil || !c.killSwitch || len(c.apiServers) == 0 {
+		return httpClient, err
+	}
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	// A proxy would be blocked by the kill switch anyway
+	transport.Proxy = nil
+	servers := c.apiServers
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		var err error
+		for _, server := range servers {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, server.String()); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	httpClient.Transport = transport
+	return httpClient, nil
+}
+
+// resolveServerEndpoint is resolveEndpoint for a client whose kill switch may
+// be blocking DNS. An endpoint on the API server's host uses the address the
+// API was resolved to; any other name falls back to the current endpoint if
+// it cannot be looked up.
+func (c *Client) resolveServerEndpoint(ctx context.Context, endpoint string) (string, error) {
+	if !c.killSwitch {
+		return resolveEndpoint(ctx, endpoint)
+	}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid server endpoint %q: %w", endpoint, err)
+	}
+	if host == c.cfg.Server && len(c.apiServers) > 0 {
+		addr := c.apiServers[0].Addr()
+		for _, server := range c.apiServers {
+			if server.Addr().Is4() {
+				addr = server.Addr()
+				break
+			}
+		}
+		return net.JoinHostPort(addr.String(), port), nil
+	}
+
+	resolved, err := resolveEndpoint(ctx, endpoint)
+	if err != nil && c.peer.Endpoint != "" {
+		log.Printf("Warning: %v; keeping %s", err, c.peer.Endpoint)
+		return c.peer.Endpoint, nil
+	}
+	return resolved, err
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+)
+
+func TestResolveAPIServers(t *testing.T) {
+	orig := lookupHost
+	t.Cleanup(func() { lookupHost = orig })
+	lookupHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("2001:db8::1")}, nil
+	}
+
+	c := New(&config.ClientConfig{Server: "vpn.example.com", APIPort: 8443})
+	got, err := c.resolveAPIServers(context.Background())
+	if err != nil {
+		t.Fatalf("resolveAPIServers() error: %v", err)
+	}
+	want := []netip.AddrPort{netip.MustParseAddrPort("203.0.113.7:8443"), netip.MustParseAddrPort("[2001:db8::1]:8443")}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolveAPIServers() = %v, want %v", got, want)
+	}
+
+	c = New(&config.ClientConfig{Server: "198.51.100.1", APIPort: 8080})
+	got, err = c.resolveAPIServers(context.Background())
+	if err != nil {
+		t.Fatalf("resolveAPIServers() error: %v", err)
+	}
+	if len(got) != 1 || got[0] != netip.MustParseAddrPort("198.51.100.1:8080") {
+		t.Errorf("resolveAPIServers() = %v, want [198.51.100.1:8080]", got)
+	}
+}
+
+func TestKillSwitchReachesHostnameServer(t *testing.T) {
+	orig := lookupHost
+	t.Cleanup(func() { lookupHost = orig })
+	lookupHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return nil, errors.New("DNS is blocked by the kill switch")
+	}
+
+	var gotHost string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+	}))
+	defer ts.Close()
+	apiAddr := netip.MustParseAddrPort(ts.Listener.Addr().String())
+
+	c := New(&config.ClientConfig{Server: "vpn.example.com", APIPort: int(apiAddr.Port())})
+	c.killSwitch = true
+	c.apiServers = []netip.AddrPort{apiAddr}
+
+	httpClient, err := c.newAPIClient()
+	if err != nil {
+		t.Fatalf("newAPIClient() error: %v", err)
+	}
+	resp, err := httpClient.Get(c.cfg.ServerAPIURL() + "/api/v1/health")
+	if err != nil {
+		t.Fatalf("GET through the kill switch error: %v", err)
+	}
+	resp.Body.Close()
+	if want := net.JoinHostPort("vpn.example.com", strconv.Itoa(int(apiAddr.Port()))); gotHost != want {
+		t.Errorf("Host = %q, want %q", gotHost, want)
+	}
+
+	// The WireGuard endpoint on the same host uses the API's address
+	got, err := c.resolveServerEndpoint(context.Background(), "vpn.example.com:51820")
+	if err != nil {
+		t.Fatalf("resolveServerEndpoint() error: %v", err)
+	}
+	if got != "127.0.0.1:51820" {
+		t.Errorf("resolveServerEndpoint() = %q, want 127.0.0.1:51820", got)
+	}
+
+	// Another host that cannot be looked up keeps the current endpoint
+	c.peer.Endpoint = "198.51.100.9:51820"
+	got, err = c.resolveServerEndpoint(context.Background(), "wg.example.com:51820")
+	if err != nil {
+		t.Fatalf("resolveServerEndpoint() error: %v", err)
+	}
+	if got != c.peer.Endpoint {
+		t.Errorf("resolveServerEndpoint() = %q, want %q", got, c.peer.Endpoint)
+	}
+}
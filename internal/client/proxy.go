@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/gavsh/ShikVPN/internal/proxy"
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// errTunnelDown is returned to proxy clients while the tunnel is being rebuilt.
+var errTunnelDown = errors.New("VPN tunnel is not connected")
+
+// startProxy starts the local SOCKS5/HTTP proxy. It listens before the
+// tunnel exists so that a busy port fails the connection early; requests
+// made while the tunnel is down fail until it is up.
+func (c *Client) startProxy() error {
+	p := proxy.New(c.dialTunnel)
+	addr, err := p.Listen(c.cfg.ProxyListen)
+	if err != nil {
+		return fmt.Errorf("failed to start proxy: %w", err)
+	}
+	c.proxy = p
+	log.Printf("SOCKS5 and HTTP proxy listening on %s", addr)
+	return nil
+}
+
+// ProxyAddr returns the address the proxy listens on in proxy mode, or nil
+// if it is not running.
+func (c *Client) ProxyAddr() net.Addr {
+	if c.proxy == nil {
+		return nil
+	}
+	return c.proxy.Addr()
+}
+
+// stopProxy closes the proxy and every connection made through it.
+func (c *Client) stopProxy() {
+	if c.proxy == nil {
+		return
+	}
+	c.proxy.Close()
+	c.proxy = nil
+}
+
+// dialTunnel connects to address through the userspace network stack.
+func (c *Client) dialTunnel(ctx context.Context, network, address string) (net.Conn, error) {
+	c.mu.Lock()
+	tnet := c.tunnelNet
+	c.mu.Unlock()
+	if tnet == nil {
+		return nil, errTunnelDown
+	}
+	return tnet.DialContext(ctx, network, address)
+}
+
+// createNetstackTunnel creates a tunnel on a userspace network stack that
+// owns the addresses assigned by regResp and resolves names with dnsServers.
+func (c *Client) createNetstackTunnel(regResp *server.RegisterResponse, dnsServers []string) (*tunnel.Tunnel, *netstack.Net, error) {
+	var addresses []netip.Addr
+	for _, cidr := range []string{regResp.AssignedIP, regResp.AssignedIP6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid assigned address %q: %w", cidr, err)
+		}
+		addresses = append(addresses, prefix.Addr())
+	}
+	var dns []netip.Addr
+	for _, s := range dnsServers {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid DNS server %q: %w", s, err)
+		}
+		dns = append(dns, addr)
+	}
+	if len(dns) == 0 {
+		log.Println("Warning: no DNS servers configured; proxy clients must connect by IP address")
+	}
+
+	bind, err := c.newBind()
+	if err != nil {
+		return nil, nil, err
+	}
+	return tunnel.CreateNetstackTunnel(addresses, dns, c.cfg.MTU, c.cfg.LogLevel, bind)
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/server"
+)
+
+func TestProxyRefusesWhileTunnelDown(t *testing.T) {
+	c := New(&config.ClientConfig{Mode: config.ModeProxy, ProxyListen: "127.0.0.1:0"})
+	if err := c.startProxy(); err != nil {
+		t.Fatalf("startProxy() error: %v", err)
+	}
+	defer c.stopProxy()
+
+	if _, err := c.dialTunnel(context.Background(), "tcp", "10.0.0.1:80"); !errors.Is(err, errTunnelDown) {
+		t.Errorf("dialTunnel() error = %v, want %v", err, errTunnelDown)
+	}
+}
+
+func TestCreateNetstackTunnel(t *testing.T) {
+	c := New(&config.ClientConfig{Mode: config.ModeProxy, MTU: 1420, LogLevel: "silent"})
+	regResp := &server.RegisterResponse{AssignedIP: "10.0.0.2/24", AssignedIP6: "fd00::2/64"}
+
+	tun, tnet, err := c.createNetstackTunnel(regResp, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("createNetstackTunnel() error: %v", err)
+	}
+	defer tun.Close()
+
+	// The stack owns the assigned addresses
+	ln, err := tnet.ListenTCP(&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	if err != nil {
+		t.Fatalf("ListenTCP() on the assigned address: %v", err)
+	}
+	ln.Close()
+
+	if _, _, err := c.createNetstackTunnel(regResp, []string{"not-an-ip"}); err == nil {
+		t.Error("expected an error for an invalid DNS server")
+	}
+}
+
+func TestSetKillSwitchRejectsProxyMode(t *testing.T) {
+	c := New(&config.ClientConfig{Mode: config.ModeProxy})
+	if err := c.SetKillSwitch(context.Background(), true); err == nil {
+		t.Error("expected an error enabling the kill switch in proxy mode")
+	}
+	if c.cfg.KillSwitch {
+		t.Error("KillSwitch was saved despite the error")
+	}
+}
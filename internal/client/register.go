@@ -2,41 +2,157 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	mathrand "math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
 	"github.com/gavsh/ShikVPN/internal/server"
 )
 
-// retryDelays defines the backoff between registration attempts.
-var retryDelays = []time.Duration{0, 2 * time.Second, 5 * time.Second}
+// maxRetryDelay caps the backoff between registration attempts.
+const maxRetryDelay = time.Minute
 
-// Register sends a registration request to the VPN server API with retry.
-func Register(apiURL string, publicKey string, apiKey string) (*server.RegisterResponse, error) {
-	reqBody := server.RegisterRequest{
-		PublicKey: publicKey,
+// RetryPolicy controls how often and how patiently Register retries.
+type RetryPolicy struct {
+	Attempts int           // total attempts, at least 1
+	Backoff  time.Duration // delay before the first retry; doubles on each further retry
+	Jitter   float64       // randomizes each delay by up to this fraction, 0 to 1
+}
+
+// DefaultRetryPolicy returns the policy used when the config sets none.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts: config.DefaultRegisterAttempts,
+		Backoff:  config.DefaultRegisterBackoff * time.Second,
+	}
+}
+
+// RetryPolicyFromConfig returns the retry policy configured in cfg, falling
+// back to the defaults for unset fields.
+func RetryPolicyFromConfig(cfg *config.ClientConfig) RetryPolicy {
+	p := DefaultRetryPolicy()
+	if cfg.RegisterAttempts > 0 {
+		p.Attempts = cfg.RegisterAttempts
 	}
+	if cfg.RegisterBackoff > 0 {
+		p.Backoff = time.Duration(cfg.RegisterBackoff) * time.Second
+	}
+	p.Jitter = cfg.RegisterJitter
+	return p
+}
 
-	body, err := json.Marshal(reqBody)
+// delay returns how long to wait before attempt n (0-based).
+func (p RetryPolicy) delay(n int) time.Duration {
+	if n == 0 || p.Backoff <= 0 {
+		return 0
+	}
+	d := p.Backoff
+	for i := 1; i < n && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((mathrand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// errBadSignature is returned when a registration response is not signed by the server key.
+var errBadSignature = errors.New("registration response signature does not match server_public_key")
+
+// Register sends a registration request to the VPN server API, retrying
+// according to retry. It gives up as soon as ctx is cancelled.
+// httpClient should come from NewHTTPClient so TLS settings are honored.
+// The request carries a proof that the caller holds privateKey, keyed with
+// the server's public key. If serverPublicKey is empty it is first fetched
+// from the server (trust on first use). Either way the response must be
+// signed by the holder of the server's private key and name that key.
+func Register(ctx context.Context, httpClient *http.Client, apiURL string, privateKey [crypto.KeySize]byte, serverPublicKey string, apiKey string, retry RetryPolicy) (*server.RegisterResponse, error) {
+	if retry.Attempts < 1 {
+		retry.Attempts = 1
+	}
+
+	pubKey, err := crypto.PublicKeyFromPrivate(privateKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to derive public key: %w", err)
+	}
+	publicKey := crypto.KeyToBase64(pubKey)
+
+	if serverPublicKey != "" {
+		if _, err := crypto.KeyFromBase64(serverPublicKey); err != nil {
+			return nil, fmt.Errorf("invalid server public key: %w", err)
+		}
 	}
 
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := base64.StdEncoding.EncodeToString(nonceBytes)
+
 	url := apiURL + "/api/v1/register"
-	client := &http.Client{Timeout: 10 * time.Second}
 
 	var lastErr error
-	for attempt, delay := range retryDelays {
-		if delay > 0 {
-			log.Printf("Retrying registration (attempt %d/%d) in %v...", attempt+1, len(retryDelays), delay)
-			time.Sleep(delay)
+	for attempt := 0; attempt < retry.Attempts; attempt++ {
+		if attempt > 0 {
+			delay := retry.delay(attempt)
+			log.Printf("Retrying registration (attempt %d/%d) in %v...", attempt+1, retry.Attempts, delay.Round(time.Millisecond))
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		if serverPublicKey == "" {
+			serverPublicKey, err = fetchServerKey(ctx, httpClient, apiURL)
+			if err != nil {
+				lastErr = err
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if isCertificateError(err) {
+					return nil, lastErr
+				}
+				continue
+			}
+		}
+		serverKey, err := crypto.KeyFromBase64(serverPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server public key: %w", err)
+		}
+
+		// Prove possession of the private key with a fresh timestamp each attempt
+		ts := time.Now().Unix()
+		proof, err := crypto.ComputeProof(privateKey, serverKey, server.RegisterProofMessage(publicKey, nonce, ts))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute proof: %w", err)
+		}
+		body, err := json.Marshal(server.RegisterRequest{
+			PublicKey: publicKey,
+			Nonce:     nonce,
+			Timestamp: ts,
+			Proof:     base64.StdEncoding.EncodeToString(proof),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
 		}
 
-		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -45,9 +161,16 @@ func Register(apiURL string, publicKey string, apiKey string) (*server.RegisterR
 			req.Header.Set("X-API-Key", apiKey)
 		}
 
-		resp, err := client.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
 			lastErr = fmt.Errorf("registration request failed: %w", err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// A certificate that fails verification will not fix itself
+			if isCertificateError(err) {
+				return nil, lastErr
+			}
 			continue
 		}
 
@@ -67,13 +190,113 @@ func Register(apiURL string, publicKey string, apiKey string) (*server.RegisterR
 			continue
 		}
 
+		sig, _ := base64.StdEncoding.DecodeString(resp.Header.Get(server.ServerSignatureHeader))
+		msg := server.RegisterResponseMessage(publicKey, nonce, respBody)
+		if len(sig) == 0 || !crypto.VerifyProof(privateKey, serverKey, msg, sig) {
+			return nil, errBadSignature
+		}
+
 		var regResp server.RegisterResponse
 		if err := json.Unmarshal(respBody, &regResp); err != nil {
 			return nil, fmt.Errorf("failed to parse response: %w", err)
 		}
 
+		if regResp.ServerPublicKey != serverPublicKey {
+			return nil, fmt.Errorf("server returned public key %s, expected %s", regResp.ServerPublicKey, serverPublicKey)
+		}
+
 		return &regResp, nil
 	}
 
-	return nil, fmt.Errorf("registration failed after %d attempts: %w", len(retryDelays), lastErr)
+	return nil, fmt.Errorf("registration failed after %d attempts: %w", retry.Attempts, lastErr)
+}
+
+// sleepContext waits for d or until ctx is cancelled, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// fetchServerKey asks the server for its WireGuard public key.
+func fetchServerKey(ctx context.Context, httpClient *http.Client, apiURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL+"/api/v1/server-key", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("server key request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return "", fmt.Errorf("server key request failed (HTTP %d): %s", resp.StatusCode, string(respBody))
+	}
+
+	var keyResp server.ServerKeyResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&keyResp); err != nil {
+		return "", fmt.Errorf("failed to parse server key response: %w", err)
+	}
+	if _, err := crypto.KeyFromBase64(keyResp.ServerPublicKey); err != nil {
+		return "", fmt.Errorf("server returned an invalid public key: %w", err)
+	}
+	return keyResp.ServerPublicKey, nil
+}
+
+// Unregister asks the server to remove this peer and release its IP address.
+// The request is authenticated by a proof of the client's private key, and by
+// the API key when one is configured.
+func Unregister(httpClient *http.Client, apiURL string, privateKey [crypto.KeySize]byte, serverPublicKey string, apiKey string) error {
+	serverPub, err := crypto.KeyFromBase64(serverPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid server public key: %w", err)
+	}
+	pubKey, err := crypto.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive public key: %w", err)
+	}
+	pubKeyB64 := crypto.KeyToBase64(pubKey)
+
+	ts := time.Now().Unix()
+	proof, err := crypto.ComputeProof(privateKey, serverPub, server.DeregisterProofMessage(pubKeyB64, ts))
+	if err != nil {
+		return fmt.Errorf("failed to compute proof: %w", err)
+	}
+
+	req, err := http.NewRequest("DELETE", apiURL+"/api/v1/peers/"+url.PathEscape(pubKeyB64), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(server.PeerTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(server.PeerProofHeader, base64.StdEncoding.EncodeToString(proof))
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unregister request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return fmt.Errorf("unregister failed (HTTP %d): %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// isCertificateError reports whether err came from TLS certificate verification.
+func isCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	return errors.Is(err, errCertificatePin) || errors.As(err, &verifyErr) || errors.As(err, &unknownAuth) || errors.As(err, &hostErr)
 }
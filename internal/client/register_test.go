@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// newRegisterAPI starts a real registration API and returns its URL and public key.
+func newRegisterAPI(t *testing.T) (string, string) {
+	t.Helper()
+	handler, serverPub := newRegisterHandler(t)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL, serverPub
+}
+
+// newRegisterHandler returns a registration API handler and its server public key.
+func newRegisterHandler(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	ipam, err := server.NewIPAM("10.0.0.1/24", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error: %v", err)
+	}
+	serverPub := crypto.KeyToBase64(kp.PublicKey)
+
+	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := server.NewAPI(ipam, kp.PrivateKey, serverPub, "1.2.3.4:51820", nil, nil, 1420, "", nil, noop, noopRemove)
+	return api.Handler(), serverPub
+}
+
+func TestRegisterVerifiesPinnedServerKey(t *testing.T) {
+	url, serverPub := newRegisterAPI(t)
+
+	resp, err := Register(context.Background(), http.DefaultClient, url, testPrivateKey(t), serverPub, "", DefaultRetryPolicy())
+	if err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+	if resp.ServerPublicKey != serverPub {
+		t.Errorf("ServerPublicKey = %s, want %s", resp.ServerPublicKey, serverPub)
+	}
+}
+
+func TestRegisterRejectsWrongServerKey(t *testing.T) {
+	url, _ := newRegisterAPI(t)
+	other, _ := crypto.GenerateKeyPair()
+
+	// The server cannot verify a proof keyed with someone else's public key
+	_, err := Register(context.Background(), http.DefaultClient, url, testPrivateKey(t), crypto.KeyToBase64(other.PublicKey), "", DefaultRetryPolicy())
+	if err == nil {
+		t.Fatal("Register() succeeded with the wrong server key")
+	}
+}
+
+func TestRegisterRejectsUnsignedResponse(t *testing.T) {
+	serverKP, _ := crypto.GenerateKeyPair()
+	serverPub := crypto.KeyToBase64(serverKP.PublicKey)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.RegisterResponse{AssignedIP: "10.0.0.2/24", ServerPublicKey: serverPub})
+	}))
+	defer srv.Close()
+
+	_, err := Register(context.Background(), http.DefaultClient, srv.URL, testPrivateKey(t), serverPub, "", DefaultRetryPolicy())
+	if !errors.Is(err, errBadSignature) {
+		t.Fatalf("Register() error = %v, want signature mismatch", err)
+	}
+}
+
+func TestRegisterWithoutPinnedKeyFetchesServerKey(t *testing.T) {
+	url, serverPub := newRegisterAPI(t)
+
+	resp, err := Register(context.Background(), http.DefaultClient, url, testPrivateKey(t), "", "", DefaultRetryPolicy())
+	if err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+	if resp.ServerPublicKey != serverPub {
+		t.Errorf("ServerPublicKey = %s, want %s", resp.ServerPublicKey, serverPub)
+	}
+	if !strings.HasPrefix(resp.AssignedIP, "10.0.0.") {
+		t.Errorf("AssignedIP = %s, want an address in 10.0.0.0/24", resp.AssignedIP)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 10, Backoff: 2 * time.Second}
+	want := []time.Duration{0, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for n, w := range want {
+		if got := p.delay(n); got != w {
+			t.Errorf("delay(%d) = %v, want %v", n, got, w)
+		}
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Backoff: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := p.delay(1); got < 5*time.Second || got > 15*time.Second {
+			t.Fatalf("delay(1) = %v, want within 5s..15s", got)
+		}
+	}
+}
+
+func TestRetryPolicyFromConfig(t *testing.T) {
+	p := RetryPolicyFromConfig(&config.ClientConfig{})
+	if p != DefaultRetryPolicy() {
+		t.Errorf("RetryPolicyFromConfig(empty) = %+v, want defaults %+v", p, DefaultRetryPolicy())
+	}
+
+	p = RetryPolicyFromConfig(&config.ClientConfig{RegisterAttempts: 5, RegisterBackoff: 1, RegisterJitter: 0.2})
+	want := RetryPolicy{Attempts: 5, Backoff: time.Second, Jitter: 0.2}
+	if p != want {
+		t.Errorf("RetryPolicyFromConfig() = %+v, want %+v", p, want)
+	}
+}
+
+func TestRegisterRetriesUntilAttemptsExhausted(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	serverKP, _ := crypto.GenerateKeyPair()
+	retry := RetryPolicy{Attempts: 4, Backoff: time.Millisecond}
+	_, err := Register(context.Background(), http.DefaultClient, srv.URL, testPrivateKey(t), crypto.KeyToBase64(serverKP.PublicKey), "", retry)
+	if err == nil || !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Fatalf("Register() error = %v, want failure after 4 attempts", err)
+	}
+	if calls != 4 {
+		t.Errorf("server saw %d requests, want 4", calls)
+	}
+}
+
+func TestRegisterStopsWhenCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	serverKP, _ := crypto.GenerateKeyPair()
+	retry := RetryPolicy{Attempts: 3, Backoff: time.Hour}
+	start := time.Now()
+	_, err := Register(ctx, http.DefaultClient, srv.URL, testPrivateKey(t), crypto.KeyToBase64(serverKP.PublicKey), "", retry)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Register() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Register() took %v to notice cancellation", elapsed)
+	}
+}
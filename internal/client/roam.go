@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/network"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// networkSettleDelay is how long to wait after a network change before
+// acting on it, so that DHCP and route setup on the new link can finish.
+const networkSettleDelay = 2 * time.Second
+
+// lookupHost resolves a hostname; tests replace it.
+var lookupHost = net.DefaultResolver.LookupNetIP
+
+// resolveEndpoint turns a host:port endpoint into an address:port, looking
+// up the host if it is a name. IPv4 addresses are preferred, matching the
+// bypass route which only exists for IPv4.
+func resolveEndpoint(ctx context.Context, endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid server endpoint %q: %w", endpoint, err)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return endpoint, nil
+	}
+
+	addrs, err := lookupHost(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve server endpoint %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("server endpoint %s has no addresses", host)
+	}
+	addr := addrs[0]
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			addr = a
+			break
+		}
+	}
+	return net.JoinHostPort(addr.Unmap().String(), port), nil
+}
+
+// watchNetwork follows network changes, e.g. switching from Wi-Fi to
+// Ethernet, until ctx is cancelled.
+func (c *Client) watchNetwork(ctx context.Context, changes <-chan struct{}) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+
+		// Changes arriving while the network settles are handled by this pass
+		if sleepContext(ctx, networkSettleDelay) != nil {
+			return
+		}
+		select {
+		case <-changes:
+		default:
+		}
+
+		if err := c.roam(ctx); err != nil {
+			log.Printf("Warning: failed to follow network change: %v", err)
+		}
+	}
+}
+
+// roam re-resolves the server endpoint, points WireGuard at its current
+// address and moves the bypass route to the current physical gateway, all
+// without tearing down the tunnel. Only if a new server address changes
+// which prefixes go through the tunnel is the tunnel rebuilt.
+func (c *Client) roam(ctx context.Context) error {
+	c.reconfigure.Lock()
+	defer c.reconfigure.Unlock()
+
+	// A failed reconnect left no tunnel; the supervisor is restoring it
+	if c.tunnel == nil || c.regResp == nil {
+		return nil
+	}
+
+	// The registration API may have moved too; keep it reachable for reconnects
+	if c.killSwitch {
+		if servers, err := c.resolveAPIServers(ctx); err == nil && !slices.Equal(servers, c.apiServers) {
+			c.apiServers = servers
+			if err := c.applyKillSwitch(c.peer.Endpoint); err != nil {
+				return err
+			}
+		}
+	}
+	endpoint, err := c.resolveServerEndpoint(ctx, c.regResp.ServerEndpoint)
+	if err != nil {
+		return err
+	}
+	if endpoint != c.peer.Endpoint {
+		log.Printf("Server endpoint moved from %s to %s", c.peer.Endpoint, endpoint)
+
+		plan, err := planRoutes(c.cfg.AllowedIPs, c.regResp.Routes, c.cfg.ExcludeIPs,
+			c.regResp.AssignedIP6 != "", endpointAddr(endpoint))
+		if err != nil {
+			return fmt.Errorf("failed to plan routes: %w", err)
+		}
+		allowedIPs := make([]string, len(plan.AllowedIPs))
+		for i, p := range plan.AllowedIPs {
+			allowedIPs[i] = p.String()
+		}
+		if !slices.Equal(allowedIPs, c.peer.AllowedIPs) {
+			log.Println("New server address changes the tunnel routes; rebuilding the tunnel")
+			c.teardown()
+			return c.setup(ctx, c.regResp)
+		}
+
+		if err := c.applyKillSwitch(endpoint); err != nil {
+			return err
+		}
+		uapi := tunnel.BuildAddPeerUAPI(tunnel.PeerConfig{PublicKeyHex: c.peer.PublicKeyHex, Endpoint: endpoint})
+		if err := c.tunnel.Configure(uapi); err != nil {
+			return fmt.Errorf("failed to update server endpoint: %w", err)
+		}
+		c.peer.Endpoint = endpoint
+	}
+
+	// Only full-tunnel mode routes the server around the tunnel
+	if !c.defaultRouteSet || !endpointAddr(endpoint).Is4() {
+		return nil
+	}
+	router, ok := c.netConfig.(network.BypassRouter)
+	if !ok {
+		return nil
+	}
+	moved, err := router.UpdateBypassRoute(c.tunnel.Name(), endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to update route to server: %w", err)
+	}
+	if moved {
+		log.Printf("Route to server %s now follows the new network", endpoint)
+	}
+	return nil
+}
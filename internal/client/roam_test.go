@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestResolveEndpoint(t *testing.T) {
+	orig := lookupHost
+	t.Cleanup(func() { lookupHost = orig })
+	lookupHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		switch host {
+		case "vpn.example.com":
+			return []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("203.0.113.7")}, nil
+		case "v6.example.com":
+			return []netip.Addr{netip.MustParseAddr("2001:db8::2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "198.51.100.1:51820", want: "198.51.100.1:51820"},
+		{endpoint: "[2001:db8::9]:51820", want: "[2001:db8::9]:51820"},
+		{endpoint: "vpn.example.com:51820", want: "203.0.113.7:51820"},
+		{endpoint: "v6.example.com:51820", want: "[2001:db8::2]:51820"},
+		{endpoint: "missing.example.com:51820", wantErr: true},
+		{endpoint: "no-port", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveEndpoint(context.Background(), tt.endpoint)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveEndpoint(%q) = %q, want error", tt.endpoint, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveEndpoint(%q) error: %v", tt.endpoint, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveEndpoint(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// Full-tunnel prefixes used when neither the client nor the server restricts routing.
+var (
+	fullTunnelIPv4 = netip.MustParsePrefix("0.0.0.0/0")
+	fullTunnelIPv6 = netip.MustParsePrefix("::/0")
+)
+
+// routePlan describes which traffic is sent through the tunnel.
+type routePlan struct {
+	// AllowedIPs are the prefixes routed into the tunnel; they double as the
+	// server peer's WireGuard allowed IPs.
+	AllowedIPs []netip.Prefix
+	// FullTunnel is set when all IPv4 traffic goes through the tunnel with no
+	// exclusions, in which case the system default route is replaced.
+	FullTunnel bool
+}
+
+// planRoutes works out the tunnel routes. Local allowed IPs take precedence
+// over routes pushed by the server; with neither, everything is tunneled.
+// Excluded prefixes and the server endpoint are carved out of the result so
+// that the tunnel's own packets never loop back into it.
+func planRoutes(localAllowed, serverRoutes, exclude []string, ipv6 bool, endpoint netip.Addr) (routePlan, error) {
+	source := localAllowed
+	if len(source) == 0 {
+		source = serverRoutes
+	}
+
+	var allowed []netip.Prefix
+	if len(source) == 0 {
+		allowed = append(allowed, fullTunnelIPv4)
+		if ipv6 {
+			allowed = append(allowed, fullTunnelIPv6)
+		}
+	} else {
+		for _, s := range source {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return routePlan{}, fmt.Errorf("invalid allowed IP %q: %w", s, err)
+			}
+			allowed = append(allowed, p.Masked())
+		}
+	}
+
+	var excluded []netip.Prefix
+	for _, s := range exclude {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return routePlan{}, fmt.Errorf("invalid excluded IP %q: %w", s, err)
+		}
+		excluded = append(excluded, p.Masked())
+	}
+
+	plan := routePlan{}
+	for _, p := range allowed {
+		if p == fullTunnelIPv4 && len(excluded) == 0 {
+			plan.FullTunnel = true
+		}
+	}
+
+	// In full-tunnel mode the default route logic adds its own bypass route
+	// for an IPv4 endpoint; otherwise the endpoint must be excluded here.
+	if endpoint.IsValid() && (!plan.FullTunnel || endpoint.Is6()) {
+		excluded = append(excluded, netip.PrefixFrom(endpoint, endpoint.BitLen()))
+	}
+
+	for _, x := range excluded {
+		var next []netip.Prefix
+		for _, p := range allowed {
+			next = append(next, subtractPrefix(p, x)...)
+		}
+		allowed = next
+	}
+
+	sort.Slice(allowed, func(i, j int) bool {
+		if c := allowed[i].Addr().Compare(allowed[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return allowed[i].Bits() < allowed[j].Bits()
+	})
+	plan.AllowedIPs = allowed
+	return plan, nil
+}
+
+// subtractPrefix returns the prefixes covering p minus x.
+func subtractPrefix(p, x netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(x) {
+		return []netip.Prefix{p}
+	}
+	if x.Bits() <= p.Bits() {
+		return nil // x covers all of p
+	}
+
+	// Split p in half, keep the half without x and recurse into the other
+	lower, upper := splitPrefix(p)
+	if lower.Contains(x.Addr()) {
+		return append(subtractPrefix(lower, x), upper)
+	}
+	return append([]netip.Prefix{lower}, subtractPrefix(upper, x)...)
+}
+
+// splitPrefix divides p into its two halves, one bit longer.
+func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits() + 1
+	lower := netip.PrefixFrom(p.Addr(), bits)
+
+	b := p.Addr().AsSlice()
+	b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	return lower, netip.PrefixFrom(addr, bits)
+}
+
+// installablePrefixes expands any /0 into two /1 halves, which route all
+// traffic without clashing with an existing default route.
+func installablePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		if p.Bits() == 0 {
+			lower, upper := splitPrefix(p)
+			out = append(out, lower, upper)
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func prefixStrings(prefixes []netip.Prefix) string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return fmt.Sprint(s)
+}
+
+func TestPlanRoutesFullTunnelByDefault(t *testing.T) {
+	plan, err := planRoutes(nil, nil, nil, true, netip.MustParseAddr("1.2.3.4"))
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	if !plan.FullTunnel {
+		t.Error("FullTunnel = false, want true")
+	}
+	if got, want := prefixStrings(plan.AllowedIPs), "[0.0.0.0/0 ::/0]"; got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+}
+
+func TestPlanRoutesLocalOverridesServer(t *testing.T) {
+	plan, err := planRoutes([]string{"10.20.0.0/16"}, []string{"192.168.0.0/24"}, nil, false, netip.Addr{})
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	if plan.FullTunnel {
+		t.Error("FullTunnel = true, want false")
+	}
+	if got, want := prefixStrings(plan.AllowedIPs), "[10.20.0.0/16]"; got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+}
+
+func TestPlanRoutesServerPushed(t *testing.T) {
+	plan, err := planRoutes(nil, []string{"192.168.0.1/24", "10.0.0.0/8"}, nil, false, netip.Addr{})
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	if got, want := prefixStrings(plan.AllowedIPs), "[10.0.0.0/8 192.168.0.0/24]"; got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+}
+
+func TestPlanRoutesExcludeSplitsPrefix(t *testing.T) {
+	plan, err := planRoutes([]string{"10.0.0.0/8"}, nil, []string{"10.128.0.0/9", "10.1.0.0/16"}, false, netip.Addr{})
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	want := "[10.0.0.0/16 10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 10.16.0.0/12 10.32.0.0/11 10.64.0.0/10]"
+	if got := prefixStrings(plan.AllowedIPs); got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+}
+
+func TestPlanRoutesExcludeDisablesFullTunnel(t *testing.T) {
+	plan, err := planRoutes(nil, nil, []string{"192.168.0.0/16"}, false, netip.MustParseAddr("1.2.3.4"))
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	if plan.FullTunnel {
+		t.Error("FullTunnel = true, want false with exclusions")
+	}
+	for _, p := range plan.AllowedIPs {
+		if p.Contains(netip.MustParseAddr("192.168.1.1")) {
+			t.Errorf("excluded address routed via %s", p)
+		}
+		if p.Contains(netip.MustParseAddr("1.2.3.4")) {
+			t.Errorf("server endpoint routed via %s", p)
+		}
+	}
+	if !plan.AllowedIPs[0].Contains(netip.MustParseAddr("0.0.0.1")) {
+		t.Errorf("AllowedIPs %s do not cover the rest of the address space", prefixStrings(plan.AllowedIPs))
+	}
+}
+
+func TestPlanRoutesExcludesEndpointFromSplitRoutes(t *testing.T) {
+	plan, err := planRoutes([]string{"203.0.113.0/30"}, nil, nil, false, netip.MustParseAddr("203.0.113.1"))
+	if err != nil {
+		t.Fatalf("planRoutes() error: %v", err)
+	}
+	if got, want := prefixStrings(plan.AllowedIPs), "[203.0.113.0/32 203.0.113.2/31]"; got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+}
+
+func TestPlanRoutesInvalidPrefix(t *testing.T) {
+	if _, err := planRoutes([]string{"office"}, nil, nil, false, netip.Addr{}); err == nil {
+		t.Error("expected error for invalid allowed IP")
+	}
+	if _, err := planRoutes(nil, nil, []string{"10.0.0.1"}, false, netip.Addr{}); err == nil {
+		t.Error("expected error for invalid excluded IP")
+	}
+}
+
+func TestInstallablePrefixesSplitsDefault(t *testing.T) {
+	got := prefixStrings(installablePrefixes([]netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}))
+	want := "[0.0.0.0/1 128.0.0.0/1 ::/1 8000::/1 10.0.0.0/8]"
+	if got != want {
+		t.Errorf("installablePrefixes() = %s, want %s", got, want)
+	}
+}
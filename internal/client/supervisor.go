@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// State is the connection state reported to OnStateChange callbacks.
+type State string
+
+// Connection states.
+const (
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateReconnecting State = "reconnecting"
+	StateDisconnected State = "disconnected"
+)
+
+// StateChange describes a connection state transition.
+type StateChange struct {
+	State      State
+	AssignedIP string // the tunnel address while connected
+	Err        error  // why the last reconnect attempt failed, if it did
+}
+
+// StateFunc receives connection state changes.
+type StateFunc func(StateChange)
+
+const (
+	// healthCheckInterval is how often the supervisor inspects the tunnel.
+	healthCheckInterval = 10 * time.Second
+
+	// handshakeTimeout is how long a freshly configured tunnel may go without
+	// its first handshake; WireGuard itself gives up retrying after 90s.
+	handshakeTimeout = 90 * time.Second
+
+	// handshakeStaleAfter is the handshake age after which the session is
+	// considered dead. With keepalives WireGuard re-handshakes every two
+	// minutes, and sessions are rejected after three.
+	handshakeStaleAfter = 3 * time.Minute
+
+	// Reconnect attempts back off exponentially between these bounds.
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = time.Minute
+)
+
+// healthMonitor decides whether the tunnel's handshakes have gone stale.
+type healthMonitor struct {
+	since time.Time // when the server peer was last (re)configured
+}
+
+func newHealthMonitor(now time.Time) *healthMonitor {
+	return &healthMonitor{since: now}
+}
+
+// reset restarts the grace period for the first handshake.
+func (m *healthMonitor) reset(now time.Time) {
+	m.since = now
+}
+
+// stale reports whether a peer with the given last handshake is considered dead at now.
+func (m *healthMonitor) stale(lastHandshake, now time.Time) bool {
+	if lastHandshake.IsZero() {
+		return now.Sub(m.since) > handshakeTimeout
+	}
+	return now.Sub(lastHandshake) > handshakeStaleAfter
+}
+
+// reconnectBackoff returns the delay before reconnect attempt n (0-based).
+func reconnectBackoff(n int) time.Duration {
+	delay := reconnectBaseDelay
+	for i := 0; i < n && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return delay
+}
+
+// notify reports a state change to the registered callback.
+func (c *Client) notify(state State, err error) {
+	c.mu.Lock()
+	fn := c.onState
+	c.mu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	change := StateChange{State: state, Err: err}
+	if state == StateConnected || state == StateReconnecting {
+		change.AssignedIP = c.cfg.Address
+	}
+	fn(change)
+}
+
+// supervise watches the server's last handshake and reconnects when the
+// session goes stale, e.g. because the server restarted and lost its peers.
+func (c *Client) supervise(ctx context.Context) {
+	defer c.wg.Done()
+
+	monitor := newHealthMonitor(time.Now())
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			lastHandshake, err := c.lastHandshake()
+			if err != nil {
+				log.Printf("Warning: failed to read tunnel state: %v", err)
+				continue
+			}
+			if !monitor.stale(lastHandshake, now) {
+				continue
+			}
+
+			if lastHandshake.IsZero() {
+				log.Printf("No handshake with the server within %v; reconnecting", handshakeTimeout)
+			} else {
+				log.Printf("Last handshake with the server was %v ago; reconnecting", now.Sub(lastHandshake).Round(time.Second))
+			}
+			if !c.recover(ctx) {
+				return
+			}
+			monitor.reset(time.Now())
+		}
+	}
+}
+
+// lastHandshake returns the time of the last handshake with the server peer.
+func (c *Client) lastHandshake() (time.Time, error) {
+	c.reconfigure.Lock()
+	defer c.reconfigure.Unlock()
+
+	if c.tunnel == nil {
+		return time.Time{}, nil
+	}
+	stats, err := c.tunnel.PeerStats()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, peer := range stats {
+		if peer.PublicKeyHex == c.peer.PublicKeyHex {
+			return peer.LastHandshake, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// recover retries reconnecting with exponential backoff until it succeeds
+// or ctx is cancelled. It reports whether the client is connected again.
+func (c *Client) recover(ctx context.Context) bool {
+	c.notify(StateReconnecting, nil)
+
+	for attempt := 0; ; attempt++ {
+		delay := reconnectBackoff(attempt)
+		if sleepContext(ctx, delay) != nil {
+			return false
+		}
+
+		err := c.reconnect(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err == nil {
+			log.Println("VPN reconnected successfully")
+			c.notify(StateConnected, nil)
+			return true
+		}
+		log.Printf("Reconnect attempt %d failed: %v", attempt+1, err)
+		c.notify(StateReconnecting, err)
+	}
+}
+
+// reconnect registers with the server again and restores the tunnel. If the
+// registration is unchanged only the server peer is reset, which forces a
+// fresh handshake; otherwise the tunnel is rebuilt from scratch.
+func (c *Client) reconnect(ctx context.Context) error {
+	regResp, err := c.register(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.reconfigure.Lock()
+	defer c.reconfigure.Unlock()
+
+	if c.tunnel != nil && sameRegistration(c.regResp, regResp) {
+		uapi := tunnel.BuildRemovePeerUAPI(c.peer.PublicKeyHex) + tunnel.BuildAddPeerUAPI(c.peer)
+		if err := c.tunnel.Configure(uapi); err != nil {
+			return fmt.Errorf("failed to reconfigure server peer: %w", err)
+		}
+		return nil
+	}
+
+	log.Println("Server registration changed; rebuilding the tunnel")
+	c.teardown()
+	return c.setup(ctx, regResp)
+}
+
+// sameRegistration reports whether two registration responses would produce
+// the same tunnel configuration.
+func sameRegistration(a, b *server.RegisterResponse) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	x, y := *a, *b
+	x.APIToken, y.APIToken = "", ""
+	return reflect.DeepEqual(x, y)
+}
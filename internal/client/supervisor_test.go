@@ -0,0 +1,75 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/server"
+)
+
+func TestHealthMonitorFirstHandshake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	m := newHealthMonitor(start)
+
+	if m.stale(time.Time{}, start.Add(handshakeTimeout)) {
+		t.Error("stale before the handshake timeout")
+	}
+	if !m.stale(time.Time{}, start.Add(handshakeTimeout+time.Second)) {
+		t.Error("not stale after the handshake timeout without a handshake")
+	}
+
+	// A reset gives a reconfigured peer a fresh grace period
+	m.reset(start.Add(5 * time.Minute))
+	if m.stale(time.Time{}, start.Add(6*time.Minute)) {
+		t.Error("stale right after reset")
+	}
+}
+
+func TestHealthMonitorStaleHandshake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	m := newHealthMonitor(start)
+	handshake := start.Add(10 * time.Second)
+
+	if m.stale(handshake, handshake.Add(2*time.Minute)) {
+		t.Error("stale with a recent handshake")
+	}
+	if !m.stale(handshake, handshake.Add(handshakeStaleAfter+time.Second)) {
+		t.Error("not stale with an old handshake")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	want := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for n, w := range want {
+		if got := reconnectBackoff(n); got != w {
+			t.Errorf("reconnectBackoff(%d) = %v, want %v", n, got, w)
+		}
+	}
+	if got := reconnectBackoff(1000); got != reconnectMaxDelay {
+		t.Errorf("reconnectBackoff(1000) = %v, want %v", got, reconnectMaxDelay)
+	}
+}
+
+func TestSameRegistration(t *testing.T) {
+	a := validResponse(t)
+	b := *a
+	b.APIToken = "shk_new"
+	if !sameRegistration(a, &b) {
+		t.Error("responses differing only in api_token should match")
+	}
+
+	b.AssignedIP = "10.8.1.8/22"
+	if sameRegistration(a, &b) {
+		t.Error("responses with different addresses should not match")
+	}
+
+	c := *a
+	c.Routes = []string{"10.20.0.0/16"}
+	if sameRegistration(a, &c) {
+		t.Error("responses with different routes should not match")
+	}
+	if sameRegistration(nil, a) || sameRegistration(a, (*server.RegisterResponse)(nil)) {
+		t.Error("nil responses should not match")
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/transport"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// UseBind makes the client's tunnels send WireGuard's packets through bind
+// instead of the configured transport; obfuscation still applies. The bind
+// is reused when the tunnel is rebuilt, so it must support being opened
+// again after Close. It must be called before Connect; in-process tests use
+// it with a tunnel.MemoryNetwork.
+func (c *Client) UseBind(bind conn.Bind) {
+	c.bind = bind
+}
+
+// newBind returns the transport for a new tunnel: UDP sockets, or a stream
+// to the server for the tcp and websocket transports, obfuscated if an
+// obfuscation key is set.
+func (c *Client) newBind() (conn.Bind, error) {
+	bind, err := c.newTransportBind()
+	if err != nil || c.cfg.ObfuscationKey == "" {
+		return bind, err
+	}
+	key, err := crypto.KeyFromBase64(c.cfg.ObfuscationKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid obfuscation key: %w", err)
+	}
+	return transport.NewObfuscatedBind(bind, key), nil
+}
+
+// newTransportBind returns the bind set by UseBind, or one for the
+// configured transport.
+func (c *Client) newTransportBind() (conn.Bind, error) {
+	if c.bind != nil {
+		return c.bind, nil
+	}
+
+	switch c.cfg.Transport {
+	case config.TransportTCP:
+		return transport.NewClientBind(transport.DialTCP(uint16(c.cfg.TransportPort))), nil
+	case config.TransportWebSocket:
+		tlsConfig, err := newTLSConfig(c.cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up WebSocket transport: %w", err)
+		}
+		return transport.NewClientBind(transport.DialWebSocket(c.cfg.Server, c.streamPort(0), tlsConfig)), nil
+	}
+	return conn.NewDefaultBind(), nil
+}
+
+// streamEndpoint returns where the stream transport connects for the
+// WireGuard endpoint ep: its address, on transport_port if set, otherwise
+// on ep's port for tcp and on the API port for websocket.
+func (c *Client) streamEndpoint(ep netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ep.Addr(), c.streamPort(ep.Port()))
+}
+
+// streamPort returns the server's stream transport port, given the
+// WireGuard endpoint's port.
+func (c *Client) streamPort(endpointPort uint16) uint16 {
+	switch {
+	case c.cfg.TransportPort != 0:
+		return uint16(c.cfg.TransportPort)
+	case c.cfg.Transport == config.TransportWebSocket:
+		return uint16(c.cfg.APIPort)
+	}
+	return endpointPort
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/transport"
+)
+
+func TestStreamEndpoint(t *testing.T) {
+	ep := netip.MustParseAddrPort("203.0.113.7:51820")
+	tests := []struct {
+		transport string
+		port      int
+		want      string
+	}{
+		{config.TransportTCP, 0, "203.0.113.7:51820"},
+		{config.TransportTCP, 443, "203.0.113.7:443"},
+		{config.TransportWebSocket, 0, "203.0.113.7:8080"},
+		{config.TransportWebSocket, 8443, "203.0.113.7:8443"},
+	}
+	for _, tt := range tests {
+		c := New(&config.ClientConfig{APIPort: 8080, Transport: tt.transport, TransportPort: tt.port})
+		if got := c.streamEndpoint(ep).String(); got != tt.want {
+			t.Errorf("streamEndpoint() for %s with transport_port %d = %s, want %s", tt.transport, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestNewBindFollowsTransport(t *testing.T) {
+	for _, tr := range []string{config.TransportTCP, config.TransportWebSocket} {
+		c := New(&config.ClientConfig{Server: "vpn.example.com", APIPort: 8080, Transport: tr})
+		bind, err := c.newBind()
+		if err != nil {
+			t.Fatalf("newBind() for %s error: %v", tr, err)
+		}
+		if _, ok := bind.(*transport.ClientBind); !ok {
+			t.Errorf("newBind() for %s = %T, want a stream bind", tr, bind)
+		}
+	}
+}
+
+func TestNewBindObfuscates(t *testing.T) {
+	c := New(&config.ClientConfig{Transport: config.TransportUDP, ObfuscationKey: crypto.KeyToBase64([32]byte{1})})
+	bind, err := c.newBind()
+	if err != nil {
+		t.Fatalf("newBind() error: %v", err)
+	}
+	if _, ok := bind.(*transport.ObfuscatedBind); !ok {
+		t.Errorf("newBind() with an obfuscation key = %T, want an obfuscated bind", bind)
+	}
+}
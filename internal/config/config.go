@@ -6,8 +6,12 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
 )
 
 // validIfaceNameRe matches safe interface names: alphanumeric, hyphens, underscores, dots, max 15 chars.
@@ -15,37 +19,104 @@ var validIfaceNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,14}$`)
 
 // ServerConfig holds the VPN server configuration.
 type ServerConfig struct {
-	ListenPort    int      `toml:"listen_port"`
-	Address       string   `toml:"address"`
-	PrivateKey    string   `toml:"private_key"`
-	PublicKey     string   `toml:"public_key"`
-	APIPort       int      `toml:"api_port"`
-	ExternalHost  string   `toml:"external_host"`
-	DNSServers    []string `toml:"dns_servers"`
-	MTU           int      `toml:"mtu"`
-	InterfaceName string   `toml:"interface_name"`
-	APIKey        string   `toml:"api_key"`
-	LogLevel      string   `toml:"log_level"`
+	ListenPort      int      `toml:"listen_port"`
+	Address         string   `toml:"address"`
+	Address6        string   `toml:"address6"`
+	PrivateKey      string   `toml:"private_key"`
+	PublicKey       string   `toml:"public_key"`
+	APIPort         int      `toml:"api_port"`
+	ExternalHost    string   `toml:"external_host"`
+	DNSServers      []string `toml:"dns_servers"`
+	MTU             int      `toml:"mtu"`
+	InterfaceName   string   `toml:"interface_name"`
+	APIKey          string   `toml:"api_key"`
+	LogLevel        string   `toml:"log_level"`
+	StateDir        string   `toml:"state_dir"`
+	PeerIdleTimeout int      `toml:"peer_idle_timeout"`
+	AdminAPIKey     string   `toml:"admin_api_key"`
+	Routes          []string `toml:"routes"`
+	TLSCertFile     string   `toml:"tls_cert_file"`
+	TLSKeyFile      string   `toml:"tls_key_file"`
+	TLSSelfSigned   bool     `toml:"tls_self_signed"`
+	TokenFile       string   `toml:"token_file"`
+	NATBackend      string   `toml:"nat_backend"`
+	WANInterface    string   `toml:"wan_interface"`
+	Transport       string   `toml:"transport"`
+	TransportPort   int      `toml:"transport_port"`
+	ObfuscationKey  string   `toml:"obfuscation_key"`
+	MetricsListen   string   `toml:"metrics_listen"`
 }
 
 // ClientConfig holds the VPN client configuration.
 type ClientConfig struct {
-	Server              string `toml:"server" json:"server"`
-	APIPort             int    `toml:"api_port" json:"api_port"`
-	ServerPublicKey     string `toml:"server_public_key" json:"server_public_key"`
-	PrivateKey          string `toml:"private_key" json:"private_key"`
-	Address             string `toml:"address" json:"address"`
-	DNS                 string `toml:"dns" json:"dns"`
-	MTU                 int    `toml:"mtu" json:"mtu"`
-	PersistentKeepalive int    `toml:"persistent_keepalive" json:"persistent_keepalive"`
-	InterfaceName       string `toml:"interface_name" json:"interface_name"`
-	APIKey              string `toml:"api_key" json:"api_key"`
-	LogLevel            string `toml:"log_level" json:"log_level"`
-}
-
-// ServerAPIURL returns the full HTTP URL for the server's registration API.
+	Server                 string   `toml:"server" json:"server"`
+	APIPort                int      `toml:"api_port" json:"api_port"`
+	ServerPublicKey        string   `toml:"server_public_key" json:"server_public_key"`
+	PrivateKey             string   `toml:"private_key" json:"private_key"`
+	Address                string   `toml:"address" json:"address"`
+	DNS                    string   `toml:"dns" json:"dns"`
+	MTU                    int      `toml:"mtu" json:"mtu"`
+	PersistentKeepalive    int      `toml:"persistent_keepalive" json:"persistent_keepalive"`
+	InterfaceName          string   `toml:"interface_name" json:"interface_name"`
+	APIKey                 string   `toml:"api_key" json:"api_key"`
+	LogLevel               string   `toml:"log_level" json:"log_level"`
+	UnregisterOnDisconnect bool     `toml:"unregister_on_disconnect" json:"unregister_on_disconnect"`
+	AllowedIPs             []string `toml:"allowed_ips" json:"allowed_ips"`
+	ExcludeIPs             []string `toml:"exclude_ips" json:"exclude_ips"`
+	APITLS                 bool     `toml:"api_tls" json:"api_tls"`
+	APICAFile              string   `toml:"api_ca_file" json:"api_ca_file"`
+	APICertSHA256          string   `toml:"api_cert_sha256" json:"api_cert_sha256"`
+	RegisterAttempts       int      `toml:"register_attempts" json:"register_attempts"`
+	RegisterBackoff        int      `toml:"register_backoff" json:"register_backoff"`
+	RegisterJitter         float64  `toml:"register_jitter" json:"register_jitter"`
+	KillSwitch             bool     `toml:"kill_switch" json:"kill_switch"`
+	Mode                   string   `toml:"mode" json:"mode"`
+	ProxyListen            string   `toml:"proxy_listen" json:"proxy_listen"`
+	Transport              string   `toml:"transport" json:"transport"`
+	TransportPort          int      `toml:"transport_port" json:"transport_port"`
+	ObfuscationKey         string   `toml:"obfuscation_key" json:"obfuscation_key"`
+}
+
+// ServerAPIURL returns the full URL for the server's registration API,
+// using HTTPS when api_tls is enabled.
 func (c *ClientConfig) ServerAPIURL() string {
-	return fmt.Sprintf("http://%s:%d", c.Server, c.APIPort)
+	scheme := "http"
+	if c.APITLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(c.Server, strconv.Itoa(c.APIPort)))
+}
+
+// TLSEnabled reports whether the server API is served over HTTPS.
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSSelfSigned || c.TLSCertFile != ""
+}
+
+// DNSServers returns the DNS servers from the dns field, which may list
+// several addresses separated by commas or spaces.
+func (c *ClientConfig) DNSServers() []string {
+	return strings.FieldsFunc(c.DNS, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// StreamPort returns the TCP port of the stream transport: transport_port
+// if set, otherwise listen_port for tcp and api_port for websocket, which
+// then shares the API's listener.
+func (c *ServerConfig) StreamPort() int {
+	switch {
+	case c.TransportPort != 0:
+		return c.TransportPort
+	case c.Transport == TransportWebSocket:
+		return c.APIPort
+	}
+	return c.ListenPort
+}
+
+// ProxyMode reports whether the client runs a local proxy on a userspace
+// network stack instead of a TUN device.
+func (c *ClientConfig) ProxyMode() bool {
+	return c.Mode == ModeProxy
 }
 
 // LoadServerConfig reads and parses a server config from a TOML file.
@@ -86,6 +157,21 @@ func ParseClientConfig(data string) (*ClientConfig, error) {
 	return cfg, nil
 }
 
+// SaveClientConfig writes cfg to path as TOML. The file is created with
+// restrictive permissions (0600) since client configs contain private keys.
+func SaveClientConfig(path string, cfg *ClientConfig) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	defer f.Close()
+
+	if err := toml.NewEncoder(f).Encode(cfg); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	return nil
+}
+
 // ValidateServerConfig checks that all required server fields are present and valid.
 func ValidateServerConfig(cfg *ServerConfig) error {
 	if cfg.PrivateKey == "" {
@@ -106,6 +192,15 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 	if _, _, err := net.ParseCIDR(cfg.Address); err != nil {
 		return fmt.Errorf("address is not a valid CIDR: %w", err)
 	}
+	if cfg.Address6 != "" {
+		ip, _, err := net.ParseCIDR(cfg.Address6)
+		if err != nil {
+			return fmt.Errorf("address6 is not a valid CIDR: %w", err)
+		}
+		if ip.To4() != nil {
+			return fmt.Errorf("address6 must be an IPv6 CIDR")
+		}
+	}
 	if cfg.ListenPort < 1 || cfg.ListenPort > 65535 {
 		return fmt.Errorf("listen_port must be between 1 and 65535")
 	}
@@ -123,6 +218,43 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 	if err := validateLogLevel(cfg.LogLevel); err != nil {
 		return err
 	}
+	if cfg.PeerIdleTimeout != 0 && cfg.PeerIdleTimeout < MinPeerIdleTimeout {
+		return fmt.Errorf("peer_idle_timeout must be 0 (disabled) or at least %d seconds", MinPeerIdleTimeout)
+	}
+	if err := validateCIDRList(cfg.Routes, "routes"); err != nil {
+		return err
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if cfg.TLSSelfSigned && cfg.TLSCertFile != "" {
+		return fmt.Errorf("tls_self_signed cannot be combined with tls_cert_file")
+	}
+	switch cfg.NATBackend {
+	case "", NATBackendIPTables, NATBackendNFTables, NATBackendNone:
+	default:
+		return fmt.Errorf("nat_backend must be one of: %s, %s, %s (got %q)",
+			NATBackendIPTables, NATBackendNFTables, NATBackendNone, cfg.NATBackend)
+	}
+	if cfg.WANInterface != "" && !validIfaceNameRe.MatchString(cfg.WANInterface) {
+		return fmt.Errorf("wan_interface %q is invalid: must be 1-15 alphanumeric characters, hyphens, underscores, or dots", cfg.WANInterface)
+	}
+	if err := validateTransport(cfg.Transport, cfg.TransportPort); err != nil {
+		return err
+	}
+	if cfg.Transport == TransportTCP && cfg.StreamPort() == cfg.APIPort {
+		return fmt.Errorf("transport = %q cannot share api_port; use %q or another transport_port", TransportTCP, TransportWebSocket)
+	}
+	if cfg.ObfuscationKey != "" {
+		if err := validateBase64Key(cfg.ObfuscationKey, "obfuscation_key"); err != nil {
+			return err
+		}
+	}
+	if cfg.MetricsListen != "" {
+		if _, port, err := net.SplitHostPort(cfg.MetricsListen); err != nil || port == "" {
+			return fmt.Errorf("metrics_listen %q is not a valid host:port", cfg.MetricsListen)
+		}
+	}
 	return nil
 }
 
@@ -137,6 +269,11 @@ func ValidateClientConfig(cfg *ClientConfig) error {
 	if cfg.Server == "" {
 		return fmt.Errorf("server is required")
 	}
+	if cfg.ServerPublicKey != "" {
+		if err := validateBase64Key(cfg.ServerPublicKey, "server_public_key"); err != nil {
+			return err
+		}
+	}
 	if cfg.MTU < 576 || cfg.MTU > 65535 {
 		return fmt.Errorf("mtu must be between 576 and 65535")
 	}
@@ -148,6 +285,81 @@ func ValidateClientConfig(cfg *ClientConfig) error {
 	if err := validateLogLevel(cfg.LogLevel); err != nil {
 		return err
 	}
+	for _, dns := range cfg.DNSServers() {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("dns entry %q is not a valid IP address", dns)
+		}
+	}
+	if err := validateCIDRList(cfg.AllowedIPs, "allowed_ips"); err != nil {
+		return err
+	}
+	if err := validateCIDRList(cfg.ExcludeIPs, "exclude_ips"); err != nil {
+		return err
+	}
+	if !cfg.APITLS && (cfg.APICAFile != "" || cfg.APICertSHA256 != "") {
+		return fmt.Errorf("api_ca_file and api_cert_sha256 require api_tls = true")
+	}
+	if cfg.APICertSHA256 != "" {
+		if _, err := crypto.NormalizeFingerprint(cfg.APICertSHA256); err != nil {
+			return fmt.Errorf("api_cert_sha256 is invalid: %w", err)
+		}
+	}
+	if cfg.RegisterAttempts < 0 {
+		return fmt.Errorf("register_attempts must not be negative")
+	}
+	if cfg.RegisterBackoff < 0 {
+		return fmt.Errorf("register_backoff must not be negative")
+	}
+	if cfg.RegisterJitter < 0 || cfg.RegisterJitter > 1 {
+		return fmt.Errorf("register_jitter must be between 0 and 1")
+	}
+	switch cfg.Mode {
+	case "", ModeTUN:
+	case ModeProxy:
+		if cfg.KillSwitch {
+			return fmt.Errorf("kill_switch requires mode = %q", ModeTUN)
+		}
+	default:
+		return fmt.Errorf("mode must be one of: %s, %s (got %q)", ModeTUN, ModeProxy, cfg.Mode)
+	}
+	if cfg.ProxyListen != "" {
+		if _, port, err := net.SplitHostPort(cfg.ProxyListen); err != nil || port == "" {
+			return fmt.Errorf("proxy_listen %q is not a valid host:port", cfg.ProxyListen)
+		}
+	}
+	if err := validateTransport(cfg.Transport, cfg.TransportPort); err != nil {
+		return err
+	}
+	if cfg.ObfuscationKey != "" {
+		if err := validateBase64Key(cfg.ObfuscationKey, "obfuscation_key"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTransport(transport string, port int) error {
+	switch transport {
+	case "", TransportUDP:
+		if port != 0 {
+			return fmt.Errorf("transport_port requires transport = %q or %q", TransportTCP, TransportWebSocket)
+		}
+	case TransportTCP, TransportWebSocket:
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("transport_port must be between 1 and 65535, or 0 for the default")
+		}
+	default:
+		return fmt.Errorf("transport must be one of: %s, %s, %s (got %q)", TransportUDP, TransportTCP, TransportWebSocket, transport)
+	}
+	return nil
+}
+
+func validateCIDRList(cidrs []string, field string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("%s entry %q is not a valid CIDR", field, cidr)
+		}
+	}
 	return nil
 }
 
@@ -200,6 +412,12 @@ func applyServerDefaults(cfg *ServerConfig) {
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = DefaultLogLevel
 	}
+	if cfg.NATBackend == "" {
+		cfg.NATBackend = DefaultNATBackend
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = DefaultTransport
+	}
 }
 
 // ApplyClientDefaults fills in zero-value fields with sensible defaults.
@@ -219,4 +437,19 @@ func ApplyClientDefaults(cfg *ClientConfig) {
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = DefaultLogLevel
 	}
+	if cfg.RegisterAttempts == 0 {
+		cfg.RegisterAttempts = DefaultRegisterAttempts
+	}
+	if cfg.RegisterBackoff == 0 {
+		cfg.RegisterBackoff = DefaultRegisterBackoff
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = DefaultMode
+	}
+	if cfg.ProxyListen == "" {
+		cfg.ProxyListen = DefaultProxyListen
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = DefaultTransport
+	}
 }
@@ -2,6 +2,9 @@ package config
 
 import (
 	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -109,6 +112,12 @@ func TestServerConfigDefaults(t *testing.T) {
 	if cfg.LogLevel != DefaultLogLevel {
 		t.Errorf("default LogLevel = %s, want %s", cfg.LogLevel, DefaultLogLevel)
 	}
+	if cfg.NATBackend != DefaultNATBackend {
+		t.Errorf("default NATBackend = %s, want %s", cfg.NATBackend, DefaultNATBackend)
+	}
+	if cfg.Transport != DefaultTransport {
+		t.Errorf("default Transport = %s, want %s", cfg.Transport, DefaultTransport)
+	}
 }
 
 func TestClientConfigDefaults(t *testing.T) {
@@ -132,6 +141,15 @@ func TestClientConfigDefaults(t *testing.T) {
 	if cfg.LogLevel != DefaultLogLevel {
 		t.Errorf("default LogLevel = %s, want %s", cfg.LogLevel, DefaultLogLevel)
 	}
+	if cfg.Mode != DefaultMode {
+		t.Errorf("default Mode = %s, want %s", cfg.Mode, DefaultMode)
+	}
+	if cfg.ProxyListen != DefaultProxyListen {
+		t.Errorf("default ProxyListen = %s, want %s", cfg.ProxyListen, DefaultProxyListen)
+	}
+	if cfg.Transport != DefaultTransport {
+		t.Errorf("default Transport = %s, want %s", cfg.Transport, DefaultTransport)
+	}
 }
 
 func TestInvalidTOMLReturnsError(t *testing.T) {
@@ -223,6 +241,16 @@ func TestValidateServerConfig_InvalidValues(t *testing.T) {
 			mutate: func(c *ServerConfig) { c.Address = "not-a-cidr" },
 			want:   "address is not a valid CIDR",
 		},
+		{
+			name:   "bad IPv6 CIDR",
+			mutate: func(c *ServerConfig) { c.Address6 = "fd00::1" },
+			want:   "address6 is not a valid CIDR",
+		},
+		{
+			name:   "IPv4 address6",
+			mutate: func(c *ServerConfig) { c.Address6 = "10.1.0.1/24" },
+			want:   "address6 must be an IPv6 CIDR",
+		},
 		{
 			name:   "port too high",
 			mutate: func(c *ServerConfig) { c.ListenPort = 70000 },
@@ -253,6 +281,68 @@ func TestValidateServerConfig_InvalidValues(t *testing.T) {
 			mutate: func(c *ServerConfig) { c.LogLevel = "debug" },
 			want:   "log_level must be one of",
 		},
+		{
+			name:   "peer_idle_timeout too short",
+			mutate: func(c *ServerConfig) { c.PeerIdleTimeout = 30 },
+			want:   "peer_idle_timeout must be 0",
+		},
+		{
+			name:   "bad route",
+			mutate: func(c *ServerConfig) { c.Routes = []string{"10.10.0.0"} },
+			want:   "routes entry",
+		},
+		{
+			name:   "tls cert without key",
+			mutate: func(c *ServerConfig) { c.TLSCertFile = "/etc/shikvpn/api.crt" },
+			want:   "tls_cert_file and tls_key_file must be set together",
+		},
+		{
+			name: "tls self-signed with cert files",
+			mutate: func(c *ServerConfig) {
+				c.TLSSelfSigned = true
+				c.TLSCertFile = "/etc/shikvpn/api.crt"
+				c.TLSKeyFile = "/etc/shikvpn/api.key"
+			},
+			want: "tls_self_signed cannot be combined",
+		},
+		{
+			name:   "unknown nat backend",
+			mutate: func(c *ServerConfig) { c.NATBackend = "pf" },
+			want:   "nat_backend must be one of",
+		},
+		{
+			name:   "bad wan interface",
+			mutate: func(c *ServerConfig) { c.WANInterface = "eth0; rm -rf /" },
+			want:   "wan_interface",
+		},
+		{
+			name:   "unknown transport",
+			mutate: func(c *ServerConfig) { c.Transport = "quic" },
+			want:   "transport must be one of",
+		},
+		{
+			name:   "transport port without a stream transport",
+			mutate: func(c *ServerConfig) { c.TransportPort = 443 },
+			want:   "transport_port requires transport",
+		},
+		{
+			name: "tcp transport on the api port",
+			mutate: func(c *ServerConfig) {
+				c.Transport = TransportTCP
+				c.TransportPort = c.APIPort
+			},
+			want: "cannot share api_port",
+		},
+		{
+			name:   "bad obfuscation key",
+			mutate: func(c *ServerConfig) { c.ObfuscationKey = "c2hvcnQ=" },
+			want:   "obfuscation_key must decode to 32 bytes",
+		},
+		{
+			name:   "metrics listener without port",
+			mutate: func(c *ServerConfig) { c.MetricsListen = "127.0.0.1" },
+			want:   "metrics_listen \"127.0.0.1\" is not a valid host:port",
+		},
 	}
 
 	for _, tt := range tests {
@@ -314,6 +404,85 @@ func TestValidateClientConfig_InvalidValues(t *testing.T) {
 			mutate: func(c *ClientConfig) { c.MTU = 10 },
 			want:   "mtu must be between",
 		},
+		{
+			name:   "bad dns entry",
+			mutate: func(c *ClientConfig) { c.DNS = "1.1.1.1, dns.example" },
+			want:   "dns entry",
+		},
+		{
+			name:   "bad allowed_ips entry",
+			mutate: func(c *ClientConfig) { c.AllowedIPs = []string{"10.0.0.0/8", "192.168.1.1"} },
+			want:   "allowed_ips entry",
+		},
+		{
+			name:   "bad exclude_ips entry",
+			mutate: func(c *ClientConfig) { c.ExcludeIPs = []string{"office"} },
+			want:   "exclude_ips entry",
+		},
+		{
+			name:   "pin without api_tls",
+			mutate: func(c *ClientConfig) { c.APICertSHA256 = strings.Repeat("ab", 32) },
+			want:   "require api_tls",
+		},
+		{
+			name: "bad pin",
+			mutate: func(c *ClientConfig) {
+				c.APITLS = true
+				c.APICertSHA256 = "abcd"
+			},
+			want: "api_cert_sha256 is invalid",
+		},
+		{
+			name:   "negative register_attempts",
+			mutate: func(c *ClientConfig) { c.RegisterAttempts = -1 },
+			want:   "register_attempts must not be negative",
+		},
+		{
+			name:   "negative register_backoff",
+			mutate: func(c *ClientConfig) { c.RegisterBackoff = -5 },
+			want:   "register_backoff must not be negative",
+		},
+		{
+			name:   "register_jitter above one",
+			mutate: func(c *ClientConfig) { c.RegisterJitter = 1.5 },
+			want:   "register_jitter must be between",
+		},
+		{
+			name:   "unknown mode",
+			mutate: func(c *ClientConfig) { c.Mode = "tap" },
+			want:   "mode must be one of",
+		},
+		{
+			name: "kill switch in proxy mode",
+			mutate: func(c *ClientConfig) {
+				c.Mode = ModeProxy
+				c.KillSwitch = true
+			},
+			want: "kill_switch requires mode",
+		},
+		{
+			name:   "bad proxy_listen",
+			mutate: func(c *ClientConfig) { c.ProxyListen = "1080" },
+			want:   "proxy_listen",
+		},
+		{
+			name:   "unknown transport",
+			mutate: func(c *ClientConfig) { c.Transport = "quic" },
+			want:   "transport must be one of",
+		},
+		{
+			name: "bad transport port",
+			mutate: func(c *ClientConfig) {
+				c.Transport = TransportWebSocket
+				c.TransportPort = 70000
+			},
+			want: "transport_port must be between",
+		},
+		{
+			name:   "bad obfuscation key",
+			mutate: func(c *ClientConfig) { c.ObfuscationKey = "not base64!" },
+			want:   "obfuscation_key is not valid base64",
+		},
 	}
 
 	for _, tt := range tests {
@@ -361,3 +530,83 @@ api_key = "my-secret-key"
 		t.Errorf("APIKey = %q, want %q", cfg.APIKey, "my-secret-key")
 	}
 }
+
+func TestServerConfigStreamPort(t *testing.T) {
+	tests := []struct {
+		transport string
+		port      int
+		want      int
+	}{
+		{TransportTCP, 0, 51820},
+		{TransportWebSocket, 0, 8080},
+		{TransportWebSocket, 443, 443},
+	}
+	for _, tt := range tests {
+		cfg := &ServerConfig{ListenPort: 51820, APIPort: 8080, Transport: tt.transport, TransportPort: tt.port}
+		if got := cfg.StreamPort(); got != tt.want {
+			t.Errorf("StreamPort() for %s with transport_port %d = %d, want %d", tt.transport, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestClientConfigDNSServers(t *testing.T) {
+	tests := []struct {
+		dns  string
+		want []string
+	}{
+		{"", nil},
+		{"1.1.1.1", []string{"1.1.1.1"}},
+		{"1.1.1.1,8.8.8.8", []string{"1.1.1.1", "8.8.8.8"}},
+		{" 10.0.0.1 , 9.9.9.9  1.0.0.1", []string{"10.0.0.1", "9.9.9.9", "1.0.0.1"}},
+	}
+
+	for _, tt := range tests {
+		cfg := ClientConfig{DNS: tt.dns}
+		got := cfg.DNSServers()
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("DNSServers(%q) = %v, want %v", tt.dns, got, tt.want)
+		}
+	}
+}
+
+func TestClientConfigServerAPIURL(t *testing.T) {
+	cfg := &ClientConfig{Server: "vpn.example.com", APIPort: 8443}
+	if got := cfg.ServerAPIURL(); got != "http://vpn.example.com:8443" {
+		t.Errorf("ServerAPIURL() = %q, want http://vpn.example.com:8443", got)
+	}
+	cfg.APITLS = true
+	if got := cfg.ServerAPIURL(); got != "https://vpn.example.com:8443" {
+		t.Errorf("ServerAPIURL() = %q, want https://vpn.example.com:8443", got)
+	}
+}
+
+func TestSaveClientConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.toml")
+	cfg := &ClientConfig{
+		Server:     "vpn.example.com",
+		PrivateKey: validKey(),
+		APIKey:     "shk_token",
+		AllowedIPs: []string{"10.20.0.0/16"},
+	}
+	ApplyClientDefaults(cfg)
+
+	if err := SaveClientConfig(path, cfg); err != nil {
+		t.Fatalf("SaveClientConfig() error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("permissions = %v, want 0600", info.Mode().Perm())
+	}
+
+	loaded, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("LoadClientConfig() error: %v", err)
+	}
+	if loaded.Server != cfg.Server || loaded.APIKey != cfg.APIKey || loaded.PrivateKey != cfg.PrivateKey ||
+		len(loaded.AllowedIPs) != 1 || loaded.AllowedIPs[0] != "10.20.0.0/16" {
+		t.Errorf("loaded config = %+v, want %+v", loaded, cfg)
+	}
+}
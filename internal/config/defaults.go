@@ -8,6 +8,38 @@ const (
 	DefaultPersistentKeepalive = 25
 	DefaultInterfaceName       = "wg0"
 	DefaultLogLevel            = "error"
+	DefaultRegisterAttempts    = 3
+	DefaultRegisterBackoff     = 2 // seconds before the first retry; doubles on each further retry
+	DefaultNATBackend          = NATBackendIPTables
+	DefaultMode                = ModeTUN
+	DefaultProxyListen         = "127.0.0.1:1080"
+	DefaultTransport           = TransportUDP
+
+	// MinPeerIdleTimeout is the smallest allowed peer_idle_timeout in seconds.
+	// WireGuard renews handshakes every 2 minutes on active sessions, so
+	// anything shorter would evict healthy peers.
+	MinPeerIdleTimeout = 180
+)
+
+// NAT backends for the server's nat_backend option.
+const (
+	NATBackendIPTables = "iptables" // MASQUERADE rules in the iptables nat table
+	NATBackendNFTables = "nftables" // a dedicated nftables table
+	NATBackendNone     = "none"     // leave NAT to the administrator
+)
+
+// Client modes for the client's mode option.
+const (
+	ModeTUN   = "tun"   // route traffic through a TUN device; needs root
+	ModeProxy = "proxy" // serve a local SOCKS5/HTTP proxy from a userspace network stack
+)
+
+// Transports for the transport option. On the server a stream transport is
+// served alongside UDP, so clients can use either.
+const (
+	TransportUDP       = "udp"       // plain WireGuard
+	TransportTCP       = "tcp"       // WireGuard datagrams framed in a TCP stream
+	TransportWebSocket = "websocket" // WireGuard datagrams framed in a WebSocket stream
 )
 
 var DefaultDNSServers = []string{"1.1.1.1", "8.8.8.8"}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// invitePrefix identifies (and versions) invite codes.
+const invitePrefix = "shikvpn1."
+
+// Invite is everything a new client needs to register: where the server API
+// is, how to trust it, and a one-time credential.
+type Invite struct {
+	Server          string `json:"server"`
+	APIPort         int    `json:"api_port"`
+	Token           string `json:"token"`
+	ServerPublicKey string `json:"server_public_key"`
+	APITLS          bool   `json:"api_tls,omitempty"`
+	APICertSHA256   string `json:"api_cert_sha256,omitempty"`
+	Transport       string `json:"transport,omitempty"`
+	TransportPort   int    `json:"transport_port,omitempty"`
+	ObfuscationKey  string `json:"obfuscation_key,omitempty"`
+}
+
+// EncodeInvite returns inv as a copy-pasteable invite code.
+func EncodeInvite(inv Invite) (string, error) {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode invite: %w", err)
+	}
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeInvite parses an invite code produced by EncodeInvite.
+func DecodeInvite(code string) (Invite, error) {
+	code = strings.TrimSpace(code)
+	if !strings.HasPrefix(code, invitePrefix) {
+		return Invite{}, fmt.Errorf("not a ShikVPN invite code")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(code, invitePrefix))
+	if err != nil {
+		return Invite{}, fmt.Errorf("invite code is corrupted: %w", err)
+	}
+
+	var inv Invite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return Invite{}, fmt.Errorf("invite code is corrupted: %w", err)
+	}
+	if inv.Server == "" || inv.Token == "" || inv.ServerPublicKey == "" {
+		return Invite{}, fmt.Errorf("invite code is incomplete")
+	}
+	if inv.APIPort <= 0 || inv.APIPort > 65535 {
+		return Invite{}, fmt.Errorf("invite code has invalid api_port %d", inv.APIPort)
+	}
+	if err := validateBase64Key(inv.ServerPublicKey, "server_public_key"); err != nil {
+		return Invite{}, err
+	}
+	if err := validateTransport(inv.Transport, inv.TransportPort); err != nil {
+		return Invite{}, err
+	}
+	if inv.ObfuscationKey != "" {
+		if err := validateBase64Key(inv.ObfuscationKey, "obfuscation_key"); err != nil {
+			return Invite{}, err
+		}
+	}
+	return inv, nil
+}
+
+// ClientConfig returns a client config for the invite's server with default
+// settings and the invite token as its API key. Clients of a server with a
+// stream transport use it, as they may be on a network that blocks UDP.
+func (inv Invite) ClientConfig() *ClientConfig {
+	cfg := &ClientConfig{
+		Server:          inv.Server,
+		APIPort:         inv.APIPort,
+		ServerPublicKey: inv.ServerPublicKey,
+		APIKey:          inv.Token,
+		APITLS:          inv.APITLS,
+		APICertSHA256:   inv.APICertSHA256,
+		Transport:       inv.Transport,
+		TransportPort:   inv.TransportPort,
+		ObfuscationKey:  inv.ObfuscationKey,
+	}
+	ApplyClientDefaults(cfg)
+	return cfg
+}
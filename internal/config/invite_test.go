@@ -0,0 +1,71 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInviteRoundTrip(t *testing.T) {
+	inv := Invite{
+		Server:          "vpn.example.com",
+		APIPort:         8443,
+		Token:           "shk_secret",
+		ServerPublicKey: validKey(),
+		APITLS:          true,
+		APICertSHA256:   strings.Repeat("ab", 32),
+		Transport:       TransportWebSocket,
+		TransportPort:   443,
+		ObfuscationKey:  validKey(),
+	}
+	code, err := EncodeInvite(inv)
+	if err != nil {
+		t.Fatalf("EncodeInvite() error: %v", err)
+	}
+	if !strings.HasPrefix(code, invitePrefix) {
+		t.Errorf("code %q lacks prefix %q", code, invitePrefix)
+	}
+
+	got, err := DecodeInvite("  " + code + "\n")
+	if err != nil {
+		t.Fatalf("DecodeInvite() error: %v", err)
+	}
+	if got != inv {
+		t.Errorf("DecodeInvite() = %+v, want %+v", got, inv)
+	}
+}
+
+func TestDecodeInviteInvalid(t *testing.T) {
+	incomplete, _ := EncodeInvite(Invite{Server: "vpn.example.com", APIPort: 8080, ServerPublicKey: validKey()})
+	badPort, _ := EncodeInvite(Invite{Server: "vpn.example.com", Token: "t", ServerPublicKey: validKey()})
+	badKey, _ := EncodeInvite(Invite{Server: "vpn.example.com", APIPort: 8080, Token: "t", ServerPublicKey: "short"})
+	badObfuscation, _ := EncodeInvite(Invite{Server: "vpn.example.com", APIPort: 8080, Token: "t", ServerPublicKey: validKey(), ObfuscationKey: "short"})
+	badTransport, _ := EncodeInvite(Invite{Server: "vpn.example.com", APIPort: 8080, Token: "t", ServerPublicKey: validKey(), Transport: "quic"})
+
+	for name, code := range map[string]string{
+		"wrong prefix":        "hello",
+		"bad base64":          invitePrefix + "!!!",
+		"bad json":            invitePrefix + "bm90IGpzb24",
+		"no token":            incomplete,
+		"no port":             badPort,
+		"bad key":             badKey,
+		"bad obfuscation key": badObfuscation,
+		"bad transport":       badTransport,
+	} {
+		if _, err := DecodeInvite(code); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestInviteClientConfig(t *testing.T) {
+	inv := Invite{Server: "vpn.example.com", APIPort: 9000, Token: "shk_x", ServerPublicKey: validKey(), Transport: TransportTCP, TransportPort: 443, ObfuscationKey: validKey()}
+	cfg := inv.ClientConfig()
+
+	if cfg.Server != "vpn.example.com" || cfg.APIPort != 9000 || cfg.APIKey != "shk_x" || cfg.ServerPublicKey != validKey() ||
+		cfg.Transport != TransportTCP || cfg.TransportPort != 443 || cfg.ObfuscationKey != validKey() {
+		t.Errorf("ClientConfig() = %+v, missing invite fields", cfg)
+	}
+	if cfg.MTU != DefaultMTU || cfg.InterfaceName != DefaultInterfaceName {
+		t.Errorf("ClientConfig() defaults not applied: MTU=%d interface=%q", cfg.MTU, cfg.InterfaceName)
+	}
+}
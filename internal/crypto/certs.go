@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// CertFingerprint returns the lowercase hex SHA-256 of a DER-encoded certificate,
+// the format used for api_cert_sha256 pinning.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint accepts a SHA-256 fingerprint in plain or
+// colon-separated hex of either case and returns it as lowercase hex.
+func NormalizeFingerprint(fp string) (string, error) {
+	s := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("fingerprint is not valid hex: %w", err)
+	}
+	if len(b) != sha256.Size {
+		return "", fmt.Errorf("fingerprint must be %d bytes (got %d)", sha256.Size, len(b))
+	}
+	return s, nil
+}
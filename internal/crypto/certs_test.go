@@ -0,0 +1,33 @@
+package crypto
+
+import "testing"
+
+func TestCertFingerprint(t *testing.T) {
+	// SHA-256 of the empty input
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := CertFingerprint(nil); got != want {
+		t.Errorf("CertFingerprint() = %s, want %s", got, want)
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	plain := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	colons := "E3:B0:C4:42:98:FC:1C:14:9A:FB:F4:C8:99:6F:B9:24:27:AE:41:E4:64:9B:93:4C:A4:95:99:1B:78:52:B8:55"
+
+	for _, in := range []string{plain, colons, " " + plain + " "} {
+		got, err := NormalizeFingerprint(in)
+		if err != nil {
+			t.Errorf("NormalizeFingerprint(%q) error: %v", in, err)
+			continue
+		}
+		if got != plain {
+			t.Errorf("NormalizeFingerprint(%q) = %s, want %s", in, got, plain)
+		}
+	}
+
+	for _, in := range []string{"", "zz", plain[:62]} {
+		if _, err := NormalizeFingerprint(in); err == nil {
+			t.Errorf("NormalizeFingerprint(%q) succeeded, want error", in)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// SharedSecret computes the X25519 shared secret between a private key and a peer's public key.
+// Both sides of a WireGuard key pair arrive at the same value, which lets a peer prove
+// possession of its private key to the server without revealing it.
+func SharedSecret(privateKey, peerPublicKey [KeySize]byte) ([KeySize]byte, error) {
+	shared, err := curve25519.X25519(privateKey[:], peerPublicKey[:])
+	if err != nil {
+		return [KeySize]byte{}, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	var out [KeySize]byte
+	copy(out[:], shared)
+	return out, nil
+}
+
+// ComputeProof returns an HMAC-SHA256 of message keyed by the X25519 shared secret.
+func ComputeProof(privateKey, peerPublicKey [KeySize]byte, message []byte) ([]byte, error) {
+	shared, err := SharedSecret(privateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+// VerifyProof checks a proof produced by ComputeProof on the other side of the key exchange.
+func VerifyProof(privateKey, peerPublicKey [KeySize]byte, message, proof []byte) bool {
+	expected, err := ComputeProof(privateKey, peerPublicKey, message)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, proof)
+}
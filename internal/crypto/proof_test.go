@@ -0,0 +1,57 @@
+package crypto
+
+import "testing"
+
+func TestSharedSecretSymmetric(t *testing.T) {
+	a, _ := GenerateKeyPair()
+	b, _ := GenerateKeyPair()
+
+	ab, err := SharedSecret(a.PrivateKey, b.PublicKey)
+	if err != nil {
+		t.Fatalf("SharedSecret() error: %v", err)
+	}
+	ba, err := SharedSecret(b.PrivateKey, a.PublicKey)
+	if err != nil {
+		t.Fatalf("SharedSecret() error: %v", err)
+	}
+	if ab != ba {
+		t.Error("shared secrets differ between the two sides")
+	}
+}
+
+func TestProofRoundTrip(t *testing.T) {
+	client, _ := GenerateKeyPair()
+	server, _ := GenerateKeyPair()
+	msg := []byte("hello")
+
+	proof, err := ComputeProof(client.PrivateKey, server.PublicKey, msg)
+	if err != nil {
+		t.Fatalf("ComputeProof() error: %v", err)
+	}
+	if !VerifyProof(server.PrivateKey, client.PublicKey, msg, proof) {
+		t.Error("VerifyProof() rejected a valid proof")
+	}
+}
+
+func TestProofRejectsWrongKey(t *testing.T) {
+	client, _ := GenerateKeyPair()
+	other, _ := GenerateKeyPair()
+	server, _ := GenerateKeyPair()
+	msg := []byte("hello")
+
+	// A proof made with someone else's private key must not verify for client
+	proof, _ := ComputeProof(other.PrivateKey, server.PublicKey, msg)
+	if VerifyProof(server.PrivateKey, client.PublicKey, msg, proof) {
+		t.Error("VerifyProof() accepted a proof from the wrong private key")
+	}
+}
+
+func TestProofRejectsTamperedMessage(t *testing.T) {
+	client, _ := GenerateKeyPair()
+	server, _ := GenerateKeyPair()
+
+	proof, _ := ComputeProof(client.PrivateKey, server.PublicKey, []byte("hello"))
+	if VerifyProof(server.PrivateKey, client.PublicKey, []byte("hellO"), proof) {
+		t.Error("VerifyProof() accepted a proof for a different message")
+	}
+}
@@ -0,0 +1,237 @@
+package e2e
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// whoami answers with the tunnel address the request came from.
+func whoami(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	fmt.Fprint(w, host)
+}
+
+// fetch GETs url through c's tunnel and returns the body.
+func fetch(t *testing.T, c *Client, url string) string {
+	t.Helper()
+	resp, err := c.HTTPClient().Get(url)
+	if err != nil {
+		t.Fatalf("GET %s through the tunnel: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", url, err)
+	}
+	return string(body)
+}
+
+func TestClientsReachServerThroughTunnel(t *testing.T) {
+	h := New(t, nil)
+	url := h.Serve(80, http.HandlerFunc(whoami))
+
+	clients := []*Client{h.Connect(nil), h.Connect(nil), h.Connect(nil)}
+
+	seen := make(map[string]bool)
+	for i, c := range clients {
+		assigned := netip.MustParsePrefix(c.Config.Address).Addr().String()
+		if seen[assigned] {
+			t.Fatalf("client %d was assigned %s, which is already in use", i, assigned)
+		}
+		seen[assigned] = true
+
+		// The server sees the request arrive from the client's tunnel address
+		if got := fetch(t, c, url); got != assigned {
+			t.Errorf("client %d: server saw source %q, want %q", i, got, assigned)
+		}
+	}
+}
+
+func TestServerPeerStats(t *testing.T) {
+	h := New(t, nil)
+	url := h.Serve(80, http.HandlerFunc(whoami))
+	c := h.Connect(nil)
+	fetch(t, c, url)
+
+	stats, err := h.Server.PeerStats()
+	if err != nil {
+		t.Fatalf("PeerStats() error: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("server has %d peers, want 1", len(stats))
+	}
+	if stats[0].LastHandshake.IsZero() || stats[0].RxBytes == 0 || stats[0].TxBytes == 0 {
+		t.Errorf("peer shows no traffic after a request: %+v", stats[0])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := New(t, nil)
+	url := h.Serve(80, http.HandlerFunc(whoami))
+	c := h.Connect(nil)
+	fetch(t, c, url)
+
+	rec := httptest.NewRecorder()
+	h.Server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want 200", rec.Code)
+	}
+
+	privKey, err := crypto.KeyFromBase64(c.Config.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.PublicKeyFromPrivate(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := crypto.KeyToBase64(pub)
+	body := rec.Body.String()
+	for _, want := range []string{
+		`shikvpn_registrations_total{result="success"} 1`,
+		`shikvpn_ipam_pool_size{family="ipv4"} 253`,
+		`shikvpn_ipam_pool_used{family="ipv4"} 1`,
+		`shikvpn_ipam_pool_used{family="ipv6"} 1`,
+		"shikvpn_peers 1",
+		`shikvpn_peer_receive_bytes_total{public_key="` + pubKey + `"}`,
+		`shikvpn_peer_transmit_bytes_total{public_key="` + pubKey + `"}`,
+		`shikvpn_peer_last_handshake_age_seconds{public_key="` + pubKey + `"}`,
+		`shikvpn_api_request_duration_seconds_count{code="200",endpoint="register"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
+
+func TestFailedStartReleasesMetricsListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ServerConfig{
+		ListenPort:    serverListenPort,
+		Address:       "10.0.0.1/24",
+		PrivateKey:    crypto.KeyToBase64(kp.PrivateKey),
+		PublicKey:     crypto.KeyToBase64(kp.PublicKey),
+		ExternalHost:  serverHost.String(),
+		MTU:           config.DefaultMTU,
+		LogLevel:      "silent",
+		NATBackend:    config.NATBackendNone,
+		MetricsListen: addr,
+		TLSCertFile:   "/nonexistent/cert.pem",
+		TLSKeyFile:    "/nonexistent/key.pem",
+	}
+	srv := server.New(cfg)
+	srv.UseNetstack(tunnel.NewMemoryNetwork().Bind(serverHost))
+	if err := srv.Start(); err == nil {
+		srv.Stop()
+		t.Fatal("Start() with a missing certificate succeeded")
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("metrics address still in use after a failed Start: %v", err)
+	}
+	ln.Close()
+}
+
+func TestRegistrationRequiresAPIKey(t *testing.T) {
+	h := New(t, nil)
+
+	cfg, err := h.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIKey = "wrong"
+	cfg.RegisterAttempts = 1
+	_, err = connect(h, cfg)
+	if err == nil || !strings.Contains(err.Error(), "registration failed") {
+		t.Errorf("Connect() with a wrong API key error = %v, want a registration failure", err)
+	}
+}
+
+func TestIPv6ThroughTunnel(t *testing.T) {
+	h := New(t, func(cfg *config.ServerConfig) { cfg.Address6 = "fd00:1::1/64" })
+	c := h.Connect(nil)
+
+	ln, err := h.ServerNet().ListenTCP(&net.TCPAddr{IP: net.ParseIP("fd00:1::1"), Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(whoami)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	got := fetch(t, c, "http://[fd00:1::1]:8080/")
+	if addr, err := netip.ParseAddr(got); err != nil || !addr.Is6() {
+		t.Errorf("server saw source %q, want the client's IPv6 tunnel address", got)
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	// The stream goes to the endpoint's address, which must be reachable
+	h := New(t, func(cfg *config.ServerConfig) {
+		cfg.Transport = config.TransportWebSocket
+		cfg.ExternalHost = "127.0.0.1"
+	})
+	url := h.Serve(80, http.HandlerFunc(whoami))
+
+	ws := h.Connect(func(cfg *config.ClientConfig) { cfg.Transport = config.TransportWebSocket })
+	assigned := netip.MustParsePrefix(ws.Config.Address).Addr().String()
+	if got := fetch(t, ws, url); got != assigned {
+		t.Errorf("server saw source %q, want %q", got, assigned)
+	}
+
+	stats, err := h.Server.PeerStats()
+	if err != nil {
+		t.Fatalf("PeerStats() error: %v", err)
+	}
+	if len(stats) != 1 || !strings.HasPrefix(stats[0].Endpoint, "127.0.0.1:") {
+		t.Errorf("peer stats = %+v, want one peer connected from loopback", stats)
+	}
+}
+
+func TestObfuscatedTunnel(t *testing.T) {
+	key := crypto.KeyToBase64([32]byte{7})
+	h := New(t, func(cfg *config.ServerConfig) { cfg.ObfuscationKey = key })
+	url := h.Serve(80, http.HandlerFunc(whoami))
+
+	c := h.Connect(func(cfg *config.ClientConfig) { cfg.ObfuscationKey = key })
+	assigned := netip.MustParsePrefix(c.Config.Address).Addr().String()
+	if got := fetch(t, c, url); got != assigned {
+		t.Errorf("server saw source %q, want %q", got, assigned)
+	}
+}
+
+func TestObfuscationKeyMismatch(t *testing.T) {
+	h := New(t, func(cfg *config.ServerConfig) { cfg.ObfuscationKey = crypto.KeyToBase64([32]byte{7}) })
+	url := h.Serve(80, http.HandlerFunc(whoami))
+
+	// A plain client registers, but its handshakes are dropped
+	c := h.Connect(nil)
+	client := c.HTTPClient()
+	client.Timeout = time.Second
+	if _, err := client.Get(url); err == nil {
+		t.Error("a client without the obfuscation key reached the server")
+	}
+}
@@ -0,0 +1,197 @@
+// Package e2e runs a VPN server and its clients in one process for
+// end-to-end tests. Every tunnel runs on a userspace network stack and the
+// WireGuard packets travel over a tunnel.MemoryNetwork, so the tests need no
+// root, TUN devices or UDP ports; only the registration API listens on
+// loopback, through httptest.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/client"
+	"github.com/gavsh/ShikVPN/internal/config"
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/server"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	// APIKey is the registration key of harness servers.
+	APIKey = "e2e-api-key"
+
+	// serverListenPort is the server's WireGuard port on the memory network.
+	serverListenPort = 51820
+)
+
+// serverHost is the server's public address on the memory network.
+var serverHost = netip.MustParseAddr("192.0.2.1")
+
+// Harness is a running server with its memory network.
+type Harness struct {
+	t       testing.TB
+	Network *tunnel.MemoryNetwork
+	Server  *server.Server
+	Config  *config.ServerConfig
+	API     *httptest.Server
+
+	nextClient int
+}
+
+// New starts a server on 10.0.0.1/24 and fd00::1/64 and stops it when the
+// test ends. mutate, if not nil, may adjust the server config first.
+func New(t testing.TB, mutate func(*config.ServerConfig)) *Harness {
+	t.Helper()
+
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("failed to generate server keys: %v", err)
+	}
+	cfg := &config.ServerConfig{
+		ListenPort:   serverListenPort,
+		Address:      "10.0.0.1/24",
+		Address6:     "fd00::1/64",
+		PrivateKey:   crypto.KeyToBase64(kp.PrivateKey),
+		PublicKey:    crypto.KeyToBase64(kp.PublicKey),
+		ExternalHost: serverHost.String(),
+		MTU:          config.DefaultMTU,
+		APIKey:       APIKey,
+		LogLevel:     "silent",
+		NATBackend:   config.NATBackendNone,
+	}
+	if mutate != nil {
+		mutate(cfg)
+	}
+
+	h := &Harness{
+		t:       t,
+		Network: tunnel.NewMemoryNetwork(),
+		Config:  cfg,
+		Server:  server.New(cfg),
+	}
+	h.Server.UseNetstack(h.Network.Bind(serverHost))
+	if err := h.Server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(h.Server.Stop)
+
+	h.API = httptest.NewServer(h.Server.APIHandler())
+	t.Cleanup(h.API.Close)
+	return h
+}
+
+// ServerNet returns the network stack owning the server's tunnel addresses,
+// for serving or dialing on the VPN side.
+func (h *Harness) ServerNet() *netstack.Net {
+	return h.Server.Net()
+}
+
+// Client is a connected client of a Harness.
+type Client struct {
+	*client.Client
+	Config *config.ClientConfig
+}
+
+// Connect registers and connects a new proxy-mode client, which disconnects
+// when the test ends. mutate, if not nil, may adjust the client config first.
+func (h *Harness) Connect(mutate func(*config.ClientConfig)) *Client {
+	h.t.Helper()
+
+	cfg, err := h.ClientConfig()
+	if err != nil {
+		h.t.Fatalf("failed to create client config: %v", err)
+	}
+	if mutate != nil {
+		mutate(cfg)
+	}
+
+	c, err := connect(h, cfg)
+	if err != nil {
+		h.t.Fatalf("client failed to connect: %v", err)
+	}
+	return c
+}
+
+// connect connects a client with cfg, which disconnects when the test ends.
+// Clients using UDP reach the server over the memory network, and clients
+// using a stream transport over loopback.
+func connect(h *Harness, cfg *config.ClientConfig) (*Client, error) {
+	h.nextClient++
+	c := client.New(cfg)
+	if cfg.Transport == config.TransportUDP {
+		c.UseBind(h.Network.Bind(netip.AddrFrom4([4]byte{198, 51, 100, byte(h.nextClient)})))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+	h.t.Cleanup(c.Disconnect)
+	return &Client{Client: c, Config: cfg}, nil
+}
+
+// ClientConfig returns a config for a new proxy-mode client of the server,
+// with a fresh key pair.
+func (h *Harness) ClientConfig() (*config.ClientConfig, error) {
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(h.API.Listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	apiPort, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config.ClientConfig{
+		Server:          host,
+		APIPort:         apiPort,
+		ServerPublicKey: h.Config.PublicKey,
+		PrivateKey:      crypto.KeyToBase64(kp.PrivateKey),
+		APIKey:          h.Config.APIKey,
+		LogLevel:        "silent",
+		Mode:            config.ModeProxy,
+		ProxyListen:     "127.0.0.1:0",
+	}
+	config.ApplyClientDefaults(cfg)
+	return cfg, nil
+}
+
+// HTTPClient returns an HTTP client that connects through the client's
+// SOCKS5 proxy, and so through its tunnel.
+func (c *Client) HTTPClient() *http.Client {
+	proxyURL := &url.URL{Scheme: "socks5", Host: c.ProxyAddr().String()}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		Timeout:   10 * time.Second,
+	}
+}
+
+// Serve runs handler on the server's tunnel address at port until the test
+// ends, and returns its URL.
+func (h *Harness) Serve(port int, handler http.Handler) string {
+	h.t.Helper()
+
+	addr := netip.MustParsePrefix(h.Config.Address).Addr()
+	ln, err := h.ServerNet().ListenTCP(net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))))
+	if err != nil {
+		h.t.Fatalf("failed to listen on the server's tunnel address: %v", err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	h.t.Cleanup(func() { srv.Close() })
+	return fmt.Sprintf("http://%s", net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+}
@@ -0,0 +1,13 @@
+//go:build darwin
+
+package network
+
+import "fmt"
+
+func (c *DarwinConfigurator) SetDNS(ifaceName string, servers []string) error {
+	return fmt.Errorf("DNS configuration on macOS is not supported yet")
+}
+
+func (c *DarwinConfigurator) RestoreDNS(ifaceName string) error {
+	return nil
+}
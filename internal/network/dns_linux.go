@@ -0,0 +1,120 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dnsMode records how DNS was configured so it can be undone the same way.
+type dnsMode int
+
+const (
+	dnsModeNone dnsMode = iota
+	dnsModeResolved
+	dnsModeResolvConf
+)
+
+const (
+	resolvConfPath       = "/etc/resolv.conf"
+	resolvConfBackupPath = "/etc/resolv.conf.shikvpn"
+)
+
+func (c *LinuxConfigurator) SetDNS(ifaceName string, servers []string) error {
+	if err := ValidateInterfaceName(ifaceName); err != nil {
+		return err
+	}
+	for _, s := range servers {
+		if err := ValidateIP(s); err != nil {
+			return err
+		}
+	}
+
+	if usesResolved() {
+		args := append([]string{"dns", ifaceName}, servers...)
+		if err := runCmd("resolvectl", args...); err != nil {
+			return err
+		}
+		// "~." makes the tunnel link handle lookups for every domain
+		if err := runCmd("resolvectl", "domain", ifaceName, "~."); err != nil {
+			_ = runCmd("resolvectl", "revert", ifaceName)
+			return err
+		}
+		c.dnsMode = dnsModeResolved
+		return nil
+	}
+
+	// Prefer a backup left by a previous run that did not restore cleanly,
+	// since the live file may still hold our generated contents.
+	orig, err := os.ReadFile(resolvConfBackupPath)
+	if err != nil {
+		orig, err = os.ReadFile(resolvConfPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %w", resolvConfPath, err)
+		}
+		if err := os.WriteFile(resolvConfBackupPath, orig, 0644); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", resolvConfPath, err)
+		}
+	}
+
+	if err := os.WriteFile(resolvConfPath, []byte(buildResolvConf(orig, servers)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", resolvConfPath, err)
+	}
+	c.savedResolv = orig
+	c.dnsMode = dnsModeResolvConf
+	return nil
+}
+
+func (c *LinuxConfigurator) RestoreDNS(ifaceName string) error {
+	mode := c.dnsMode
+	c.dnsMode = dnsModeNone
+
+	switch mode {
+	case dnsModeResolved:
+		if err := ValidateInterfaceName(ifaceName); err != nil {
+			return err
+		}
+		return runCmd("resolvectl", "revert", ifaceName)
+	case dnsModeResolvConf:
+		if err := os.WriteFile(resolvConfPath, c.savedResolv, 0644); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", resolvConfPath, err)
+		}
+		c.savedResolv = nil
+		return os.Remove(resolvConfBackupPath)
+	}
+	return nil
+}
+
+// usesResolved reports whether name resolution is managed by systemd-resolved,
+// i.e. /etc/resolv.conf points into /run/systemd/resolve and resolvectl exists.
+func usesResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(resolvConfPath)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(target, "/run/systemd/resolve/")
+}
+
+// buildResolvConf returns resolv.conf contents using servers as nameservers,
+// keeping search and options lines from the original file.
+func buildResolvConf(orig []byte, servers []string) string {
+	var b strings.Builder
+	b.WriteString("# Generated by ShikVPN; original saved to " + resolvConfBackupPath + "\n")
+	for _, s := range servers {
+		b.WriteString("nameserver " + s + "\n")
+	}
+	for _, line := range strings.Split(string(orig), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain" || fields[0] == "options") {
+			b.WriteString(strings.TrimSpace(line) + "\n")
+		}
+	}
+	return b.String()
+}
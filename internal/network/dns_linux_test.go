@@ -0,0 +1,26 @@
+//go:build linux
+
+package network
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildResolvConf(t *testing.T) {
+	orig := "# managed by dhcp\nnameserver 192.168.1.1\nsearch corp.example\noptions edns0\n"
+
+	got := buildResolvConf([]byte(orig), []string{"10.0.0.1", "1.1.1.1"})
+
+	if strings.Contains(got, "192.168.1.1") {
+		t.Error("original nameserver should be replaced")
+	}
+	for _, want := range []string{"nameserver 10.0.0.1\n", "nameserver 1.1.1.1\n", "search corp.example\n", "options edns0\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("resolv.conf missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, "nameserver 10.0.0.1") > strings.Index(got, "nameserver 1.1.1.1") {
+		t.Error("nameserver order not preserved")
+	}
+}
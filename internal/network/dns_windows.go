@@ -0,0 +1,33 @@
+//go:build windows
+
+package network
+
+import "fmt"
+
+func (c *WindowsConfigurator) SetDNS(ifaceName string, servers []string) error {
+	if err := ValidateInterfaceName(ifaceName); err != nil {
+		return err
+	}
+	for i, s := range servers {
+		if err := ValidateIP(s); err != nil {
+			return err
+		}
+		if i == 0 {
+			if err := runCmd("netsh", "interface", "ipv4", "set", "dnsservers",
+				fmt.Sprintf("name=%s", ifaceName), "source=static", fmt.Sprintf("address=%s", s), "register=none", "validate=no"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := runCmd("netsh", "interface", "ipv4", "add", "dnsservers",
+			fmt.Sprintf("name=%s", ifaceName), fmt.Sprintf("address=%s", s), fmt.Sprintf("index=%d", i+1), "validate=no"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WindowsConfigurator) RestoreDNS(ifaceName string) error {
+	// DNS settings live on the tunnel adapter and disappear with it
+	return nil
+}
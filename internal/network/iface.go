@@ -1,5 +1,13 @@
 package network
 
+// PolicyRouter is implemented by configurators whose SetDefaultRoute uses
+// policy routing instead of replacing the system default route. The
+// WireGuard device must mark its own packets with FwMark, or they would be
+// routed back into the tunnel.
+type PolicyRouter interface {
+	FwMark() uint32
+}
+
 // InterfaceConfigurator provides platform-specific network interface configuration.
 type InterfaceConfigurator interface {
 	// AssignAddress assigns an IP address to a network interface.
@@ -21,12 +29,24 @@ type InterfaceConfigurator interface {
 	// RemoveDefaultRoute restores the original default route.
 	RemoveDefaultRoute(ifaceName string) error
 
+	// SetDNS points system name resolution at the given servers for the
+	// lifetime of the tunnel. It saves the current settings for restoration.
+	SetDNS(ifaceName string, servers []string) error
+
+	// RestoreDNS restores the DNS settings saved by SetDNS.
+	RestoreDNS(ifaceName string) error
+
 	// EnableIPForwarding enables IP forwarding on the system (server-side).
 	EnableIPForwarding() error
 
+	// EnableIPv6Forwarding enables IPv6 forwarding on the system (server-side, dual-stack).
+	EnableIPv6Forwarding() error
+
 	// ConfigureNAT sets up NAT/masquerade for VPN traffic (server-side).
-	ConfigureNAT(ifaceName string, vpnSubnet string) error
+	// vpnSubnet may be an IPv4 or IPv6 CIDR. Traffic is masqueraded when it
+	// leaves through wanInterface, or the default route's interface if empty.
+	ConfigureNAT(ifaceName, vpnSubnet, wanInterface string) error
 
 	// RemoveNAT removes NAT rules (cleanup).
-	RemoveNAT(ifaceName string, vpnSubnet string) error
+	RemoveNAT(ifaceName, vpnSubnet, wanInterface string) error
 }
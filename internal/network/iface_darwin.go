@@ -26,6 +26,11 @@ func (c *DarwinConfigurator) AssignAddress(ifaceName string, address string) err
 	if err := ValidateCIDR(address); err != nil {
 		return err
 	}
+	if isIPv6CIDR(address) {
+		ip, ipNet, _ := net.ParseCIDR(address)
+		ones, _ := ipNet.Mask.Size()
+		return runCmd("ifconfig", ifaceName, "inet6", ip.String(), "prefixlen", fmt.Sprintf("%d", ones), "alias")
+	}
 	// macOS ifconfig wants "addr netmask mask" format
 	ip, mask := splitCIDR(address)
 	return runCmd("ifconfig", ifaceName, "inet", ip, ip, "netmask", mask)
@@ -40,6 +45,12 @@ func (c *DarwinConfigurator) SetMTU(ifaceName string, mtu int) error {
 }
 
 func (c *DarwinConfigurator) AddRoute(destination string, gateway string, ifaceName string) error {
+	if isIPv6CIDR(destination) {
+		if gateway != "" {
+			return runCmd("route", "add", "-inet6", "-net", destination, gateway)
+		}
+		return runCmd("route", "add", "-inet6", "-net", destination, "-interface", ifaceName)
+	}
 	if gateway != "" {
 		return runCmd("route", "add", "-net", destination, gateway)
 	}
@@ -84,13 +95,17 @@ func (c *DarwinConfigurator) EnableIPForwarding() error {
 	return runCmd("sysctl", "-w", "net.inet.ip.forwarding=1")
 }
 
-func (c *DarwinConfigurator) ConfigureNAT(ifaceName string, vpnSubnet string) error {
+func (c *DarwinConfigurator) EnableIPv6Forwarding() error {
+	return runCmd("sysctl", "-w", "net.inet6.ip6.forwarding=1")
+}
+
+func (c *DarwinConfigurator) ConfigureNAT(ifaceName, vpnSubnet, wanInterface string) error {
 	// macOS uses pfctl for NAT — write a minimal pf.conf snippet
 	// For MVP, we rely on the user having PF configured or skip NAT on macOS
 	return fmt.Errorf("NAT configuration on macOS requires manual pfctl setup")
 }
 
-func (c *DarwinConfigurator) RemoveNAT(ifaceName string, vpnSubnet string) error {
+func (c *DarwinConfigurator) RemoveNAT(ifaceName, vpnSubnet, wanInterface string) error {
 	return nil
 }
 
@@ -4,14 +4,23 @@ package network
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// LinuxConfigurator implements InterfaceConfigurator for Linux.
+// LinuxConfigurator implements InterfaceConfigurator for Linux. Links,
+// addresses, routes and routing rules are managed over rtnetlink; forwarding
+// and NAT use sysctl, and iptables or nftables.
 type LinuxConfigurator struct {
-	savedGateway   string
-	savedInterface string
+	bypassRoute *netlink.Route // keeps traffic to the server off the tunnel
+	dnsMode     dnsMode
+	savedResolv []byte
 }
 
 func NewConfigurator() InterfaceConfigurator {
@@ -25,91 +34,344 @@ func (c *LinuxConfigurator) AssignAddress(ifaceName string, address string) erro
 	if err := ValidateCIDR(address); err != nil {
 		return err
 	}
-	return runCmd("ip", "addr", "add", address, "dev", ifaceName)
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", address, ifaceName, err)
+	}
+	return nil
 }
 
 func (c *LinuxConfigurator) SetInterfaceUp(ifaceName string) error {
 	if err := ValidateInterfaceName(ifaceName); err != nil {
 		return err
 	}
-	return runCmd("ip", "link", "set", ifaceName, "up")
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %s up: %w", ifaceName, err)
+	}
+	return nil
 }
 
 func (c *LinuxConfigurator) SetMTU(ifaceName string, mtu int) error {
-	return runCmd("ip", "link", "set", ifaceName, "mtu", fmt.Sprintf("%d", mtu))
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of %s to %d: %w", ifaceName, mtu, err)
+	}
+	return nil
 }
 
 func (c *LinuxConfigurator) AddRoute(destination string, gateway string, ifaceName string) error {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid route destination %q: %w", destination, err)
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst}
 	if gateway != "" {
-		return runCmd("ip", "route", "add", destination, "via", gateway, "dev", ifaceName)
+		if route.Gw = net.ParseIP(gateway); route.Gw == nil {
+			return fmt.Errorf("invalid gateway %q", gateway)
+		}
+	} else {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		return fmt.Errorf("failed to add route %s via %s: %w", destination, ifaceName, err)
 	}
-	return runCmd("ip", "route", "add", destination, "dev", ifaceName)
+	return nil
 }
 
+// SetDefaultRoute sends all IPv4 traffic through the tunnel the way wg-quick
+// does: the default route goes into a routing table of its own, selected by
+// a rule for every packet without the tunnel's firewall mark, while the
+// WireGuard device marks its own packets so they still leave by the main
+// table. The system default route is never touched, so nothing needs to be
+// restored if the client dies; once the tunnel device is gone its table is
+// empty and lookups fall through to the main table again.
 func (c *LinuxConfigurator) SetDefaultRoute(ifaceName string, gateway string, serverEndpoint string) error {
-	// Save current default route
-	out, err := exec.Command("ip", "route", "show", "default").Output()
-	if err == nil {
-		parts := strings.Fields(string(out))
-		if len(parts) >= 5 {
-			c.savedGateway = parts[2]
-			c.savedInterface = parts[4]
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+
+	// The registration API usually lives on the server too; a host route
+	// keeps it reachable outside the tunnel so reconnects work
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %w", err)
+	}
+	if def := physicalDefaultRoute(routes, link.Attrs().Index); def != nil && serverEndpoint != "" {
+		if err := c.replaceBypassRoute(serverEndpoint, def); err != nil {
+			return err
 		}
 	}
 
-	// Add route to server endpoint via original gateway
-	if c.savedGateway != "" && serverEndpoint != "" {
-		host := strings.Split(serverEndpoint, ":")[0]
-		_ = runCmd("ip", "route", "add", host+"/32", "via", c.savedGateway, "dev", c.savedInterface)
+	if err := netlink.RouteReplace(tunnelDefaultRoute(link.Attrs().Index)); err != nil {
+		c.RemoveDefaultRoute(ifaceName)
+		return fmt.Errorf("failed to add default route via %s: %w", ifaceName, err)
+	}
+	// Rules left behind by a client that crashed would otherwise pile up
+	for _, rule := range policyRules() {
+		for netlink.RuleDel(rule) == nil {
+		}
+		if err := netlink.RuleAdd(rule); err != nil {
+			c.RemoveDefaultRoute(ifaceName)
+			return fmt.Errorf("failed to add routing rule %s: %w", rule, err)
+		}
 	}
 
-	// Replace default route to go through VPN
-	_ = runCmd("ip", "route", "del", "default")
-	return runCmd("ip", "route", "add", "default", "dev", ifaceName)
+	// Let replies to marked packets pass reverse path filtering
+	if err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0644); err != nil {
+		log.Printf("Warning: failed to enable src_valid_mark: %v", err)
+	}
+	return nil
 }
 
 func (c *LinuxConfigurator) RemoveDefaultRoute(ifaceName string) error {
-	_ = runCmd("ip", "route", "del", "default", "dev", ifaceName)
+	for _, rule := range policyRules() {
+		for netlink.RuleDel(rule) == nil {
+		}
+	}
+	if link, err := netlink.LinkByName(ifaceName); err == nil {
+		_ = netlink.RouteDel(tunnelDefaultRoute(link.Attrs().Index))
+	}
+	if c.bypassRoute != nil {
+		_ = netlink.RouteDel(c.bypassRoute)
+		c.bypassRoute = nil
+	}
+	return nil
+}
+
+// FwMark returns the firewall mark the WireGuard device must put on its own
+// packets so that they bypass the tunnel's routing table.
+func (c *LinuxConfigurator) FwMark() uint32 {
+	return policyTable
+}
 
-	if c.savedGateway != "" {
-		return runCmd("ip", "route", "add", "default", "via", c.savedGateway, "dev", c.savedInterface)
+func (c *LinuxConfigurator) UpdateBypassRoute(ifaceName string, serverEndpoint string) (bool, error) {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return false, fmt.Errorf("failed to find interface %s: %w", ifaceName, err)
+	}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %w", err)
+	}
+	def := physicalDefaultRoute(routes, link.Attrs().Index)
+	if def == nil {
+		return false, nil
+	}
+
+	host, err := endpointIPv4(serverEndpoint)
+	if err != nil {
+		return false, err
 	}
+	if b := c.bypassRoute; b != nil && b.Dst.IP.Equal(host) && b.Gw.Equal(def.Gw) && b.LinkIndex == def.LinkIndex {
+		return false, nil
+	}
+
+	if err := c.replaceBypassRoute(serverEndpoint, def); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// replaceBypassRoute routes the server endpoint via the gateway of def,
+// removing the previous bypass route.
+func (c *LinuxConfigurator) replaceBypassRoute(serverEndpoint string, def *netlink.Route) error {
+	host, err := endpointIPv4(serverEndpoint)
+	if err != nil {
+		return err
+	}
+	if c.bypassRoute != nil {
+		_ = netlink.RouteDel(c.bypassRoute)
+		c.bypassRoute = nil
+	}
+	route := &netlink.Route{
+		LinkIndex: def.LinkIndex,
+		Dst:       &net.IPNet{IP: host, Mask: net.CIDRMask(32, 32)},
+		Gw:        def.Gw,
+	}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to route server %s around the tunnel: %w", host, err)
+	}
+	c.bypassRoute = route
 	return nil
 }
 
+// endpointIPv4 returns the IPv4 address of a host:port endpoint.
+func endpointIPv4(serverEndpoint string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(serverEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server endpoint %q: %w", serverEndpoint, err)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("server endpoint %q is not an IPv4 address", serverEndpoint)
+	}
+	return ip, nil
+}
+
+// policyTable is both the routing table holding the tunnel's default route
+// and the firewall mark that exempts WireGuard's own packets from it, as in
+// wg-quick.
+const policyTable = 51820
+
+// tunnelDefaultRoute is the IPv4 default route through the tunnel link, in
+// the tunnel's routing table.
+func tunnelDefaultRoute(linkIndex int) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Scope:     netlink.SCOPE_LINK,
+		Table:     policyTable,
+	}
+}
+
+// policyRules returns the rules that steer traffic into the tunnel table:
+// everything not marked by WireGuard uses the tunnel table, except that more
+// specific routes in the main table, such as the local subnet, still win.
+func policyRules() []*netlink.Rule {
+	tunnel := netlink.NewRule()
+	tunnel.Family = netlink.FAMILY_V4
+	tunnel.Table = policyTable
+	tunnel.Mark = policyTable
+	tunnel.Invert = true
+
+	main := netlink.NewRule()
+	main.Family = netlink.FAMILY_V4
+	main.Table = unix.RT_TABLE_MAIN
+	main.SuppressPrefixlen = 0
+
+	// Rules added later take precedence, so main's exception goes in last
+	return []*netlink.Rule{tunnel, main}
+}
+
+// isDefaultRoute reports whether a route covers the whole address space.
+func isDefaultRoute(r netlink.Route) bool {
+	if r.Dst == nil {
+		return true
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones == 0
+}
+
+// physicalDefaultRoute returns the preferred default route in the main table
+// that does not use the link excludeIndex, or nil if there is none. When
+// several exist, the one with the lowest metric wins, as it does in the kernel.
+func physicalDefaultRoute(routes []netlink.Route, excludeIndex int) *netlink.Route {
+	var best *netlink.Route
+	for i := range routes {
+		r := routes[i]
+		if !isDefaultRoute(r) || r.LinkIndex == excludeIndex || r.LinkIndex == 0 {
+			continue
+		}
+		if r.Table != 0 && r.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = &r
+		}
+	}
+	return best
+}
+
+// outboundInterface returns the name of the interface holding the default
+// route for an address family, falling back to eth0.
+func outboundInterface(family int) (string, error) {
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return "", fmt.Errorf("failed to find default route: %w", err)
+	}
+	def := physicalDefaultRoute(routes, -1)
+	if def == nil {
+		return "eth0", nil
+	}
+	link, err := netlink.LinkByIndex(def.LinkIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to find default route interface: %w", err)
+	}
+	return link.Attrs().Name, nil
+}
+
 func (c *LinuxConfigurator) EnableIPForwarding() error {
 	return runCmd("sysctl", "-w", "net.ipv4.ip_forward=1")
 }
 
-func (c *LinuxConfigurator) ConfigureNAT(ifaceName string, vpnSubnet string) error {
+func (c *LinuxConfigurator) EnableIPv6Forwarding() error {
+	return runCmd("sysctl", "-w", "net.ipv6.conf.all.forwarding=1")
+}
+
+func (c *LinuxConfigurator) ConfigureNAT(ifaceName, vpnSubnet, wanInterface string) error {
 	if err := ValidateCIDR(vpnSubnet); err != nil {
 		return err
 	}
-	// Find the default outbound interface
-	out, err := exec.Command("ip", "route", "show", "default").Output()
+	ipCmd, family := natTools(vpnSubnet)
+
+	outIface, err := natInterface(wanInterface, family)
 	if err != nil {
-		return fmt.Errorf("failed to find default route: %w", err)
+		return err
 	}
-	parts := strings.Fields(string(out))
-	outIface := "eth0"
-	if len(parts) >= 5 {
-		outIface = parts[4]
+
+	// A rule left behind by a crash would otherwise be duplicated
+	rule := []string{"POSTROUTING", "-s", vpnSubnet, "-o", outIface, "-j", "MASQUERADE"}
+	if runCmd(ipCmd, append([]string{"-t", "nat", "-C"}, rule...)...) == nil {
+		return nil
 	}
+	return runCmd(ipCmd, append([]string{"-t", "nat", "-A"}, rule...)...)
+}
 
-	return runCmd("iptables", "-t", "nat", "-A", "POSTROUTING",
+func (c *LinuxConfigurator) RemoveNAT(ifaceName, vpnSubnet, wanInterface string) error {
+	if err := ValidateCIDR(vpnSubnet); err != nil {
+		return err
+	}
+	ipCmd, family := natTools(vpnSubnet)
+
+	outIface, err := natInterface(wanInterface, family)
+	if err != nil {
+		outIface = "eth0"
+	}
+
+	return runCmd(ipCmd, "-t", "nat", "-D", "POSTROUTING",
 		"-s", vpnSubnet, "-o", outIface, "-j", "MASQUERADE")
 }
 
-func (c *LinuxConfigurator) RemoveNAT(ifaceName string, vpnSubnet string) error {
-	out, _ := exec.Command("ip", "route", "show", "default").Output()
-	parts := strings.Fields(string(out))
-	outIface := "eth0"
-	if len(parts) >= 5 {
-		outIface = parts[4]
+// natInterface returns wanInterface if it is set, and otherwise the
+// interface holding the default route for family.
+func natInterface(wanInterface string, family int) (string, error) {
+	if wanInterface != "" {
+		if err := ValidateInterfaceName(wanInterface); err != nil {
+			return "", err
+		}
+		return wanInterface, nil
 	}
+	return outboundInterface(family)
+}
 
-	return runCmd("iptables", "-t", "nat", "-D", "POSTROUTING",
-		"-s", vpnSubnet, "-o", outIface, "-j", "MASQUERADE")
+// natTools returns the iptables binary and netlink address family for a subnet.
+func natTools(vpnSubnet string) (string, int) {
+	if isIPv6CIDR(vpnSubnet) {
+		return "ip6tables", netlink.FAMILY_V6
+	}
+	return "iptables", netlink.FAMILY_V4
 }
 
 func runCmd(name string, args ...string) error {
@@ -0,0 +1,303 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestPhysicalDefaultRoute(t *testing.T) {
+	wifi := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("192.168.1.1"), Priority: 600, Protocol: unix.RTPROT_DHCP}
+	ethernet := netlink.Route{LinkIndex: 3, Gw: net.ParseIP("10.1.0.1"), Priority: 100, Protocol: unix.RTPROT_DHCP}
+	tunnel := netlink.Route{LinkIndex: 9, Dst: mustCIDR("0.0.0.0/0"), Scope: netlink.SCOPE_LINK}
+	subnet := netlink.Route{LinkIndex: 3, Dst: mustCIDR("10.1.0.0/24"), Scope: netlink.SCOPE_LINK}
+	otherTable := netlink.Route{LinkIndex: 4, Gw: net.ParseIP("172.16.0.1"), Table: 200}
+
+	tests := []struct {
+		name   string
+		routes []netlink.Route
+		want   *netlink.Route
+	}{
+		{name: "single route", routes: []netlink.Route{subnet, wifi}, want: &wifi},
+		{name: "lowest metric wins", routes: []netlink.Route{wifi, ethernet}, want: &ethernet},
+		{name: "skips the tunnel", routes: []netlink.Route{tunnel, wifi}, want: &wifi},
+		{name: "only the tunnel", routes: []netlink.Route{tunnel, subnet}},
+		{name: "ignores other tables", routes: []netlink.Route{otherTable}},
+		{name: "no routes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := physicalDefaultRoute(tt.routes, 9)
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("physicalDefaultRoute() = %v, want nil", got)
+			case tt.want != nil && (got == nil || got.LinkIndex != tt.want.LinkIndex || !got.Gw.Equal(tt.want.Gw)):
+				t.Errorf("physicalDefaultRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// withNetNS runs fn in a fresh network namespace, so the configurator can
+// change links and routes without touching the host. It needs root.
+func withNetNS(t *testing.T, fn func()) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace requires root")
+	}
+
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("netns.Get() error: %v", err)
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer func() {
+		// A thread left in the test namespace must not be reused
+		if err := netns.Set(orig); err == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	fn()
+}
+
+// addTestLink creates an up veth pair and returns the named end.
+func addTestLink(t *testing.T, name string, address string) netlink.Link {
+	t.Helper()
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("cannot create veth links: %v", err)
+	}
+	for _, n := range []string{name, name + "p"} {
+		l, err := netlink.LinkByName(n)
+		if err != nil {
+			t.Fatalf("LinkByName(%s) error: %v", n, err)
+		}
+		if err := netlink.LinkSetUp(l); err != nil {
+			t.Fatalf("LinkSetUp(%s) error: %v", n, err)
+		}
+	}
+	link, _ := netlink.LinkByName(name)
+	if address != "" {
+		addr, _ := netlink.ParseAddr(address)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Fatalf("AddrAdd(%s) error: %v", address, err)
+		}
+	}
+	return link
+}
+
+// defaultRoutes returns the IPv4 default routes in the main table.
+func defaultRoutes(t *testing.T) []netlink.Route {
+	t.Helper()
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("RouteList() error: %v", err)
+	}
+	var defaults []netlink.Route
+	for _, r := range routes {
+		if isDefaultRoute(r) {
+			defaults = append(defaults, r)
+		}
+	}
+	return defaults
+}
+
+// hostRoute returns the main table route to ip/32, if any.
+func hostRoute(t *testing.T, ip string) *netlink.Route {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: mustCIDR(ip + "/32")}, netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatalf("RouteListFiltered() error: %v", err)
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+	return &routes[0]
+}
+
+func TestLinuxConfiguratorInterface(t *testing.T) {
+	withNetNS(t, func() {
+		addTestLink(t, "tun0", "")
+		c := &LinuxConfigurator{}
+
+		if err := c.AssignAddress("tun0", "10.0.0.2/24"); err != nil {
+			t.Fatalf("AssignAddress() error: %v", err)
+		}
+		if err := c.SetInterfaceUp("tun0"); err != nil {
+			t.Fatalf("SetInterfaceUp() error: %v", err)
+		}
+		if err := c.SetMTU("tun0", 1380); err != nil {
+			t.Fatalf("SetMTU() error: %v", err)
+		}
+		if err := c.AddRoute("10.20.0.0/16", "", "tun0"); err != nil {
+			t.Fatalf("AddRoute() error: %v", err)
+		}
+
+		link, _ := netlink.LinkByName("tun0")
+		if link.Attrs().MTU != 1380 {
+			t.Errorf("MTU = %d, want 1380", link.Attrs().MTU)
+		}
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "10.0.0.2/24" {
+			t.Errorf("addresses = %v, want [10.0.0.2/24]", addrs)
+		}
+		routes, _ := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: mustCIDR("10.20.0.0/16")}, netlink.RT_FILTER_DST)
+		if len(routes) != 1 || routes[0].LinkIndex != link.Attrs().Index {
+			t.Errorf("routes to 10.20.0.0/16 = %v, want one via tun0", routes)
+		}
+	})
+}
+
+// routeVia returns the link index the kernel would send a packet to dst
+// with the given firewall mark through.
+func routeVia(t *testing.T, dst string, mark uint32) int {
+	t.Helper()
+	routes, err := netlink.RouteGetWithOptions(net.ParseIP(dst), &netlink.RouteGetOptions{Mark: mark})
+	if err != nil {
+		t.Fatalf("RouteGet(%s, mark %d) error: %v", dst, mark, err)
+	}
+	return routes[0].LinkIndex
+}
+
+func TestLinuxConfiguratorDefaultRoute(t *testing.T) {
+	withNetNS(t, func() {
+		wifi := addTestLink(t, "wlan0", "192.168.1.10/24")
+		tun := addTestLink(t, "tun0", "10.0.0.2/24")
+		orig := &netlink.Route{LinkIndex: wifi.Attrs().Index, Gw: net.ParseIP("192.168.1.1"), Priority: 600}
+		if err := netlink.RouteAdd(orig); err != nil {
+			t.Fatalf("RouteAdd(default) error: %v", err)
+		}
+		c := &LinuxConfigurator{}
+
+		if err := c.SetDefaultRoute("tun0", "10.0.0.1", "203.0.113.7:51820"); err != nil {
+			t.Fatalf("SetDefaultRoute() error: %v", err)
+		}
+		// The main table keeps its default route
+		defaults := defaultRoutes(t)
+		if len(defaults) != 1 || defaults[0].LinkIndex != wifi.Attrs().Index {
+			t.Fatalf("main default routes = %v, want the original via wlan0", defaults)
+		}
+		if got := routeVia(t, "198.51.100.1", 0); got != tun.Attrs().Index {
+			t.Errorf("unmarked traffic leaves via link %d, want the tunnel %d", got, tun.Attrs().Index)
+		}
+		if got := routeVia(t, "198.51.100.1", c.FwMark()); got != wifi.Attrs().Index {
+			t.Errorf("WireGuard traffic leaves via link %d, want wlan0 %d", got, wifi.Attrs().Index)
+		}
+		if got := routeVia(t, "192.168.1.20", 0); got != wifi.Attrs().Index {
+			t.Errorf("local subnet traffic leaves via link %d, want wlan0 %d", got, wifi.Attrs().Index)
+		}
+		if got := routeVia(t, "203.0.113.7", 0); got != wifi.Attrs().Index {
+			t.Errorf("traffic to the server leaves via link %d, want wlan0 %d", got, wifi.Attrs().Index)
+		}
+
+		// Setting up again, e.g. after a crash, must not duplicate the rules
+		if err := c.SetDefaultRoute("tun0", "10.0.0.1", "203.0.113.7:51820"); err != nil {
+			t.Fatalf("SetDefaultRoute() again error: %v", err)
+		}
+		rules, _ := netlink.RuleListFiltered(netlink.FAMILY_V4, &netlink.Rule{Table: policyTable}, netlink.RT_FILTER_TABLE)
+		if len(rules) != 1 {
+			t.Errorf("found %d rules for the tunnel table, want 1", len(rules))
+		}
+
+		if err := c.RemoveDefaultRoute("tun0"); err != nil {
+			t.Fatalf("RemoveDefaultRoute() error: %v", err)
+		}
+		if got := routeVia(t, "198.51.100.1", 0); got != wifi.Attrs().Index {
+			t.Errorf("after removal traffic leaves via link %d, want wlan0 %d", got, wifi.Attrs().Index)
+		}
+		if r := hostRoute(t, "203.0.113.7"); r != nil {
+			t.Errorf("route to server %v left behind", r)
+		}
+	})
+}
+
+func TestLinuxConfiguratorSurvivesTunnelCrash(t *testing.T) {
+	withNetNS(t, func() {
+		wifi := addTestLink(t, "wlan0", "192.168.1.10/24")
+		addTestLink(t, "tun0", "10.0.0.2/24")
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: wifi.Attrs().Index, Gw: net.ParseIP("192.168.1.1")}); err != nil {
+			t.Fatalf("RouteAdd(default) error: %v", err)
+		}
+		c := &LinuxConfigurator{}
+		if err := c.SetDefaultRoute("tun0", "10.0.0.1", "203.0.113.7:51820"); err != nil {
+			t.Fatalf("SetDefaultRoute() error: %v", err)
+		}
+
+		// The client dies without cleaning up; its tunnel device goes away
+		tun, _ := netlink.LinkByName("tun0")
+		if err := netlink.LinkDel(tun); err != nil {
+			t.Fatalf("LinkDel() error: %v", err)
+		}
+		if got := routeVia(t, "198.51.100.1", 0); got != wifi.Attrs().Index {
+			t.Errorf("traffic leaves via link %d, want wlan0 %d", got, wifi.Attrs().Index)
+		}
+	})
+}
+
+func TestLinuxConfiguratorUpdateBypassRoute(t *testing.T) {
+	withNetNS(t, func() {
+		wifi := addTestLink(t, "wlan0", "192.168.1.10/24")
+		addTestLink(t, "tun0", "10.0.0.2/24")
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: wifi.Attrs().Index, Gw: net.ParseIP("192.168.1.1"), Priority: 600}); err != nil {
+			t.Fatalf("RouteAdd(default) error: %v", err)
+		}
+		c := &LinuxConfigurator{}
+		if err := c.SetDefaultRoute("tun0", "10.0.0.1", "203.0.113.7:51820"); err != nil {
+			t.Fatalf("SetDefaultRoute() error: %v", err)
+		}
+
+		// Nothing changed yet
+		if moved, err := c.UpdateBypassRoute("tun0", "203.0.113.7:51820"); err != nil || moved {
+			t.Fatalf("UpdateBypassRoute() = %v, %v, want false, nil", moved, err)
+		}
+
+		// Plug in Ethernet; its DHCP client adds a default route
+		eth := addTestLink(t, "eth0", "10.1.0.10/24")
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: eth.Attrs().Index, Gw: net.ParseIP("10.1.0.1"), Priority: 100}); err != nil {
+			t.Fatalf("RouteAdd(default) error: %v", err)
+		}
+		moved, err := c.UpdateBypassRoute("tun0", "203.0.113.7:51820")
+		if err != nil || !moved {
+			t.Fatalf("UpdateBypassRoute() = %v, %v, want true, nil", moved, err)
+		}
+		bypass := hostRoute(t, "203.0.113.7")
+		if bypass == nil || bypass.LinkIndex != eth.Attrs().Index || !bypass.Gw.Equal(net.ParseIP("10.1.0.1")) {
+			t.Fatalf("route to server = %v, want via 10.1.0.1 on eth0", bypass)
+		}
+
+		// The server moved as well
+		if _, err := c.UpdateBypassRoute("tun0", "203.0.113.9:51820"); err != nil {
+			t.Fatalf("UpdateBypassRoute() error: %v", err)
+		}
+		if r := hostRoute(t, "203.0.113.7"); r != nil {
+			t.Errorf("stale route to old server address %v left behind", r)
+		}
+		if r := hostRoute(t, "203.0.113.9"); r == nil {
+			t.Error("no route to the new server address")
+		}
+	})
+}
@@ -27,6 +27,10 @@ func (c *WindowsConfigurator) AssignAddress(ifaceName string, address string) er
 	if err := ValidateCIDR(address); err != nil {
 		return err
 	}
+	if isIPv6CIDR(address) {
+		return runCmd("netsh", "interface", "ipv6", "add", "address",
+			fmt.Sprintf("interface=%s", ifaceName), fmt.Sprintf("address=%s", address), "store=active")
+	}
 	ip, mask := splitCIDR(address)
 	return runCmd("netsh", "interface", "ip", "set", "address",
 		fmt.Sprintf("name=%s", ifaceName), "static", ip, mask)
@@ -43,6 +47,18 @@ func (c *WindowsConfigurator) SetMTU(ifaceName string, mtu int) error {
 }
 
 func (c *WindowsConfigurator) AddRoute(destination string, gateway string, ifaceName string) error {
+	if isIPv6CIDR(destination) {
+		idx, err := getInterfaceIndex(ifaceName)
+		if err != nil {
+			return fmt.Errorf("failed to get interface index for %s: %w", ifaceName, err)
+		}
+		args := []string{"interface", "ipv6", "add", "route", fmt.Sprintf("prefix=%s", destination),
+			fmt.Sprintf("interface=%s", idx), "store=active"}
+		if gateway != "" {
+			args = append(args, fmt.Sprintf("nexthop=%s", gateway))
+		}
+		return runCmd("netsh", args...)
+	}
 	dest, mask := splitCIDR(destination)
 	if gateway != "" {
 		return runCmd("route", "add", dest, "mask", mask, gateway)
@@ -98,17 +114,28 @@ func (c *WindowsConfigurator) EnableIPForwarding() error {
 		"Set-NetIPInterface -Forwarding Enabled -AddressFamily IPv4")
 }
 
-func (c *WindowsConfigurator) ConfigureNAT(ifaceName string, vpnSubnet string) error {
+func (c *WindowsConfigurator) EnableIPv6Forwarding() error {
+	return runCmd("powershell", "-Command",
+		"Set-NetIPInterface -Forwarding Enabled -AddressFamily IPv6")
+}
+
+func (c *WindowsConfigurator) ConfigureNAT(ifaceName, vpnSubnet, wanInterface string) error {
 	// Validate vpnSubnet is a proper CIDR before passing to PowerShell
 	if _, _, err := net.ParseCIDR(vpnSubnet); err != nil {
 		return fmt.Errorf("invalid VPN subnet CIDR %q: %w", vpnSubnet, err)
 	}
+	if isIPv6CIDR(vpnSubnet) {
+		return fmt.Errorf("IPv6 NAT is not supported on Windows")
+	}
 	// Windows uses Internet Connection Sharing or netsh routing
 	return runCmd("powershell", "-Command",
 		fmt.Sprintf("New-NetNat -Name 'ShikVPN' -InternalIPInterfaceAddressPrefix '%s'", vpnSubnet))
 }
 
-func (c *WindowsConfigurator) RemoveNAT(ifaceName string, vpnSubnet string) error {
+func (c *WindowsConfigurator) RemoveNAT(ifaceName, vpnSubnet, wanInterface string) error {
+	if isIPv6CIDR(vpnSubnet) {
+		return nil
+	}
 	return runCmd("powershell", "-Command", "Remove-NetNat -Name ShikVPN -Confirm:$false")
 }
 
@@ -0,0 +1,24 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// ErrKillSwitchUnsupported is returned on platforms without a kill switch.
+var ErrKillSwitchUnsupported = errors.New("the kill switch is not supported on this platform")
+
+// KillSwitchRules describes the only traffic the kill switch lets out while
+// it is active, besides loopback.
+type KillSwitchRules struct {
+	// TunnelInterface carries everything else once the tunnel is up.
+	TunnelInterface string
+	// Endpoints are the server's WireGuard addresses, reached over UDP.
+	Endpoints []netip.AddrPort
+	// StreamEndpoints are where WireGuard connects over TCP instead, when
+	// it runs over a stream transport.
+	StreamEndpoints []netip.AddrPort
+	// APIServers are the registration API's addresses, reached over TCP so
+	// the client can register and reconnect.
+	APIServers []netip.AddrPort
+}
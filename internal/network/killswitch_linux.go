@@ -0,0 +1,80 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// killSwitchTable is the nftables table holding the kill switch rules. It
+// lives on its own so removing it can never touch other firewall rules.
+const killSwitchTable = "shikvpn_killswitch"
+
+// EnableKillSwitch installs firewall rules that drop all outgoing traffic
+// except that described by rules, replacing any rules installed earlier.
+// The rules outlive the process, so a crashed client keeps blocking traffic
+// until DisableKillSwitch is called.
+func EnableKillSwitch(rules KillSwitchRules) error {
+	if err := ValidateInterfaceName(rules.TunnelInterface); err != nil {
+		return err
+	}
+	return runNft(buildKillSwitchRuleset(rules))
+}
+
+// DisableKillSwitch removes the kill switch rules. It succeeds if none are installed.
+func DisableKillSwitch() error {
+	// Declaring the table first makes the delete succeed even if it is missing
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", killSwitchTable, killSwitchTable))
+}
+
+// buildKillSwitchRuleset returns an nft script that atomically replaces the
+// kill switch table.
+func buildKillSwitchRuleset(rules KillSwitchRules) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %q accept\n", rules.TunnelInterface)
+	// Keep DHCP and neighbor discovery working so the physical link stays
+	// configured, e.g. after roaming to another network
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	b.WriteString("\t\tudp sport 546 udp dport 547 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	for _, ep := range rules.Endpoints {
+		fmt.Fprintf(&b, "\t\t%s daddr %s udp dport %d accept\n", nftFamily(ep.Addr()), ep.Addr().Unmap(), ep.Port())
+	}
+	for _, ep := range rules.StreamEndpoints {
+		fmt.Fprintf(&b, "\t\t%s daddr %s tcp dport %d accept\n", nftFamily(ep.Addr()), ep.Addr().Unmap(), ep.Port())
+	}
+	for _, api := range rules.APIServers {
+		fmt.Fprintf(&b, "\t\t%s daddr %s tcp dport %d accept\n", nftFamily(api.Addr()), api.Addr().Unmap(), api.Port())
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftFamily returns the nft address match keyword for an address.
+func nftFamily(addr netip.Addr) string {
+	if addr.Unmap().Is4() {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// runNft applies an nft script in a single transaction.
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
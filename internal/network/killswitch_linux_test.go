@@ -0,0 +1,47 @@
+//go:build linux
+
+package network
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestBuildKillSwitchRuleset(t *testing.T) {
+	got := buildKillSwitchRuleset(KillSwitchRules{
+		TunnelInterface: "wg0",
+		Endpoints:       []netip.AddrPort{netip.MustParseAddrPort("203.0.113.7:51820")},
+		StreamEndpoints: []netip.AddrPort{netip.MustParseAddrPort("203.0.113.7:443")},
+		APIServers: []netip.AddrPort{
+			netip.MustParseAddrPort("203.0.113.7:8080"),
+			netip.MustParseAddrPort("[2001:db8::1]:8080"),
+		},
+	})
+
+	for _, want := range []string{
+		"delete table inet shikvpn_killswitch\n",
+		"policy drop;",
+		"oifname \"lo\" accept\n",
+		"oifname \"wg0\" accept\n",
+		"ip daddr 203.0.113.7 udp dport 51820 accept\n",
+		"ip daddr 203.0.113.7 tcp dport 443 accept\n",
+		"ip daddr 203.0.113.7 tcp dport 8080 accept\n",
+		"ip6 daddr 2001:db8::1 tcp dport 8080 accept\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ruleset missing %q:\n%s", want, got)
+		}
+	}
+	// The replacement must come after the delete so it is atomic
+	if strings.Index(got, "delete table") > strings.Index(got, "chain output") {
+		t.Errorf("ruleset deletes the table after defining it:\n%s", got)
+	}
+}
+
+func TestBuildKillSwitchRulesetBeforeRegistration(t *testing.T) {
+	got := buildKillSwitchRuleset(KillSwitchRules{TunnelInterface: "wg0"})
+	if strings.Contains(got, "udp dport 51820") {
+		t.Errorf("ruleset allows an endpoint that was not given:\n%s", got)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package network
+
+// EnableKillSwitch is only implemented on Linux.
+func EnableKillSwitch(rules KillSwitchRules) error {
+	return ErrKillSwitchUnsupported
+}
+
+// DisableKillSwitch is only implemented on Linux; there is nothing to remove elsewhere.
+func DisableKillSwitch() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// natTable is the nftables table holding the server's NAT rules. Owning a
+// whole table lets it be replaced and removed without touching other rules.
+const natTable = "shikvpn"
+
+// natRule masquerades traffic from a VPN subnet leaving through an interface.
+type natRule struct {
+	subnet netip.Prefix
+	oif    string
+}
+
+// EnableNFTablesNAT masquerades traffic from vpnSubnets that leaves through
+// wanInterface, or through the default route's interface for each subnet's
+// address family if it is empty. Any table left by an earlier run is
+// replaced atomically, so restarting after a crash never duplicates rules.
+func EnableNFTablesNAT(wanInterface string, vpnSubnets []string) error {
+	rules := make([]natRule, 0, len(vpnSubnets))
+	for _, subnet := range vpnSubnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR address %q: %w", subnet, err)
+		}
+		_, family := natTools(subnet)
+		oif, err := natInterface(wanInterface, family)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, natRule{subnet: prefix.Masked(), oif: oif})
+	}
+	return runNft(buildNATRuleset(rules))
+}
+
+// DisableNFTablesNAT removes the NAT table. It succeeds if none is installed.
+func DisableNFTablesNAT() error {
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", natTable, natTable))
+}
+
+// buildNATRuleset returns an nft script that atomically replaces the NAT table.
+func buildNATRuleset(rules []natRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\n", natTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", natTable)
+	fmt.Fprintf(&b, "table inet %s {\n", natTable)
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "\t\t%s saddr %s oifname %q masquerade\n", nftFamily(r.subnet.Addr()), r.subnet, r.oif)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
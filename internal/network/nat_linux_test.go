@@ -0,0 +1,40 @@
+//go:build linux
+
+package network
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestBuildNATRuleset(t *testing.T) {
+	got := buildNATRuleset([]natRule{
+		{subnet: netip.MustParsePrefix("10.0.0.0/24"), oif: "eth0"},
+		{subnet: netip.MustParsePrefix("fd00::/64"), oif: "ens3"},
+	})
+
+	for _, want := range []string{
+		"delete table inet shikvpn\n",
+		"type nat hook postrouting priority 100; policy accept;\n",
+		"ip saddr 10.0.0.0/24 oifname \"eth0\" masquerade\n",
+		"ip6 saddr fd00::/64 oifname \"ens3\" masquerade\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ruleset missing %q:\n%s", want, got)
+		}
+	}
+	// The replacement must come after the delete so it is atomic
+	if strings.Index(got, "delete table") > strings.Index(got, "chain postrouting") {
+		t.Errorf("ruleset deletes the table after defining it:\n%s", got)
+	}
+}
+
+func TestEnableNFTablesNATRejectsBadInput(t *testing.T) {
+	if err := EnableNFTablesNAT("eth0", []string{"10.0.0.0"}); err == nil {
+		t.Error("expected an error for a subnet without a prefix length")
+	}
+	if err := EnableNFTablesNAT("eth0\" masquerade", []string{"10.0.0.0/24"}); err == nil {
+		t.Error("expected an error for an unsafe interface name")
+	}
+}
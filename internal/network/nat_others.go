@@ -0,0 +1,15 @@
+//go:build !linux
+
+package network
+
+import "fmt"
+
+// EnableNFTablesNAT is only implemented on Linux.
+func EnableNFTablesNAT(wanInterface string, vpnSubnets []string) error {
+	return fmt.Errorf("nftables NAT is only supported on Linux")
+}
+
+// DisableNFTablesNAT is only implemented on Linux; there is nothing to remove elsewhere.
+func DisableNFTablesNAT() error {
+	return nil
+}
@@ -33,3 +33,9 @@ func ValidateIP(ip string) error {
 	}
 	return nil
 }
+
+// isIPv6CIDR reports whether address is an IPv6 CIDR.
+func isIPv6CIDR(address string) bool {
+	ip, _, err := net.ParseCIDR(address)
+	return err == nil && ip.To4() == nil
+}
@@ -0,0 +1,18 @@
+package network
+
+import "errors"
+
+// ErrWatchUnsupported is returned by WatchChanges on platforms where network
+// changes cannot be observed.
+var ErrWatchUnsupported = errors.New("network change monitoring is not supported on this platform")
+
+// BypassRouter is implemented by configurators that can move the route which
+// keeps traffic to the server endpoint off the tunnel when the physical
+// network changes, e.g. when switching from Wi-Fi to Ethernet.
+type BypassRouter interface {
+	// UpdateBypassRoute points the server endpoint's route at the current
+	// physical default gateway, ignoring routes through ifaceName. It reports
+	// whether the route changed. Without a physical default route it does
+	// nothing, as there is nowhere to send the traffic yet.
+	UpdateBypassRoute(ifaceName string, serverEndpoint string) (bool, error)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+)
+
+// WatchChanges reports link, address and route changes until ctx is
+// cancelled. Bursts of changes are coalesced, so a receive means "something
+// changed since the last receive" rather than one event each.
+func WatchChanges(ctx context.Context) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	onError := func(err error) {
+		log.Printf("Warning: netlink subscription error: %v", err)
+	}
+
+	links := make(chan netlink.LinkUpdate, 16)
+	if err := netlink.LinkSubscribeWithOptions(links, done, netlink.LinkSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to subscribe to link changes: %w", err)
+	}
+	addrs := make(chan netlink.AddrUpdate, 16)
+	if err := netlink.AddrSubscribeWithOptions(addrs, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to subscribe to address changes: %w", err)
+	}
+	routes := make(chan netlink.RouteUpdate, 16)
+	if err := netlink.RouteSubscribeWithOptions(routes, done, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to subscribe to route changes: %w", err)
+	}
+
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default: // a change is already pending
+		}
+	}
+
+	go func() {
+		defer close(done)
+		for {
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok = <-links:
+			case _, ok = <-addrs:
+			case _, ok = <-routes:
+			}
+			if !ok {
+				log.Println("Warning: netlink subscription closed; no longer watching for network changes")
+				return
+			}
+			notify()
+		}
+	}()
+	return changes, nil
+}
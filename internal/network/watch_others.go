@@ -0,0 +1,10 @@
+//go:build !linux
+
+package network
+
+import "context"
+
+// WatchChanges is only implemented on Linux.
+func WatchChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, ErrWatchUnsupported
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hopHeaders are connection-specific headers that must not be forwarded (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// handleHTTP serves an HTTP proxy request. CONNECT requests return the
+// connection to the target for relaying; other requests with an absolute
+// URL are forwarded and answered directly, one per connection.
+func (s *Server) handleHTTP(c net.Conn, r *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodConnect {
+		address := req.Host
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			writeHTTPError(c, http.StatusBadRequest)
+			return nil, fmt.Errorf("http: CONNECT target %q is not host:port", address)
+		}
+		target, err := s.dial(s.ctx, "tcp", address)
+		if err != nil {
+			writeHTTPError(c, http.StatusBadGateway)
+			return nil, fmt.Errorf("http: connect to %s: %w", address, err)
+		}
+		if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			target.Close()
+			return nil, err
+		}
+		return target, nil
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeHTTPError(c, http.StatusBadRequest)
+		return nil, fmt.Errorf("http: %s %s is not a proxy request", req.Method, req.URL)
+	}
+	// Responses may take longer than the request handshake
+	c.SetDeadline(time.Time{})
+	return nil, s.forwardHTTP(c, req)
+}
+
+// forwardHTTP sends a plain HTTP request through the tunnel and writes the response back.
+func (s *Server) forwardHTTP(c net.Conn, req *http.Request) error {
+	for _, h := range connectionHeaders(req.Header) {
+		req.Header.Del(h)
+	}
+	req.RequestURI = ""
+	req.Close = true
+
+	transport := &http.Transport{
+		DialContext:       s.dial,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := transport.RoundTrip(req.WithContext(s.ctx))
+	if err != nil {
+		writeHTTPError(c, http.StatusBadGateway)
+		return fmt.Errorf("http: forward to %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	for _, h := range connectionHeaders(resp.Header) {
+		resp.Header.Del(h)
+	}
+	resp.Close = true
+	return resp.Write(c)
+}
+
+// connectionHeaders returns the hop-by-hop headers of h, including any named in its Connection header.
+func connectionHeaders(h http.Header) []string {
+	headers := append([]string(nil), hopHeaders...)
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers = append(headers, name)
+			}
+		}
+	}
+	return headers
+}
+
+// writeHTTPError answers a proxy request with an empty error response.
+func writeHTTPError(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,198 @@
+// Package proxy implements a local SOCKS5 and HTTP proxy that makes its
+// outgoing connections through a dial function, such as one backed by a
+// userspace WireGuard tunnel.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds how long a client may take to send its request.
+const handshakeTimeout = 30 * time.Second
+
+// DialFunc opens an outgoing connection on behalf of a proxy client.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Server accepts SOCKS5 and HTTP proxy clients on a single listener. The
+// protocol is told apart by the first byte each client sends.
+type Server struct {
+	dial DialFunc
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a proxy server that makes outgoing connections with dial.
+func New(dial DialFunc) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		dial:   dial,
+		conns:  make(map[net.Conn]struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Listen starts serving on address, e.g. "127.0.0.1:1080", and returns the
+// address actually bound.
+func (s *Server) Listen(address string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil, net.ErrClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.serve(ln)
+	return ln.Addr(), nil
+}
+
+// Addr returns the address the proxy listens on, or nil before Listen.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// Close stops the listener and closes every proxied connection, on both sides.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Warning: proxy stopped accepting connections: %v", err)
+			}
+			return
+		}
+		if !s.track(c, true) {
+			c.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(c, false)
+			defer c.Close()
+			s.handle(c)
+		}()
+	}
+}
+
+// track adds or removes a connection from the set closed by Close. It
+// reports false if the server is already closed.
+func (s *Server) track(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// handle serves one client connection.
+func (s *Server) handle(c net.Conn) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(c)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var target net.Conn
+	if first[0] == socksVersion {
+		target, err = s.handleSOCKS(c, r)
+	} else {
+		target, err = s.handleHTTP(c, r)
+	}
+	if err != nil {
+		log.Printf("Proxy request from %s failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	if target == nil {
+		return // answered without a tunnel, e.g. a forwarded HTTP request
+	}
+	defer target.Close()
+	if !s.track(target, true) {
+		return
+	}
+	defer s.track(target, false)
+	c.SetDeadline(time.Time{})
+
+	// The client may already have sent data behind its request
+	if n := r.Buffered(); n > 0 {
+		buffered, _ := r.Peek(n)
+		if _, err := target.Write(buffered); err != nil {
+			return
+		}
+	}
+	relay(c, target)
+}
+
+// relay copies data in both directions until either side is done.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Pass the end of the stream on so half-closed protocols still work
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
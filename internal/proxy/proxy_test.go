@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// startProxy runs a proxy that dials directly and returns its address.
+func startProxy(t *testing.T) string {
+	t.Helper()
+	var d net.Dialer
+	s := New(d.DialContext)
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return addr.String()
+}
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hello %s", r.URL.Path)
+}
+
+// get fetches url through the proxy at proxyURL.
+func get(t *testing.T, proxyURL, target string, tlsConfig *tls.Config) string {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: tlsConfig,
+	}}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("GET %s via %s: %v", target, proxyURL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s via %s: status %d", target, proxyURL, resp.StatusCode)
+	}
+	return string(body)
+}
+
+func TestSOCKS5(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(hello))
+	defer backend.Close()
+	proxyAddr := startProxy(t)
+
+	if got := get(t, "socks5://"+proxyAddr, backend.URL+"/socks", nil); got != "hello /socks" {
+		t.Errorf("body = %q, want %q", got, "hello /socks")
+	}
+
+	// Names are resolved by the proxy's dialer
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	if got := get(t, "socks5://"+proxyAddr, "http://localhost:"+port+"/name", nil); got != "hello /name" {
+		t.Errorf("body = %q, want %q", got, "hello /name")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(hello))
+	defer backend.Close()
+	proxyAddr := startProxy(t)
+
+	tlsConfig := backend.Client().Transport.(*http.Transport).TLSClientConfig
+	if got := get(t, "http://"+proxyAddr, backend.URL+"/connect", tlsConfig); got != "hello /connect" {
+		t.Errorf("body = %q, want %q", got, "hello /connect")
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	var sawProxyHeader bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawProxyHeader = r.Header.Get("Proxy-Connection") != ""
+		hello(w, r)
+	}))
+	defer backend.Close()
+	proxyAddr := startProxy(t)
+
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET %s/forward HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", backend.URL, backend.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello /forward" {
+		t.Errorf("body = %q, want %q", body, "hello /forward")
+	}
+	if sawProxyHeader {
+		t.Error("hop-by-hop Proxy-Connection header was forwarded")
+	}
+}
+
+func TestHTTPRejectsOriginRequests(t *testing.T) {
+	proxyAddr := startProxy(t)
+
+	resp, err := http.Get("http://" + proxyAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSOCKS5Errors(t *testing.T) {
+	proxyAddr := startProxy(t)
+
+	tests := []struct {
+		name    string
+		request []byte
+		want    byte
+	}{
+		{
+			name:    "bind command",
+			request: []byte{socksVersion, 0x02, 0x00, socksAddrIPv4, 127, 0, 0, 1, 0, 80},
+			want:    socksCommandNotSupported,
+		},
+		{
+			name:    "unknown address type",
+			request: []byte{socksVersion, socksConnect, 0x00, 0x09},
+			want:    socksAddrNotSupported,
+		},
+		{
+			name:    "closed port",
+			request: []byte{socksVersion, socksConnect, 0x00, socksAddrIPv4, 127, 0, 0, 1, 0, 1},
+			want:    socksConnectionRefused,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			c.Write([]byte{socksVersion, 1, socksNoAuth})
+			var method [2]byte
+			if _, err := io.ReadFull(c, method[:]); err != nil || method[1] != socksNoAuth {
+				t.Fatalf("method selection = %v, %v", method, err)
+			}
+			c.Write(tt.request)
+			var reply [2]byte
+			if _, err := io.ReadFull(c, reply[:]); err != nil {
+				t.Fatalf("reading reply: %v", err)
+			}
+			if reply[1] != tt.want {
+				t.Errorf("reply code = %d, want %d", reply[1], tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS5RequiresNoAuth(t *testing.T) {
+	proxyAddr := startProxy(t)
+
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{socksVersion, 1, 0x02}) // username/password only
+	var method [2]byte
+	if _, err := io.ReadFull(c, method[:]); err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != socksNoAcceptable {
+		t.Errorf("method = %#x, want %#x", method[1], socksNoAcceptable)
+	}
+}
+
+func TestCloseStopsRelays(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err == nil {
+			io.Copy(io.Discard, c) // hold the connection open
+		}
+	}()
+
+	var d net.Dialer
+	s := New(d.DialContext)
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backend.Addr(), backend.Addr())
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || !strings.Contains(line, "200") {
+		t.Fatalf("CONNECT response = %q, %v", line, err)
+	}
+
+	// Close must not hang on the open relay
+	s.Close()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("client connection still open after Close")
+	}
+	if _, err := s.Listen("127.0.0.1:0"); err == nil {
+		t.Error("Listen() after Close succeeded")
+	}
+}
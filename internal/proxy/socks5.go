@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+// SOCKS5 protocol constants (RFC 1928).
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+)
+
+// handleSOCKS negotiates a SOCKS5 CONNECT and returns the connection to the target.
+func (s *Server) handleSOCKS(c net.Conn, r *bufio.Reader) (net.Conn, error) {
+	// Greeting: version, method count, methods
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoAcceptable {
+		return nil, fmt.Errorf("socks: client does not offer unauthenticated access")
+	}
+
+	// Request: version, command, reserved, address
+	var req [3]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return nil, err
+	}
+	if req[0] != socksVersion {
+		return nil, fmt.Errorf("socks: unsupported version %d", req[0])
+	}
+	address, err := readSOCKSAddr(r)
+	if err != nil {
+		writeSOCKSReply(c, socksAddrNotSupported, nil)
+		return nil, err
+	}
+	if req[1] != socksConnect {
+		writeSOCKSReply(c, socksCommandNotSupported, nil)
+		return nil, fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+
+	target, err := s.dial(s.ctx, "tcp", address)
+	if err != nil {
+		writeSOCKSReply(c, socksReplyCode(err), nil)
+		return nil, fmt.Errorf("socks: connect to %s: %w", address, err)
+	}
+	if err := writeSOCKSReply(c, socksSucceeded, target.LocalAddr()); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// readSOCKSAddr reads a SOCKS5 address and port and returns it as host:port.
+func readSOCKSAddr(r *bufio.Reader) (string, error) {
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := 4
+		if atyp == socksAddrIPv6 {
+			size = 16
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(raw)
+		host = addr.String()
+	case socksAddrDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		raw := make([]byte, n)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return "", err
+		}
+		host = string(raw)
+	default:
+		return "", fmt.Errorf("socks: unsupported address type %d", atyp)
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKSReply sends a reply with the given code and bound address.
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	var ap netip.AddrPort
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ap = tcp.AddrPort()
+	}
+	addr := ap.Addr().Unmap()
+	switch {
+	case addr.Is6():
+		reply = append(reply, socksAddrIPv6)
+		reply = append(reply, addr.AsSlice()...)
+	case addr.Is4():
+		reply = append(reply, socksAddrIPv4)
+		reply = append(reply, addr.AsSlice()...)
+	default:
+		reply = append(reply, socksAddrIPv4, 0, 0, 0, 0)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, ap.Port())
+	_, err := w.Write(reply)
+	return err
+}
+
+// socksReplyCode maps a dial error to a SOCKS5 reply code.
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
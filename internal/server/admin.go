@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// AdminKeyHeader carries the admin API key.
+const AdminKeyHeader = "X-Admin-Key"
+
+// AdminPrefix is the path prefix under which the admin API is served.
+const AdminPrefix = "/api/v1/admin/"
+
+// PeerStatsFunc returns the current runtime state of all WireGuard peers.
+type PeerStatsFunc func() ([]tunnel.PeerStats, error)
+
+// AdminPeer describes a peer in admin API responses.
+type AdminPeer struct {
+	PublicKey     string     `json:"public_key"`
+	AssignedIP    string     `json:"assigned_ip"`
+	AssignedIP6   string     `json:"assigned_ip6,omitempty"`
+	Static        bool       `json:"static"`
+	Token         string     `json:"token,omitempty"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+}
+
+// PinRequest is the JSON body for pinning a static IP to a peer.
+type PinRequest struct {
+	IP string `json:"ip"`
+}
+
+// AdminAPI serves operator endpoints for inspecting and managing peers.
+type AdminAPI struct {
+	ipam         *IPAM
+	adminKey     string
+	tokens       *TokenStore
+	peerStats    PeerStatsFunc
+	onPeerAdd    PeerAddFunc
+	onPeerRemove PeerRemoveFunc
+	mux          *http.ServeMux
+}
+
+// NewAdminAPI creates the admin API handler. Requests must carry adminKey or,
+// if tokens is non-nil, a token with the admin scope; adminKey may be empty
+// when tokens are used.
+func NewAdminAPI(ipam *IPAM, adminKey string, tokens *TokenStore, peerStats PeerStatsFunc, onPeerAdd PeerAddFunc, onPeerRemove PeerRemoveFunc) *AdminAPI {
+	a := &AdminAPI{
+		ipam:         ipam,
+		adminKey:     adminKey,
+		tokens:       tokens,
+		peerStats:    peerStats,
+		onPeerAdd:    onPeerAdd,
+		onPeerRemove: onPeerRemove,
+		mux:          http.NewServeMux(),
+	}
+	a.mux.HandleFunc("GET "+AdminPrefix+"peers", a.handleListPeers)
+	a.mux.HandleFunc("GET "+AdminPrefix+"peers/{pubkey}", a.handleGetPeer)
+	a.mux.HandleFunc("DELETE "+AdminPrefix+"peers/{pubkey}", a.handleKickPeer)
+	a.mux.HandleFunc("PUT "+AdminPrefix+"peers/{pubkey}/ip", a.handlePinIP)
+	a.mux.HandleFunc("DELETE "+AdminPrefix+"peers/{pubkey}/ip", a.handleUnpinIP)
+	return a
+}
+
+// Handler returns the HTTP handler for the admin API, guarded by the admin key.
+func (a *AdminAPI) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r.Header.Get(AdminKeyHeader)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		a.mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether provided is the admin key or an admin-scoped token.
+func (a *AdminAPI) authorized(provided string) bool {
+	if a.adminKey != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(a.adminKey)) == 1 {
+		return true
+	}
+	if a.tokens == nil {
+		return false
+	}
+	token, err := a.tokens.Authenticate(provided, ScopeAdmin, time.Now())
+	if err != nil {
+		if token.Name != "" {
+			log.Printf("Admin: rejected token %q: %v", token.Name, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (a *AdminAPI) handleListPeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := a.collectPeers()
+	if err != nil {
+		log.Printf("Admin: failed to read peer stats: %v", err)
+		http.Error(w, "failed to read peer stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (a *AdminAPI) handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pathPublicKey(w, r)
+	if !ok {
+		return
+	}
+
+	a.writePeer(w, pubKey)
+}
+
+func (a *AdminAPI) handleKickPeer(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pathPublicKey(w, r)
+	if !ok {
+		return
+	}
+
+	assignedIP, found := a.ipam.GetAllocation(pubKey)
+	if !found {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		return
+	}
+
+	pubKeyHex, _ := crypto.Base64ToHex(pubKey)
+	if err := a.onPeerRemove(pubKeyHex); err != nil {
+		log.Printf("Admin: failed to remove peer: %v", err)
+		http.Error(w, "failed to remove peer", http.StatusInternalServerError)
+		return
+	}
+	a.ipam.Release(pubKey)
+
+	log.Printf("Admin: kicked peer %s... (IP %s)", truncateKey(pubKey), assignedIP.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) handlePinIP(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pathPublicKey(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	var req PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		http.Error(w, "ip is not a valid IP address", http.StatusBadRequest)
+		return
+	}
+
+	prevIP, err := a.ipam.Pin(pubKey, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// Keep the device in sync: the peer's only allowed IP becomes the pinned one
+	pubKeyHex, _ := crypto.Base64ToHex(pubKey)
+	peer := tunnel.PeerConfig{
+		PublicKeyHex:      pubKeyHex,
+		AllowedIPs:        a.ipam.AllowedIPs(pubKey),
+		ReplaceAllowedIPs: true,
+	}
+	if err := a.onPeerAdd(peer); err != nil {
+		log.Printf("Admin: failed to update peer allowed IPs: %v", err)
+		http.Error(w, "failed to configure peer", http.StatusInternalServerError)
+		return
+	}
+
+	if prevIP != nil && !prevIP.Equal(ip) {
+		log.Printf("Admin: pinned peer %s... to %s (was %s)", truncateKey(pubKey), ip.String(), prevIP.String())
+	} else {
+		log.Printf("Admin: pinned peer %s... to %s", truncateKey(pubKey), ip.String())
+	}
+
+	a.writePeer(w, pubKey)
+}
+
+func (a *AdminAPI) handleUnpinIP(w http.ResponseWriter, r *http.Request) {
+	pubKey, ok := pathPublicKey(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.ipam.Unpin(pubKey) {
+		http.Error(w, "peer has no pinned IP", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin: unpinned peer %s...", truncateKey(pubKey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePeer responds with the admin view of a single peer.
+func (a *AdminAPI) writePeer(w http.ResponseWriter, pubKey string) {
+	peers, err := a.collectPeers()
+	if err != nil {
+		log.Printf("Admin: failed to read peer stats: %v", err)
+		http.Error(w, "failed to read peer stats", http.StatusInternalServerError)
+		return
+	}
+	for _, p := range peers {
+		if p.PublicKey == pubKey {
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+	}
+	http.Error(w, "peer not found", http.StatusNotFound)
+}
+
+// collectPeers merges IPAM allocations with live device statistics.
+func (a *AdminAPI) collectPeers() ([]AdminPeer, error) {
+	stats, err := a.peerStats()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]tunnel.PeerStats, len(stats))
+	for _, st := range stats {
+		byKey[st.PublicKeyHex] = st
+	}
+
+	allocs := a.ipam.Allocations()
+	peers := make([]AdminPeer, 0, len(allocs))
+	for pubKey, ip := range allocs {
+		p := AdminPeer{
+			PublicKey:  pubKey,
+			AssignedIP: ip.String(),
+			Static:     a.ipam.IsStatic(pubKey),
+			Token:      a.ipam.Token(pubKey),
+		}
+		if ip6, ok := a.ipam.GetAllocation6(pubKey); ok {
+			p.AssignedIP6 = ip6.String()
+		}
+		if pubKeyHex, err := crypto.Base64ToHex(pubKey); err == nil {
+			if st, ok := byKey[pubKeyHex]; ok {
+				p.Endpoint = st.Endpoint
+				p.RxBytes = st.RxBytes
+				p.TxBytes = st.TxBytes
+				if !st.LastHandshake.IsZero() {
+					hs := st.LastHandshake.UTC()
+					p.LastHandshake = &hs
+				}
+			}
+		}
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(peers[i].AssignedIP).To16(), net.ParseIP(peers[j].AssignedIP).To16()) < 0
+	})
+	return peers, nil
+}
+
+// pathPublicKey extracts and validates the {pubkey} path value.
+func pathPublicKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	pubKey := r.PathValue("pubkey")
+	if _, err := crypto.KeyFromBase64(pubKey); err != nil {
+		http.Error(w, "invalid public_key format", http.StatusBadRequest)
+		return "", false
+	}
+	return pubKey, true
+}
+
+// writeJSON encodes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
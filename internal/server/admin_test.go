@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+const testAdminKey = "test-admin-key"
+
+// fakeDevice records peer changes made through the admin API.
+type fakeDevice struct {
+	stats   []tunnel.PeerStats
+	added   []tunnel.PeerConfig
+	removed []string
+}
+
+func setupTestAdmin(t *testing.T) (*IPAM, *fakeDevice, *httptest.Server) {
+	t.Helper()
+
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	dev := &fakeDevice{}
+	admin := NewAdminAPI(ipam, testAdminKey, nil,
+		func() ([]tunnel.PeerStats, error) { return dev.stats, nil },
+		func(peer tunnel.PeerConfig) error { dev.added = append(dev.added, peer); return nil },
+		func(publicKeyHex string) error { dev.removed = append(dev.removed, publicKeyHex); return nil },
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle(AdminPrefix, admin.Handler())
+	return ipam, dev, httptest.NewServer(mux)
+}
+
+func adminRequest(t *testing.T, method, url string, body []byte) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set(AdminKeyHeader, testAdminKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s error: %v", method, url, err)
+	}
+	return resp
+}
+
+func TestAdminRequiresKey(t *testing.T) {
+	_, _, server := setupTestAdmin(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + AdminPrefix + "peers")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestAdminAcceptsAdminToken(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	adminSecret, _ := tokens.Issue("ops", []string{ScopeAdmin}, time.Time{}, 0)
+	registerSecret, _ := tokens.Issue("user", []string{ScopeRegister}, time.Time{}, 0)
+
+	ipam, _ := NewIPAM("10.0.0.1/24", nil)
+	admin := NewAdminAPI(ipam, "", tokens,
+		func() ([]tunnel.PeerStats, error) { return nil, nil },
+		func(peer tunnel.PeerConfig) error { return nil },
+		func(publicKeyHex string) error { return nil },
+	)
+	server := httptest.NewServer(admin.Handler())
+	defer server.Close()
+
+	for secret, want := range map[string]int{
+		adminSecret:    http.StatusOK,
+		registerSecret: http.StatusUnauthorized,
+		"":             http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("GET", server.URL+AdminPrefix+"peers", nil)
+		req.Header.Set(AdminKeyHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("key %q: status = %d, want %d", secret, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestAdminListPeers(t *testing.T) {
+	ipam, dev, server := setupTestAdmin(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	ipam.Allocate(pubKey)
+
+	handshake := time.Unix(1700000000, 0)
+	dev.stats = []tunnel.PeerStats{{
+		PublicKeyHex:  crypto.KeyToHex(kp.PublicKey),
+		Endpoint:      "5.6.7.8:40000",
+		LastHandshake: handshake,
+		RxBytes:       1234,
+		TxBytes:       5678,
+	}}
+
+	resp := adminRequest(t, "GET", server.URL+AdminPrefix+"peers", nil)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var peers []AdminPeer
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(peers))
+	}
+	p := peers[0]
+	if p.PublicKey != pubKey || p.AssignedIP != "10.0.0.2" {
+		t.Errorf("peer = %+v, unexpected key or IP", p)
+	}
+	if p.Endpoint != "5.6.7.8:40000" || p.RxBytes != 1234 || p.TxBytes != 5678 {
+		t.Errorf("peer = %+v, stats not merged", p)
+	}
+	if p.LastHandshake == nil || !p.LastHandshake.Equal(handshake) {
+		t.Errorf("LastHandshake = %v, want %v", p.LastHandshake, handshake)
+	}
+}
+
+func TestAdminKickPeer(t *testing.T) {
+	ipam, dev, server := setupTestAdmin(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	ipam.Allocate(pubKey)
+
+	resp := adminRequest(t, "DELETE", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey), nil)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+	if len(dev.removed) != 1 || dev.removed[0] != crypto.KeyToHex(kp.PublicKey) {
+		t.Errorf("removed = %v, want the kicked peer", dev.removed)
+	}
+	if _, ok := ipam.GetAllocation(pubKey); ok {
+		t.Error("allocation still present after kick")
+	}
+}
+
+func TestAdminKickPinnedPeer(t *testing.T) {
+	ipam, dev, server := setupTestAdmin(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	if _, err := ipam.Pin(pubKey, net.ParseIP("10.0.0.50")); err != nil {
+		t.Fatalf("Pin() error: %v", err)
+	}
+
+	resp := adminRequest(t, "DELETE", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey), nil)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+	if len(dev.removed) != 1 {
+		t.Errorf("removed = %v, want the kicked peer", dev.removed)
+	}
+	// The pinned IP stays reserved, but the peer is not restored on restart
+	if ip, _ := ipam.GetAllocation(pubKey); ip.String() != "10.0.0.50" {
+		t.Errorf("pinned IP after kick = %v, want 10.0.0.50", ip)
+	}
+	if !ipam.IsReleased(pubKey) {
+		t.Error("kicked pinned peer not marked released")
+	}
+}
+
+func TestAdminPinIP(t *testing.T) {
+	ipam, dev, server := setupTestAdmin(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	ipam.Allocate(pubKey)
+
+	body, _ := json.Marshal(PinRequest{IP: "10.0.0.50"})
+	resp := adminRequest(t, "PUT", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey)+"/ip", body)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var p AdminPeer
+	json.NewDecoder(resp.Body).Decode(&p)
+	if p.AssignedIP != "10.0.0.50" || !p.Static {
+		t.Errorf("peer = %+v, want static 10.0.0.50", p)
+	}
+
+	if len(dev.added) != 1 || !dev.added[0].ReplaceAllowedIPs || dev.added[0].AllowedIPs[0] != "10.0.0.50/32" {
+		t.Errorf("device update = %+v, want replaced allowed IP 10.0.0.50/32", dev.added)
+	}
+
+	// Pinned allocations survive release
+	ipam.Release(pubKey)
+	if ip, ok := ipam.GetAllocation(pubKey); !ok || ip.String() != "10.0.0.50" {
+		t.Errorf("pinned allocation lost after Release: %v", ip)
+	}
+}
+
+func TestAdminPinIPConflict(t *testing.T) {
+	ipam, _, server := setupTestAdmin(t)
+	defer server.Close()
+
+	ipam.Allocate("other") // takes 10.0.0.2
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+
+	for _, ip := range []string{"10.0.0.2", "10.0.0.1", "192.168.0.5"} {
+		body, _ := json.Marshal(PinRequest{IP: ip})
+		resp := adminRequest(t, "PUT", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey)+"/ip", body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("pin %s: status = %d, want 409", ip, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminUnpinIP(t *testing.T) {
+	ipam, _, server := setupTestAdmin(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	ipam.Pin(pubKey, []byte{10, 0, 0, 60})
+
+	resp := adminRequest(t, "DELETE", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey)+"/ip", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+
+	ipam.Release(pubKey)
+	if _, ok := ipam.GetAllocation(pubKey); ok {
+		t.Error("unpinned allocation was not released")
+	}
+
+	resp = adminRequest(t, "DELETE", server.URL+AdminPrefix+"peers/"+url.PathEscape(pubKey)+"/ip", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second unpin status = %d, want 404", resp.StatusCode)
+	}
+}
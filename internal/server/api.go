@@ -3,9 +3,14 @@ package server
 import (
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gavsh/ShikVPN/internal/crypto"
@@ -15,70 +20,141 @@ import (
 // maxRequestBodySize limits registration request bodies to 4KB.
 const maxRequestBodySize = 4096
 
+// proofMaxSkew is how far a peer proof timestamp may differ from the server clock.
+const proofMaxSkew = 5 * time.Minute
+
+// Headers carrying a peer's proof of private key possession.
+const (
+	PeerProofHeader     = "X-Peer-Proof"
+	PeerTimestampHeader = "X-Peer-Timestamp"
+)
+
+// ServerSignatureHeader carries the server's MAC over a registration response
+// body, keyed by the X25519 shared secret between the server and the peer.
+const ServerSignatureHeader = "X-Server-Signature"
+
 // RegisterRequest is the JSON body for client registration.
 type RegisterRequest struct {
 	PublicKey string `json:"public_key"`
+	Nonce     string `json:"nonce,omitempty"` // echoed into the response signature to prevent replay
+	Timestamp int64  `json:"timestamp"`       // Unix seconds, covered by Proof
+	Proof     string `json:"proof"`           // base64 MAC over RegisterProofMessage
+}
+
+// ServerKeyResponse is returned by the server key discovery endpoint.
+type ServerKeyResponse struct {
+	ServerPublicKey string `json:"server_public_key"`
 }
 
 // RegisterResponse is returned to the client after successful registration.
 type RegisterResponse struct {
 	AssignedIP      string   `json:"assigned_ip"`
+	AssignedIP6     string   `json:"assigned_ip6,omitempty"`
+	Gateway         string   `json:"gateway"`
 	ServerPublicKey string   `json:"server_public_key"`
 	ServerEndpoint  string   `json:"server_endpoint"`
 	DNSServers      []string `json:"dns_servers"`
 	MTU             int      `json:"mtu"`
+	Routes          []string `json:"routes,omitempty"`    // recommended split-tunnel prefixes; empty means full tunnel
+	APIToken        string   `json:"api_token,omitempty"` // replaces a redeemed invite code as the client's api_key
 }
 
 // PeerAddFunc is called when a new peer needs to be added to the WireGuard device.
 type PeerAddFunc func(peer tunnel.PeerConfig) error
 
-// API handles the HTTP registration endpoint.
+// PeerRemoveFunc is called when a peer needs to be removed from the WireGuard device.
+type PeerRemoveFunc func(publicKeyHex string) error
+
+// API handles the HTTP registration endpoints.
 type API struct {
-	ipam            *IPAM
-	serverPublicKey string
-	serverEndpoint  string
-	dnsServers      []string
-	mtu             int
-	apiKey          string
-	onPeerAdd       PeerAddFunc
-	mux             *http.ServeMux
-	server          *http.Server
+	ipam             *IPAM
+	serverPrivateKey [crypto.KeySize]byte
+	serverPublicKey  string
+	serverEndpoint   string
+	dnsServers       []string
+	routes           []string
+	mtu              int
+	apiKey           string
+	tokens           *TokenStore
+	onPeerAdd        PeerAddFunc
+	onPeerRemove     PeerRemoveFunc
+	metrics          *apiMetrics
+	mux              *http.ServeMux
+	server           *http.Server
 }
 
 // NewAPI creates a new registration API handler.
-func NewAPI(ipam *IPAM, serverPubKey, serverEndpoint string, dnsServers []string, mtu int, apiKey string, onPeerAdd PeerAddFunc) *API {
+// serverPrivKey is used to verify peers' proofs of private key possession.
+// routes is the list of prefixes recommended to clients for split tunneling.
+// If tokens is non-nil, clients may authenticate with a per-user token
+// carrying the register scope instead of the shared apiKey.
+func NewAPI(ipam *IPAM, serverPrivKey [crypto.KeySize]byte, serverPubKey, serverEndpoint string, dnsServers []string, routes []string, mtu int, apiKey string, tokens *TokenStore, onPeerAdd PeerAddFunc, onPeerRemove PeerRemoveFunc) *API {
 	api := &API{
-		ipam:            ipam,
-		serverPublicKey: serverPubKey,
-		serverEndpoint:  serverEndpoint,
-		dnsServers:      dnsServers,
-		mtu:             mtu,
-		apiKey:          apiKey,
-		onPeerAdd:       onPeerAdd,
-		mux:             http.NewServeMux(),
-	}
-	api.mux.HandleFunc("/api/v1/register", api.handleRegister)
+		ipam:             ipam,
+		serverPrivateKey: serverPrivKey,
+		serverPublicKey:  serverPubKey,
+		serverEndpoint:   serverEndpoint,
+		dnsServers:       dnsServers,
+		routes:           routes,
+		mtu:              mtu,
+		apiKey:           apiKey,
+		tokens:           tokens,
+		onPeerAdd:        onPeerAdd,
+		onPeerRemove:     onPeerRemove,
+		metrics:          newAPIMetrics(),
+		mux:              http.NewServeMux(),
+	}
+	api.mux.Handle("/api/v1/register", api.metrics.instrument("register", http.HandlerFunc(api.handleRegister)))
+	api.mux.Handle("DELETE /api/v1/peers/{pubkey}", api.metrics.instrument("deregister", http.HandlerFunc(api.handleDeregister)))
+	api.mux.Handle("GET /api/v1/server-key", api.metrics.instrument("server_key", http.HandlerFunc(api.handleServerKey)))
 	return api
 }
 
+// DeregisterProofMessage returns the message a peer signs to prove it owns
+// pubKey when asking the server to remove it.
+func DeregisterProofMessage(pubKey string, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("shikvpn-deregister\n%s\n%d", pubKey, timestamp))
+}
+
+// RegisterProofMessage returns the message a peer signs to prove it owns
+// pubKey when registering.
+func RegisterProofMessage(pubKey, nonce string, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("shikvpn-register-request\n%s\n%s\n%d", pubKey, nonce, timestamp))
+}
+
+// RegisterResponseMessage returns the message the server signs to bind a
+// registration response body to the requesting peer and its nonce.
+func RegisterResponseMessage(pubKey, nonce string, body []byte) []byte {
+	msg := []byte(fmt.Sprintf("shikvpn-register\n%s\n%s\n", pubKey, nonce))
+	return append(msg, body...)
+}
+
+// Mount serves an additional handler on the API's listener under pattern.
+func (a *API) Mount(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
 // Handler returns the HTTP handler for the API.
 func (a *API) Handler() http.Handler {
 	return a.mux
 }
 
 func (a *API) handleRegister(w http.ResponseWriter, r *http.Request) {
+	// Every early return below is a bad request unless it says otherwise
+	result := resultBadRequest
+	defer func() { a.metrics.registrations.WithLabelValues(result).Inc() }()
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Check API key if configured
-	if a.apiKey != "" {
-		provided := r.Header.Get("X-API-Key")
-		if subtle.ConstantTimeCompare([]byte(provided), []byte(a.apiKey)) != 1 {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
+	// Check the API key or token if either is configured
+	token, ok := a.authorizeRegistration(r)
+	if !ok {
+		result = resultUnauthorized
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
 	}
 
 	// Limit request body size to prevent memory exhaustion
@@ -96,16 +172,43 @@ func (a *API) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate the key is valid base64
-	if _, err := crypto.KeyFromBase64(req.PublicKey); err != nil {
+	peerKey, err := crypto.KeyFromBase64(req.PublicKey)
+	if err != nil {
 		log.Printf("Invalid public_key from client: %v", err)
 		http.Error(w, "invalid public_key format", http.StatusBadRequest)
 		return
 	}
 
-	// Allocate an IP for this peer
-	assignedIP, err := a.ipam.Allocate(req.PublicKey)
+	// Reject low-order keys up front; responses could not be signed for them
+	if _, err := crypto.SharedSecret(a.serverPrivateKey, peerKey); err != nil {
+		http.Error(w, "invalid public_key", http.StatusBadRequest)
+		return
+	}
+
+	// The caller must hold the private key, so nobody can register (and squat
+	// the address of) someone else's public key
+	if !a.verifyPeerProof(peerKey, req.Timestamp, req.Proof, RegisterProofMessage(req.PublicKey, req.Nonce, req.Timestamp)) {
+		log.Printf("Rejected registration for %s...: missing or invalid proof of key possession", truncateKey(req.PublicKey))
+		result = resultUnauthorized
+		http.Error(w, "invalid proof of key possession", http.StatusUnauthorized)
+		return
+	}
+
+	// Allocate an IP for this peer, tagged with the token that registered it
+	_, registered := a.ipam.GetAllocation(req.PublicKey)
+	assignedIP, err := a.ipam.AllocateForToken(req.PublicKey, token.Name, token.MaxPeers)
+	if errors.Is(err, ErrPeerLimit) {
+		log.Printf("Rejected registration for %s...: token %q already has %d peer(s)", truncateKey(req.PublicKey), token.Name, token.MaxPeers)
+		result = resultPeerLimit
+		http.Error(w, "token peer limit reached", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Printf("IPAM allocation failed: %v", err)
+		result = resultError
+		if errors.Is(err, ErrPoolExhausted) {
+			result = resultPoolExhausted
+		}
 		http.Error(w, "failed to allocate IP address", http.StatusInternalServerError)
 		return
 	}
@@ -120,38 +223,209 @@ func (a *API) handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Add peer to WireGuard device
 	peer := tunnel.PeerConfig{
 		PublicKeyHex: pubKeyHex,
-		AllowedIPs:   []string{assignedIP.String() + "/32"},
+		AllowedIPs:   a.ipam.AllowedIPs(req.PublicKey),
 	}
 
 	if err := a.onPeerAdd(peer); err != nil {
 		log.Printf("Failed to add peer: %v", err)
 		a.ipam.Release(req.PublicKey)
+		result = resultError
 		http.Error(w, "failed to configure peer", http.StatusInternalServerError)
 		return
 	}
 
-	truncKey := req.PublicKey
-	if len(truncKey) > 8 {
-		truncKey = truncKey[:8]
+	// An invite code works once; the client gets a regular token in exchange
+	var newToken string
+	if token.Invite {
+		newToken, err = a.tokens.Redeem(token.Name)
+		if err != nil {
+			log.Printf("Failed to redeem invite %q: %v", token.Name, err)
+			// Another client may have won the invite; undo this one's registration
+			if !registered {
+				if err := a.onPeerRemove(pubKeyHex); err != nil {
+					log.Printf("Warning: failed to remove peer %s... after the invite failed: %v", truncateKey(req.PublicKey), err)
+				}
+				a.ipam.Release(req.PublicKey)
+			}
+			result = resultUnauthorized
+			http.Error(w, "invite already used", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Invite %q redeemed by peer %s...", token.Name, truncateKey(req.PublicKey))
+	}
+
+	if token.Name != "" {
+		log.Printf("Registered peer %s... with IP %s (token %q)", truncateKey(req.PublicKey), assignedIP.String(), token.Name)
+	} else {
+		log.Printf("Registered peer %s... with IP %s", truncateKey(req.PublicKey), assignedIP.String())
 	}
-	log.Printf("Registered peer %s... with IP %s", truncKey, assignedIP.String())
 
 	resp := RegisterResponse{
-		AssignedIP:      assignedIP.String() + "/24",
+		AssignedIP:      fmt.Sprintf("%s/%d", assignedIP.String(), a.ipam.PrefixLen()),
+		Gateway:         a.ipam.Gateway().String(),
 		ServerPublicKey: a.serverPublicKey,
 		ServerEndpoint:  a.serverEndpoint,
 		DNSServers:      a.dnsServers,
 		MTU:             a.mtu,
+		Routes:          a.routes,
+		APIToken:        newToken,
+	}
+	if ip6, ok := a.ipam.GetAllocation6(req.PublicKey); ok {
+		resp.AssignedIP6 = fmt.Sprintf("%s/%d", ip6.String(), a.ipam.PrefixLen6())
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		result = resultError
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	// Sign the exact body so the client can check it came from the holder of
+	// the server's WireGuard private key
+	sig, err := crypto.ComputeProof(a.serverPrivateKey, peerKey, RegisterResponseMessage(req.PublicKey, req.Nonce, body))
+	if err != nil {
+		log.Printf("Failed to sign registration response: %v", err)
+		result = resultError
+		http.Error(w, "failed to sign response", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	w.Header().Set(ServerSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	w.Write(body)
+	result = resultSuccess
 }
 
-// ListenAndServe starts the API server.
-func (a *API) ListenAndServe(addr string) error {
+// handleServerKey lets clients without a pinned server_public_key learn it,
+// since registration proofs are keyed with it.
+func (a *API) handleServerKey(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ServerKeyResponse{ServerPublicKey: a.serverPublicKey})
+}
+
+func (a *API) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	pubKey := r.PathValue("pubkey")
+
+	peerKey, err := crypto.KeyFromBase64(pubKey)
+	if err != nil {
+		http.Error(w, "invalid public_key format", http.StatusBadRequest)
+		return
+	}
+
+	// Either the shared API key or a proof of the peer's private key is accepted
+	if !a.hasValidAPIKey(r) && !a.hasValidPeerProof(r, pubKey, peerKey) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	assignedIP, ok := a.ipam.GetAllocation(pubKey)
+	if !ok {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		return
+	}
+
+	if err := a.onPeerRemove(crypto.KeyToHex(peerKey)); err != nil {
+		log.Printf("Failed to remove peer: %v", err)
+		http.Error(w, "failed to remove peer", http.StatusInternalServerError)
+		return
+	}
+	a.ipam.Release(pubKey)
+
+	log.Printf("Deregistered peer %s... and released IP %s", truncateKey(pubKey), assignedIP.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeRegistration checks the X-API-Key header against the shared API
+// key and the token store. It returns the matching token, which is the zero
+// Token for the shared key or when no authentication is configured.
+func (a *API) authorizeRegistration(r *http.Request) (Token, bool) {
+	if a.apiKey == "" && a.tokens == nil {
+		return Token{}, true
+	}
+	if a.hasValidAPIKey(r) {
+		return Token{}, true
+	}
+	if a.tokens == nil {
+		return Token{}, false
+	}
+
+	token, err := a.tokens.Authenticate(r.Header.Get("X-API-Key"), ScopeRegister, time.Now())
+	if err != nil {
+		if token.Name != "" {
+			log.Printf("Rejected registration with token %q: %v", token.Name, err)
+		} else if !errors.Is(err, ErrTokenInvalid) {
+			log.Printf("Warning: failed to check registration token: %v", err)
+		}
+		return Token{}, false
+	}
+	return token, true
+}
+
+// hasValidAPIKey reports whether the request carries the configured API key.
+// It is always false when no API key is configured.
+func (a *API) hasValidAPIKey(r *http.Request) bool {
 	if a.apiKey == "" {
-		log.Println("WARNING: API server starting without authentication. Set api_key in config to require auth.")
+		return false
+	}
+	provided := r.Header.Get("X-API-Key")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(a.apiKey)) == 1
+}
+
+// hasValidPeerProof verifies a timestamped HMAC keyed by the X25519 shared
+// secret between the server and the peer, proving the caller holds the
+// peer's private key.
+func (a *API) hasValidPeerProof(r *http.Request, pubKey string, peerKey [crypto.KeySize]byte) bool {
+	ts, err := strconv.ParseInt(r.Header.Get(PeerTimestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	return a.verifyPeerProof(peerKey, ts, r.Header.Get(PeerProofHeader), DeregisterProofMessage(pubKey, ts))
+}
+
+// verifyPeerProof checks a base64 proof of msg from peerKey whose timestamp
+// is within proofMaxSkew of now.
+func (a *API) verifyPeerProof(peerKey [crypto.KeySize]byte, ts int64, proofB64 string, msg []byte) bool {
+	proof, err := base64.StdEncoding.DecodeString(proofB64)
+	if err != nil || len(proof) == 0 {
+		return false
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > proofMaxSkew || skew < -proofMaxSkew {
+		return false
+	}
+	return crypto.VerifyProof(a.serverPrivateKey, peerKey, msg, proof)
+}
+
+// truncateKey shortens a public key for logging.
+func truncateKey(key string) string {
+	if len(key) > 8 {
+		return key[:8]
+	}
+	return key
+}
+
+// ListenAndServe starts the API server over plain HTTP.
+func (a *API) ListenAndServe(addr string) error {
+	a.newServer(addr)
+	log.Println("WARNING: API server is not using TLS; API keys and registration responses travel in cleartext.")
+	log.Printf("API server listening on %s", addr)
+	return a.server.ListenAndServe()
+}
+
+// ListenAndServeTLS starts the API server over HTTPS using cert.
+func (a *API) ListenAndServeTLS(addr string, cert tls.Certificate) error {
+	a.newServer(addr)
+	a.server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	log.Printf("API server listening on %s (TLS)", addr)
+	return a.server.ListenAndServeTLS("", "")
+}
+
+func (a *API) newServer(addr string) {
+	if a.apiKey == "" && a.tokens == nil {
+		log.Println("WARNING: API server starting without authentication. Set api_key or token_file in config to require auth.")
 	}
 	a.server = &http.Server{
 		Addr:              addr,
@@ -161,8 +435,6 @@ func (a *API) ListenAndServe(addr string) error {
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
-	log.Printf("API server listening on %s", addr)
-	return a.server.ListenAndServe()
 }
 
 // Shutdown gracefully stops the API server.
@@ -2,11 +2,16 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gavsh/ShikVPN/internal/crypto"
 	"github.com/gavsh/ShikVPN/internal/tunnel"
@@ -19,8 +24,13 @@ func setupTestAPI(t *testing.T) (*API, *httptest.Server) {
 
 func setupTestAPIWithKey(t *testing.T, apiKey string) (*API, *httptest.Server) {
 	t.Helper()
+	return setupTestAPIWithAuth(t, apiKey, nil)
+}
+
+func setupTestAPIWithAuth(t *testing.T, apiKey string, tokens *TokenStore) (*API, *httptest.Server) {
+	t.Helper()
 
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -32,16 +42,45 @@ func setupTestAPIWithKey(t *testing.T, apiKey string) (*API, *httptest.Server) {
 	}
 
 	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
 
-	api := NewAPI(ipam, crypto.KeyToBase64(kp.PublicKey), "1.2.3.4:51820",
-		[]string{"1.1.1.1"}, 1420, apiKey, noop)
+	api := NewAPI(ipam, kp.PrivateKey, crypto.KeyToBase64(kp.PublicKey), "1.2.3.4:51820",
+		[]string{"1.1.1.1"}, nil, 1420, apiKey, tokens, noop, noopRemove)
 
 	server := httptest.NewServer(api.Handler())
 	return api, server
 }
 
+// registerBody returns a registration request for kp with a valid proof of key possession.
+func registerBody(t *testing.T, api *API, kp *crypto.KeyPair) []byte {
+	t.Helper()
+	return registerBodyAt(t, api, kp, "", time.Now().Unix())
+}
+
+// registerBodyAt is registerBody with an explicit nonce and proof timestamp.
+func registerBodyAt(t *testing.T, api *API, kp *crypto.KeyPair, nonce string, ts int64) []byte {
+	t.Helper()
+
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	serverPub, err := crypto.KeyFromBase64(api.serverPublicKey)
+	if err != nil {
+		t.Fatalf("invalid server public key: %v", err)
+	}
+	proof, err := crypto.ComputeProof(kp.PrivateKey, serverPub, RegisterProofMessage(pubKey, nonce, ts))
+	if err != nil {
+		t.Fatalf("ComputeProof() error: %v", err)
+	}
+	body, _ := json.Marshal(RegisterRequest{
+		PublicKey: pubKey,
+		Nonce:     nonce,
+		Timestamp: ts,
+		Proof:     base64.StdEncoding.EncodeToString(proof),
+	})
+	return body
+}
+
 func TestRegisterValidRequest(t *testing.T) {
-	_, server := setupTestAPI(t)
+	api, server := setupTestAPI(t)
 	defer server.Close()
 
 	kp, err := crypto.GenerateKeyPair()
@@ -49,9 +88,7 @@ func TestRegisterValidRequest(t *testing.T) {
 		t.Fatalf("GenerateKeyPair() error: %v", err)
 	}
 
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 
 	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
 		bytes.NewReader(reqBody))
@@ -83,6 +120,111 @@ func TestRegisterValidRequest(t *testing.T) {
 	}
 }
 
+func TestRegisterResponseIsSigned(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+	reqBody := registerBodyAt(t, api, kp, "bm9uY2U=", time.Now().Unix())
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(ServerSignatureHeader))
+	if err != nil || len(sig) == 0 {
+		t.Fatalf("missing or malformed %s header", ServerSignatureHeader)
+	}
+	serverPub, _ := crypto.KeyFromBase64(api.serverPublicKey)
+	if !crypto.VerifyProof(kp.PrivateKey, serverPub, RegisterResponseMessage(pubKey, "bm9uY2U=", body), sig) {
+		t.Error("signature does not verify against the server public key")
+	}
+	if crypto.VerifyProof(kp.PrivateKey, serverPub, RegisterResponseMessage(pubKey, "b3RoZXI=", body), sig) {
+		t.Error("signature verifies with a different nonce")
+	}
+}
+
+func TestRegisterRejectsMissingProof(t *testing.T) {
+	_, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody, _ := json.Marshal(RegisterRequest{PublicKey: crypto.KeyToBase64(kp.PublicKey)})
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestRegisterRejectsSomeoneElsesKey(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	// The attacker signs with their own key but claims the victim's public key
+	victim, _ := crypto.GenerateKeyPair()
+	attacker, _ := crypto.GenerateKeyPair()
+	var req RegisterRequest
+	json.Unmarshal(registerBody(t, api, attacker), &req)
+	req.PublicKey = crypto.KeyToBase64(victim.PublicKey)
+	reqBody, _ := json.Marshal(req)
+
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+	if _, ok := api.ipam.GetAllocation(req.PublicKey); ok {
+		t.Error("victim's key was allocated an IP")
+	}
+}
+
+func TestRegisterRejectsStaleProof(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody := registerBodyAt(t, api, kp, "", time.Now().Add(-time.Hour).Unix())
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestServerKeyEndpoint(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/server-key")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var keyResp ServerKeyResponse
+	json.NewDecoder(resp.Body).Decode(&keyResp)
+	if keyResp.ServerPublicKey != api.serverPublicKey {
+		t.Errorf("ServerPublicKey = %q, want %q", keyResp.ServerPublicKey, api.serverPublicKey)
+	}
+}
+
 func TestRegisterMissingPubkey(t *testing.T) {
 	_, server := setupTestAPI(t)
 	defer server.Close()
@@ -117,14 +259,12 @@ func TestRegisterMethodNotAllowed(t *testing.T) {
 }
 
 func TestRegisterTwoDifferentClients(t *testing.T) {
-	_, server := setupTestAPI(t)
+	api, server := setupTestAPI(t)
 	defer server.Close()
 
 	// Register first client
 	kp1, _ := crypto.GenerateKeyPair()
-	reqBody1, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp1.PublicKey),
-	})
+	reqBody1 := registerBody(t, api, kp1)
 	resp1, err := http.Post(server.URL+"/api/v1/register", "application/json",
 		bytes.NewReader(reqBody1))
 	if err != nil {
@@ -137,9 +277,7 @@ func TestRegisterTwoDifferentClients(t *testing.T) {
 
 	// Register second client
 	kp2, _ := crypto.GenerateKeyPair()
-	reqBody2, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp2.PublicKey),
-	})
+	reqBody2 := registerBody(t, api, kp2)
 	resp2, err := http.Post(server.URL+"/api/v1/register", "application/json",
 		bytes.NewReader(reqBody2))
 	if err != nil {
@@ -156,13 +294,11 @@ func TestRegisterTwoDifferentClients(t *testing.T) {
 }
 
 func TestRegisterReturnsIPInSubnet(t *testing.T) {
-	_, server := setupTestAPI(t)
+	api, server := setupTestAPI(t)
 	defer server.Close()
 
 	kp, _ := crypto.GenerateKeyPair()
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
 		bytes.NewReader(reqBody))
 	if err != nil {
@@ -180,16 +316,112 @@ func TestRegisterReturnsIPInSubnet(t *testing.T) {
 	if !strings.HasSuffix(regResp.AssignedIP, "/24") {
 		t.Errorf("AssignedIP %s should have /24 suffix", regResp.AssignedIP)
 	}
+	if regResp.Gateway != "10.0.0.1" {
+		t.Errorf("Gateway = %q, want 10.0.0.1", regResp.Gateway)
+	}
+}
+
+func TestRegisterReturnsIPv6WhenDualStack(t *testing.T) {
+	ipam, err := NewDualStackIPAM("10.0.0.1/24", "fd00::1/64", nil)
+	if err != nil {
+		t.Fatalf("NewDualStackIPAM() error: %v", err)
+	}
+	serverKP, _ := crypto.GenerateKeyPair()
+
+	var added tunnel.PeerConfig
+	onAdd := func(peer tunnel.PeerConfig) error { added = peer; return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := NewAPI(ipam, serverKP.PrivateKey, crypto.KeyToBase64(serverKP.PublicKey), "1.2.3.4:51820",
+		nil, nil, 1420, "", nil, onAdd, noopRemove)
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody := registerBody(t, api, kp)
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var regResp RegisterResponse
+	json.NewDecoder(resp.Body).Decode(&regResp)
+
+	if regResp.AssignedIP6 != "fd00::2/64" {
+		t.Errorf("AssignedIP6 = %q, want fd00::2/64", regResp.AssignedIP6)
+	}
+	if len(added.AllowedIPs) != 2 || added.AllowedIPs[1] != "fd00::2/128" {
+		t.Errorf("peer AllowedIPs = %v, want IPv4 and fd00::2/128", added.AllowedIPs)
+	}
+}
+
+func TestRegisterReturnsPrefixAndGatewayForNon24Subnet(t *testing.T) {
+	ipam, err := NewIPAM("10.8.0.254/22", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	serverKP, _ := crypto.GenerateKeyPair()
+	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := NewAPI(ipam, serverKP.PrivateKey, crypto.KeyToBase64(serverKP.PublicKey), "1.2.3.4:51820",
+		nil, nil, 1420, "", nil, noop, noopRemove)
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody := registerBody(t, api, kp)
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var regResp RegisterResponse
+	json.NewDecoder(resp.Body).Decode(&regResp)
+
+	if !strings.HasSuffix(regResp.AssignedIP, "/22") {
+		t.Errorf("AssignedIP %s should have /22 suffix", regResp.AssignedIP)
+	}
+	if regResp.Gateway != "10.8.0.254" {
+		t.Errorf("Gateway = %q, want 10.8.0.254", regResp.Gateway)
+	}
+}
+
+func TestRegisterReturnsPushedRoutes(t *testing.T) {
+	ipam, _ := NewIPAM("10.0.0.1/24", nil)
+	serverKP, _ := crypto.GenerateKeyPair()
+	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := NewAPI(ipam, serverKP.PrivateKey, crypto.KeyToBase64(serverKP.PublicKey), "1.2.3.4:51820",
+		nil, []string{"10.20.0.0/16", "192.168.5.0/24"}, 1420, "", nil, noop, noopRemove)
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody := registerBody(t, api, kp)
+	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var regResp RegisterResponse
+	json.NewDecoder(resp.Body).Decode(&regResp)
+
+	if len(regResp.Routes) != 2 || regResp.Routes[0] != "10.20.0.0/16" || regResp.Routes[1] != "192.168.5.0/24" {
+		t.Errorf("Routes = %v, want [10.20.0.0/16 192.168.5.0/24]", regResp.Routes)
+	}
 }
 
 func TestRegisterWithAPIKeyValid(t *testing.T) {
-	_, server := setupTestAPIWithKey(t, "test-secret-key")
+	api, server := setupTestAPIWithKey(t, "test-secret-key")
 	defer server.Close()
 
 	kp, _ := crypto.GenerateKeyPair()
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 
 	req, _ := http.NewRequest("POST", server.URL+"/api/v1/register", bytes.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
@@ -207,13 +439,11 @@ func TestRegisterWithAPIKeyValid(t *testing.T) {
 }
 
 func TestRegisterWithAPIKeyMissing(t *testing.T) {
-	_, server := setupTestAPIWithKey(t, "test-secret-key")
+	api, server := setupTestAPIWithKey(t, "test-secret-key")
 	defer server.Close()
 
 	kp, _ := crypto.GenerateKeyPair()
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 
 	// No X-API-Key header
 	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
@@ -229,13 +459,11 @@ func TestRegisterWithAPIKeyMissing(t *testing.T) {
 }
 
 func TestRegisterWithAPIKeyWrong(t *testing.T) {
-	_, server := setupTestAPIWithKey(t, "test-secret-key")
+	api, server := setupTestAPIWithKey(t, "test-secret-key")
 	defer server.Close()
 
 	kp, _ := crypto.GenerateKeyPair()
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 
 	req, _ := http.NewRequest("POST", server.URL+"/api/v1/register", bytes.NewReader(reqBody))
 	req.Header.Set("Content-Type", "application/json")
@@ -254,13 +482,11 @@ func TestRegisterWithAPIKeyWrong(t *testing.T) {
 
 func TestRegisterNoAPIKeyConfigured(t *testing.T) {
 	// When no API key is configured, requests without a key should succeed
-	_, server := setupTestAPI(t) // no API key
+	api, server := setupTestAPI(t) // no API key
 	defer server.Close()
 
 	kp, _ := crypto.GenerateKeyPair()
-	reqBody, _ := json.Marshal(RegisterRequest{
-		PublicKey: crypto.KeyToBase64(kp.PublicKey),
-	})
+	reqBody := registerBody(t, api, kp)
 
 	resp, err := http.Post(server.URL+"/api/v1/register", "application/json",
 		bytes.NewReader(reqBody))
@@ -273,3 +499,298 @@ func TestRegisterNoAPIKeyConfigured(t *testing.T) {
 		t.Errorf("status = %d, want 200 (no auth configured)", resp.StatusCode)
 	}
 }
+
+// registerStatus posts a registration for a fresh keypair with apiKey and returns the status code.
+func registerStatus(t *testing.T, api *API, serverURL, apiKey string) int {
+	t.Helper()
+
+	kp, _ := crypto.GenerateKeyPair()
+	req, _ := http.NewRequest("POST", serverURL+"/api/v1/register", bytes.NewReader(registerBody(t, api, kp)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegisterWithToken(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	secret, _ := tokens.Issue("alice", []string{ScopeRegister}, time.Time{}, 0)
+	api, server := setupTestAPIWithAuth(t, "shared-key", tokens)
+	defer server.Close()
+
+	kp := registerTestPeer(t, api, server.URL, secret)
+	if got := api.ipam.Token(crypto.KeyToBase64(kp.PublicKey)); got != "alice" {
+		t.Errorf("peer token = %q, want alice", got)
+	}
+
+	// The shared key still works and leaves peers untagged
+	kp = registerTestPeer(t, api, server.URL, "shared-key")
+	if got := api.ipam.Token(crypto.KeyToBase64(kp.PublicKey)); got != "" {
+		t.Errorf("peer token = %q, want empty for shared key", got)
+	}
+}
+
+func TestRegisterTokenRequiredWithoutAPIKey(t *testing.T) {
+	api, server := setupTestAPIWithAuth(t, "", newTestTokenStore(t))
+	defer server.Close()
+
+	if got := registerStatus(t, api, server.URL, ""); got != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 without a token", got)
+	}
+}
+
+func TestRegisterWithUnusableToken(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	revoked, _ := tokens.Issue("revoked", []string{ScopeRegister}, time.Time{}, 0)
+	tokens.Revoke("revoked")
+	expired, _ := tokens.Issue("expired", []string{ScopeRegister}, time.Now().Add(-time.Minute), 0)
+	adminOnly, _ := tokens.Issue("admin", []string{ScopeAdmin}, time.Time{}, 0)
+
+	api, server := setupTestAPIWithAuth(t, "", tokens)
+	defer server.Close()
+
+	for name, secret := range map[string]string{"revoked": revoked, "expired": expired, "admin only": adminOnly} {
+		if got := registerStatus(t, api, server.URL, secret); got != http.StatusUnauthorized {
+			t.Errorf("%s token: status = %d, want 401", name, got)
+		}
+	}
+}
+
+func TestRegisterTokenPeerLimit(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	secret, _ := tokens.Issue("phone", []string{ScopeRegister}, time.Time{}, 1)
+	api, server := setupTestAPIWithAuth(t, "", tokens)
+	defer server.Close()
+
+	registerTestPeer(t, api, server.URL, secret)
+	if got := registerStatus(t, api, server.URL, secret); got != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 over the peer limit", got)
+	}
+}
+
+func TestRegisterWithInvite(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	code, _ := tokens.IssueInvite("erin", time.Now().Add(time.Hour))
+	api, server := setupTestAPIWithAuth(t, "", tokens)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/register", bytes.NewReader(registerBody(t, api, kp)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", code)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var regResp RegisterResponse
+	json.NewDecoder(resp.Body).Decode(&regResp)
+	if !strings.HasPrefix(regResp.APIToken, tokenPrefix) {
+		t.Fatalf("api_token = %q, want a new token", regResp.APIToken)
+	}
+	if got := api.ipam.Token(crypto.KeyToBase64(kp.PublicKey)); got != "erin" {
+		t.Errorf("peer token = %q, want erin", got)
+	}
+
+	// The invite is consumed; the issued token works in its place
+	if got := registerStatus(t, api, server.URL, code); got != http.StatusUnauthorized {
+		t.Errorf("reused invite: status = %d, want 401", got)
+	}
+	req, _ = http.NewRequest("POST", server.URL+"/api/v1/register", bytes.NewReader(registerBody(t, api, kp)))
+	req.Header.Set("X-API-Key", regResp.APIToken)
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		t.Errorf("re-registration with issued token: status = %d, want 200", resp2.StatusCode)
+	}
+}
+
+func TestRegisterWithRedeemedInviteRollsBack(t *testing.T) {
+	tokens := newTestTokenStore(t)
+	code, _ := tokens.IssueInvite("erin", time.Now().Add(time.Hour))
+
+	ipam, _ := NewIPAM("10.0.0.1/24", nil)
+	kp, _ := crypto.GenerateKeyPair()
+	var removed []string
+	// Another client redeems the invite while this one is being added
+	onAdd := func(peer tunnel.PeerConfig) error {
+		_, err := tokens.Redeem("erin")
+		return err
+	}
+	onRemove := func(publicKeyHex string) error {
+		removed = append(removed, publicKeyHex)
+		return nil
+	}
+	api := NewAPI(ipam, kp.PrivateKey, crypto.KeyToBase64(kp.PublicKey), "1.2.3.4:51820",
+		nil, nil, 1420, "", tokens, onAdd, onRemove)
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	peer, _ := crypto.GenerateKeyPair()
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/register", bytes.NewReader(registerBody(t, api, peer)))
+	req.Header.Set("X-API-Key", code)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", resp.StatusCode)
+	}
+
+	if _, ok := ipam.GetAllocation(crypto.KeyToBase64(peer.PublicKey)); ok {
+		t.Error("losing peer kept its IPAM allocation")
+	}
+	if len(removed) != 1 || removed[0] != crypto.KeyToHex(peer.PublicKey) {
+		t.Errorf("removed peers = %v, want the losing peer", removed)
+	}
+}
+
+// registerTestPeer registers a fresh keypair and returns it.
+func registerTestPeer(t *testing.T, api *API, serverURL, apiKey string) *crypto.KeyPair {
+	t.Helper()
+
+	kp, _ := crypto.GenerateKeyPair()
+	reqBody := registerBody(t, api, kp)
+	req, _ := http.NewRequest("POST", serverURL+"/api/v1/register", bytes.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register status = %d, want 200", resp.StatusCode)
+	}
+	return kp
+}
+
+// newDeregisterRequest builds a DELETE request for the peer, signed with signer's private key.
+func newDeregisterRequest(t *testing.T, api *API, serverURL string, peer, signer *crypto.KeyPair) *http.Request {
+	t.Helper()
+
+	pubKey := crypto.KeyToBase64(peer.PublicKey)
+	serverPub, _ := crypto.KeyFromBase64(api.serverPublicKey)
+	ts := time.Now().Unix()
+	proof, err := crypto.ComputeProof(signer.PrivateKey, serverPub, DeregisterProofMessage(pubKey, ts))
+	if err != nil {
+		t.Fatalf("ComputeProof() error: %v", err)
+	}
+
+	req, _ := http.NewRequest("DELETE", serverURL+"/api/v1/peers/"+url.PathEscape(pubKey), nil)
+	req.Header.Set(PeerTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(PeerProofHeader, base64.StdEncoding.EncodeToString(proof))
+	return req
+}
+
+func TestDeregisterWithPeerProof(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp := registerTestPeer(t, api, server.URL, "")
+	resp, err := http.DefaultClient.Do(newDeregisterRequest(t, api, server.URL, kp, kp))
+	if err != nil {
+		t.Fatalf("DELETE error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+	if _, ok := api.ipam.GetAllocation(crypto.KeyToBase64(kp.PublicKey)); ok {
+		t.Error("allocation still present after deregistration")
+	}
+}
+
+func TestDeregisterWithWrongProof(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	victim := registerTestPeer(t, api, server.URL, "")
+	attacker, _ := crypto.GenerateKeyPair()
+
+	resp, err := http.DefaultClient.Do(newDeregisterRequest(t, api, server.URL, victim, attacker))
+	if err != nil {
+		t.Fatalf("DELETE error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+	if _, ok := api.ipam.GetAllocation(crypto.KeyToBase64(victim.PublicKey)); !ok {
+		t.Error("victim allocation was released by an unauthorized request")
+	}
+}
+
+func TestDeregisterWithAPIKey(t *testing.T) {
+	api, server := setupTestAPIWithKey(t, "test-secret-key")
+	defer server.Close()
+
+	kp := registerTestPeer(t, api, server.URL, "test-secret-key")
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/peers/"+url.PathEscape(pubKey), nil)
+	req.Header.Set("X-API-Key", "test-secret-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+	if _, ok := api.ipam.GetAllocation(pubKey); ok {
+		t.Error("allocation still present after deregistration")
+	}
+}
+
+func TestDeregisterWithoutAuth(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp := registerTestPeer(t, api, server.URL, "")
+	pubKey := crypto.KeyToBase64(kp.PublicKey)
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/peers/"+url.PathEscape(pubKey), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestDeregisterUnknownPeer(t *testing.T) {
+	api, server := setupTestAPI(t)
+	defer server.Close()
+
+	kp, _ := crypto.GenerateKeyPair()
+	resp, err := http.DefaultClient.Do(newDeregisterRequest(t, api, server.URL, kp, kp))
+	if err != nil {
+		t.Fatalf("DELETE error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
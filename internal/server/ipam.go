@@ -2,8 +2,13 @@ package server
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
 )
 
@@ -14,14 +19,27 @@ type IPAM struct {
 	gateway   net.IP
 	allocated map[string]net.IP // pubkey -> assigned IP
 	used      map[string]string // IP string -> pubkey
+	static    map[string]bool   // pubkeys whose IP is pinned by an operator
+	released  map[string]bool   // pinned pubkeys released since, whose peer is not on the device
+	tokens    map[string]string // pubkey -> name of the API token that registered it
 	nextHost  uint32            // next host number to try (starts at 2)
+	v6        *pool6            // optional IPv6 pool for dual-stack tunnels
+	store     *PeerStore        // optional; nil keeps allocations in memory only
 }
 
 // maxIPAMPrefix is the minimum prefix length allowed (prevents huge iteration).
 const maxIPAMPrefix = 16
 
 // NewIPAM creates a new IP allocator for the given CIDR (e.g., "10.0.0.1/24").
-func NewIPAM(cidr string) (*IPAM, error) {
+// If store is non-nil, previously persisted allocations are loaded from it and
+// every subsequent change is written back.
+func NewIPAM(cidr string, store *PeerStore) (*IPAM, error) {
+	return NewDualStackIPAM(cidr, "", store)
+}
+
+// NewDualStackIPAM creates an allocator that hands out an IPv4 address from
+// cidr and, if cidr6 is non-empty, an IPv6 address from cidr6 to every peer.
+func NewDualStackIPAM(cidr, cidr6 string, store *PeerStore) (*IPAM, error) {
 	ip, network, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
@@ -32,25 +50,161 @@ func NewIPAM(cidr string) (*IPAM, error) {
 		return nil, fmt.Errorf("subnet /%d is too large; minimum prefix length is /%d", ones, maxIPAMPrefix)
 	}
 
-	return &IPAM{
+	m := &IPAM{
 		network:   network,
 		gateway:   ip.To4(),
 		allocated: make(map[string]net.IP),
 		used:      make(map[string]string),
+		static:    make(map[string]bool),
+		released:  make(map[string]bool),
+		tokens:    make(map[string]string),
 		nextHost:  2, // skip .0 (network) and .1 (gateway)
-	}, nil
+		store:     store,
+	}
+
+	if cidr6 != "" {
+		if m.v6, err = newPool6(cidr6); err != nil {
+			return nil, err
+		}
+	}
+
+	if store != nil {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// load restores allocations from the peer store, skipping records that no
+// longer fit the configured subnet.
+func (m *IPAM) load() error {
+	records, err := m.store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		ip := net.ParseIP(rec.IP).To4()
+		if ip == nil || !m.isUsable(ip) {
+			log.Printf("Warning: dropping stored allocation %s for peer outside subnet %s", rec.IP, m.network.String())
+			continue
+		}
+		if _, ok := m.used[ip.String()]; ok {
+			log.Printf("Warning: dropping duplicate stored allocation %s", rec.IP)
+			continue
+		}
+		if _, ok := m.allocated[rec.PublicKey]; ok {
+			log.Printf("Warning: dropping duplicate stored peer with IP %s", rec.IP)
+			continue
+		}
+		m.allocated[rec.PublicKey] = ip
+		m.used[ip.String()] = rec.PublicKey
+		if rec.Static {
+			m.static[rec.PublicKey] = true
+			if rec.Released {
+				m.released[rec.PublicKey] = true
+			}
+		}
+		if rec.Token != "" {
+			m.tokens[rec.PublicKey] = rec.Token
+		}
+
+		if m.v6 != nil && rec.IP6 != "" {
+			addr, err := netip.ParseAddr(rec.IP6)
+			if err != nil || !m.v6.restore(rec.PublicKey, addr) {
+				log.Printf("Warning: dropping stored IPv6 allocation %s outside subnet %s", rec.IP6, m.v6.prefix.String())
+			}
+		}
+	}
+
+	// Peers stored before IPv6 was enabled get an IPv6 address now
+	if m.v6 != nil {
+		for pubKey := range m.allocated {
+			if _, err := m.v6.allocate(pubKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isUsable reports whether ip is a host address in the subnet other than the
+// network, broadcast, or gateway address.
+func (m *IPAM) isUsable(ip net.IP) bool {
+	if !m.network.Contains(ip) || ip.Equal(m.gateway) {
+		return false
+	}
+	ones, bits := m.network.Mask.Size()
+	hostMask := uint32(1)<<uint(bits-ones) - 1
+	host := binary.BigEndian.Uint32(ip) & hostMask
+	return host != 0 && host != hostMask
+}
+
+// persist writes the current allocations to the store. Must be called with mu held.
+func (m *IPAM) persist() error {
+	if m.store == nil {
+		return nil
+	}
+	records := make([]PeerRecord, 0, len(m.allocated))
+	for pubKey, ip := range m.allocated {
+		rec := PeerRecord{PublicKey: pubKey, IP: ip.String(), Static: m.static[pubKey], Released: m.released[pubKey], Token: m.tokens[pubKey]}
+		if m.v6 != nil {
+			if ip6, ok := m.v6.lookup(pubKey); ok {
+				rec.IP6 = ip6.String()
+			}
+		}
+		records = append(records, rec)
+	}
+	return m.store.Save(records)
 }
 
+// ErrPeerLimit is returned when an API token already has its maximum number of peers.
+var ErrPeerLimit = errors.New("token peer limit reached")
+
+// ErrPoolExhausted is returned when every address in the VPN subnet is taken.
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
 // Allocate assigns an IP address to the given public key.
 // If the key already has an allocation, the same IP is returned (idempotent).
 func (m *IPAM) Allocate(pubKey string) (net.IP, error) {
+	return m.AllocateForToken(pubKey, "", 0)
+}
+
+// AllocateForToken assigns an IP address to the given public key and tags the
+// peer with the API token that registered it. If maxPeers is positive and the
+// token already owns that many other peers, ErrPeerLimit is returned.
+// Re-registering an existing peer returns its current IP.
+func (m *IPAM) AllocateForToken(pubKey, token string, maxPeers int) (net.IP, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if ip, ok := m.allocated[pubKey]; ok {
+		prevToken := m.tokens[pubKey]
+		wasReleased := m.released[pubKey]
+		if prevToken == token && !wasReleased {
+			return ip, nil
+		}
+		if prevToken != token && token != "" && maxPeers > 0 && m.countToken(token) >= maxPeers {
+			return nil, ErrPeerLimit
+		}
+		m.setToken(pubKey, token)
+		delete(m.released, pubKey)
+		if err := m.persist(); err != nil {
+			m.setToken(pubKey, prevToken)
+			if wasReleased {
+				m.released[pubKey] = true
+			}
+			return nil, fmt.Errorf("failed to persist allocation: %w", err)
+		}
 		return ip, nil
 	}
 
+	if token != "" && maxPeers > 0 && m.countToken(token) >= maxPeers {
+		return nil, ErrPeerLimit
+	}
+
 	ip, err := m.findAvailable()
 	if err != nil {
 		return nil, err
@@ -58,17 +212,106 @@ func (m *IPAM) Allocate(pubKey string) (net.IP, error) {
 
 	m.allocated[pubKey] = ip
 	m.used[ip.String()] = pubKey
+	m.setToken(pubKey, token)
+
+	if m.v6 != nil {
+		if _, err := m.v6.allocate(pubKey); err != nil {
+			delete(m.used, ip.String())
+			delete(m.allocated, pubKey)
+			delete(m.tokens, pubKey)
+			return nil, err
+		}
+	}
+
+	if err := m.persist(); err != nil {
+		delete(m.used, ip.String())
+		delete(m.allocated, pubKey)
+		delete(m.tokens, pubKey)
+		if m.v6 != nil {
+			m.v6.release(pubKey)
+		}
+		return nil, fmt.Errorf("failed to persist allocation: %w", err)
+	}
 	return ip, nil
 }
 
+// countToken returns how many peers are tagged with token. Must be called with mu held.
+func (m *IPAM) countToken(token string) int {
+	n := 0
+	for _, t := range m.tokens {
+		if t == token {
+			n++
+		}
+	}
+	return n
+}
+
+// setToken tags or untags a peer. Must be called with mu held.
+func (m *IPAM) setToken(pubKey, token string) {
+	if token == "" {
+		delete(m.tokens, pubKey)
+		return
+	}
+	m.tokens[pubKey] = token
+}
+
+// Token returns the name of the API token that registered the peer, if any.
+func (m *IPAM) Token(pubKey string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens[pubKey]
+}
+
+// PeersForToken returns the public keys of all peers registered with token.
+func (m *IPAM) PeersForToken(token string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for pubKey, t := range m.tokens {
+		if t == token {
+			keys = append(keys, pubKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Release frees the IP allocated to the given public key.
+// Pinned allocations keep their IP, but are marked released so that the peer
+// is not restored to the device on restart; registering again or re-pinning
+// undoes that. Unpinning a released allocation frees it.
 func (m *IPAM) Release(pubKey string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.static[pubKey] {
+		if m.released[pubKey] {
+			return
+		}
+		m.released[pubKey] = true
+		if err := m.persist(); err != nil {
+			log.Printf("Warning: failed to persist release of pinned peer: %v", err)
+		}
+		return
+	}
+	m.release(pubKey)
+}
+
+// release frees the IP allocated to the given public key. Must be called with
+// mu held.
+func (m *IPAM) release(pubKey string) {
 	if ip, ok := m.allocated[pubKey]; ok {
 		delete(m.used, ip.String())
 		delete(m.allocated, pubKey)
+		delete(m.tokens, pubKey)
+		if m.v6 != nil {
+			m.v6.release(pubKey)
+		}
+
+		if err := m.persist(); err != nil {
+			log.Printf("Warning: failed to persist release of %s: %v", ip.String(), err)
+		}
 	}
 }
 
@@ -81,6 +324,197 @@ func (m *IPAM) GetAllocation(pubKey string) (net.IP, bool) {
 	return ip, ok
 }
 
+// Pin reserves a specific IP for the given public key, replacing any existing
+// allocation. A pinned allocation survives Release until it is unpinned.
+// It returns the previously allocated IP, if any.
+func (m *IPAM) Pin(pubKey string, ip net.IP) (net.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ip = ip.To4()
+	if ip == nil || !m.isUsable(ip) {
+		return nil, fmt.Errorf("IP %v is not a usable host address in subnet %s", ip, m.network.String())
+	}
+	if owner, ok := m.used[ip.String()]; ok && owner != pubKey {
+		return nil, fmt.Errorf("IP %s is already allocated to another peer", ip.String())
+	}
+
+	prevIP, hadPrev := m.allocated[pubKey]
+	wasStatic := m.static[pubKey]
+	wasReleased := m.released[pubKey]
+	if hadPrev {
+		delete(m.used, prevIP.String())
+	}
+	m.allocated[pubKey] = ip
+	m.used[ip.String()] = pubKey
+	m.static[pubKey] = true
+	delete(m.released, pubKey)
+
+	// A newly pinned peer also needs its IPv6 address
+	if m.v6 != nil {
+		if _, err := m.v6.allocate(pubKey); err != nil {
+			log.Printf("Warning: failed to allocate IPv6 address for pinned peer: %v", err)
+		}
+	}
+
+	if err := m.persist(); err != nil {
+		// Roll back to the previous state
+		delete(m.used, ip.String())
+		if hadPrev {
+			m.allocated[pubKey] = prevIP
+			m.used[prevIP.String()] = pubKey
+		} else {
+			delete(m.allocated, pubKey)
+			if m.v6 != nil {
+				m.v6.release(pubKey)
+			}
+		}
+		if !wasStatic {
+			delete(m.static, pubKey)
+		}
+		if wasReleased {
+			m.released[pubKey] = true
+		}
+		return nil, fmt.Errorf("failed to persist pinned allocation: %w", err)
+	}
+	return prevIP, nil
+}
+
+// Unpin turns a pinned allocation back into a regular one. The peer keeps its
+// current IP until it is released, or loses it now if it already was. It
+// reports whether the key was pinned.
+func (m *IPAM) Unpin(pubKey string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.static[pubKey] {
+		return false
+	}
+	delete(m.static, pubKey)
+	if m.released[pubKey] {
+		delete(m.released, pubKey)
+		m.release(pubKey)
+		return true
+	}
+
+	if err := m.persist(); err != nil {
+		log.Printf("Warning: failed to persist unpin: %v", err)
+	}
+	return true
+}
+
+// GetAllocation6 returns the IPv6 address allocated to the given public key, if any.
+func (m *IPAM) GetAllocation6(pubKey string) (net.IP, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.v6 == nil {
+		return nil, false
+	}
+	return m.v6.lookup(pubKey)
+}
+
+// AllowedIPs returns the WireGuard allowed IPs (host routes) for the peer's
+// allocated addresses, or nil if the key has no allocation.
+func (m *IPAM) AllowedIPs(pubKey string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ip, ok := m.allocated[pubKey]
+	if !ok {
+		return nil
+	}
+	allowed := []string{ip.String() + "/32"}
+	if m.v6 != nil {
+		if ip6, ok := m.v6.lookup(pubKey); ok {
+			allowed = append(allowed, ip6.String()+"/128")
+		}
+	}
+	return allowed
+}
+
+// PrefixLen returns the IPv4 subnet prefix length.
+func (m *IPAM) PrefixLen() int {
+	ones, _ := m.network.Mask.Size()
+	return ones
+}
+
+// Gateway returns the server's own address in the IPv4 subnet.
+func (m *IPAM) Gateway() net.IP {
+	return m.gateway
+}
+
+// PrefixLen6 returns the IPv6 subnet prefix length, or 0 if IPv6 is disabled.
+func (m *IPAM) PrefixLen6() int {
+	if m.v6 == nil {
+		return 0
+	}
+	return m.v6.prefix.Bits()
+}
+
+// PoolSize returns how many IPv4 addresses the subnet can assign to peers:
+// every host address but the gateway.
+func (m *IPAM) PoolSize() int {
+	ones, bits := m.network.Mask.Size()
+	if bits-ones < 2 {
+		return 0
+	}
+	hostMask := uint32(1)<<uint(bits-ones) - 1
+	size := int(hostMask) - 1 // without the network and broadcast addresses
+	if host := binary.BigEndian.Uint32(m.gateway) & hostMask; host != 0 && host != hostMask {
+		size--
+	}
+	return size
+}
+
+// PoolSize6 returns how many IPv6 addresses the subnet can assign to peers,
+// or 0 if IPv6 is disabled. It is a float64 as large prefixes overflow int.
+func (m *IPAM) PoolSize6() float64 {
+	if m.v6 == nil {
+		return 0
+	}
+	// Every host but the subnet-router anycast and gateway addresses
+	return math.Ldexp(1, 128-m.v6.prefix.Bits()) - 2
+}
+
+// InUse returns how many IPv4 and IPv6 addresses are assigned.
+func (m *IPAM) InUse() (v4, v6 int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.v6 != nil {
+		v6 = len(m.v6.used)
+	}
+	return len(m.used), v6
+}
+
+// IsStatic reports whether the public key has a pinned allocation.
+func (m *IPAM) IsStatic(pubKey string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.static[pubKey]
+}
+
+// IsReleased reports whether the public key has a pinned allocation whose
+// peer was released from the device.
+func (m *IPAM) IsReleased(pubKey string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.released[pubKey]
+}
+
+// Allocations returns a snapshot of all current allocations (pubkey -> IP).
+func (m *IPAM) Allocations() map[string]net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]net.IP, len(m.allocated))
+	for pubKey, ip := range m.allocated {
+		out[pubKey] = ip
+	}
+	return out
+}
+
 func (m *IPAM) findAvailable() (net.IP, error) {
 	ones, bits := m.network.Mask.Size()
 	hostBits := uint(bits - ones)
@@ -118,5 +552,5 @@ func (m *IPAM) findAvailable() (net.IP, error) {
 		return candidate, nil
 	}
 
-	return nil, fmt.Errorf("no available IP addresses in subnet %s", m.network.String())
+	return nil, fmt.Errorf("no available IP addresses in subnet %s: %w", m.network.String(), ErrPoolExhausted)
 }
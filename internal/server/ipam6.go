@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// maxIPv6Prefix is the longest IPv6 prefix accepted for the VPN subnet.
+const maxIPv6Prefix = 120
+
+// pool6 allocates IPv6 host addresses sequentially from a prefix. It has no
+// broadcast address; the all-zero host (subnet-router anycast) and the
+// gateway are never handed out. Callers must hold the IPAM lock.
+type pool6 struct {
+	prefix    netip.Prefix
+	gateway   netip.Addr
+	allocated map[string]netip.Addr // pubkey -> assigned address
+	used      map[netip.Addr]string // address -> pubkey
+	next      netip.Addr            // next address to try
+}
+
+func newPool6(cidr string) (*pool6, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPv6 CIDR %q: %w", cidr, err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("%q is not an IPv6 prefix", cidr)
+	}
+	if prefix.Bits() > maxIPv6Prefix {
+		return nil, fmt.Errorf("IPv6 subnet /%d is too small; maximum prefix length is /%d", prefix.Bits(), maxIPv6Prefix)
+	}
+
+	return &pool6{
+		prefix:    prefix.Masked(),
+		gateway:   prefix.Addr(),
+		allocated: make(map[string]netip.Addr),
+		used:      make(map[netip.Addr]string),
+		next:      prefix.Masked().Addr().Next(),
+	}, nil
+}
+
+// usable reports whether addr may be assigned to a peer.
+func (p *pool6) usable(addr netip.Addr) bool {
+	return p.prefix.Contains(addr) && addr != p.prefix.Addr() && addr != p.gateway
+}
+
+// allocate returns the address for pubKey, assigning a new one if needed.
+func (p *pool6) allocate(pubKey string) (netip.Addr, error) {
+	if addr, ok := p.allocated[pubKey]; ok {
+		return addr, nil
+	}
+
+	// At most len(used)+1 candidates can be taken, plus the gateway and the
+	// wrap past the subnet-router address, so the scan is bounded.
+	candidate := p.next
+	for i := 0; i < len(p.used)+3; i++ {
+		if !p.prefix.Contains(candidate) {
+			candidate = p.prefix.Addr()
+		}
+		if p.usable(candidate) {
+			if _, taken := p.used[candidate]; !taken {
+				p.allocated[pubKey] = candidate
+				p.used[candidate] = pubKey
+				p.next = candidate.Next()
+				return candidate, nil
+			}
+		}
+		candidate = candidate.Next()
+	}
+
+	return netip.Addr{}, fmt.Errorf("no available IPv6 addresses in subnet %s: %w", p.prefix.String(), ErrPoolExhausted)
+}
+
+// restore records a previously persisted allocation, reporting whether it was accepted.
+func (p *pool6) restore(pubKey string, addr netip.Addr) bool {
+	if !p.usable(addr) {
+		return false
+	}
+	if _, taken := p.used[addr]; taken {
+		return false
+	}
+	p.allocated[pubKey] = addr
+	p.used[addr] = pubKey
+	return true
+}
+
+// release frees the address held by pubKey.
+func (p *pool6) release(pubKey string) {
+	if addr, ok := p.allocated[pubKey]; ok {
+		delete(p.used, addr)
+		delete(p.allocated, pubKey)
+	}
+}
+
+// lookup returns the address held by pubKey as a net.IP.
+func (p *pool6) lookup(pubKey string) (net.IP, bool) {
+	addr, ok := p.allocated[pubKey]
+	if !ok {
+		return nil, false
+	}
+	return net.IP(addr.AsSlice()), true
+}
@@ -1,13 +1,15 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"testing"
 )
 
 func TestIPAMAllocateFirst(t *testing.T) {
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -23,7 +25,7 @@ func TestIPAMAllocateFirst(t *testing.T) {
 }
 
 func TestIPAMAllocateSequential(t *testing.T) {
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -41,7 +43,7 @@ func TestIPAMAllocateSequential(t *testing.T) {
 }
 
 func TestIPAMIdempotent(t *testing.T) {
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -62,7 +64,7 @@ func TestIPAMIdempotent(t *testing.T) {
 }
 
 func TestIPAMRelease(t *testing.T) {
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -90,7 +92,7 @@ func TestIPAMRelease(t *testing.T) {
 func TestIPAMExhaust(t *testing.T) {
 	// Use a /29 subnet: 10.0.0.0/29 has IPs .0-.7
 	// .0 = network, .1 = gateway, .7 = broadcast → 5 usable (.2-.6)
-	ipam, err := NewIPAM("10.0.0.1/29")
+	ipam, err := NewIPAM("10.0.0.1/29", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -107,16 +109,51 @@ func TestIPAMExhaust(t *testing.T) {
 		allocated++
 	}
 
-	if lastErr == nil {
-		t.Error("expected error when exhausting subnet, got none")
+	if !errors.Is(lastErr, ErrPoolExhausted) {
+		t.Errorf("error when exhausting subnet = %v, want ErrPoolExhausted", lastErr)
 	}
-	if allocated < 1 {
-		t.Error("should have allocated at least one IP before exhaustion")
+	if allocated != ipam.PoolSize() {
+		t.Errorf("allocated %d IPs before exhaustion, want PoolSize() = %d", allocated, ipam.PoolSize())
+	}
+}
+
+func TestIPAMPoolUsage(t *testing.T) {
+	tests := []struct {
+		cidr, cidr6 string
+		size        int
+		size6       float64
+	}{
+		{"10.0.0.1/29", "", 5, 0},
+		{"10.0.0.1/24", "fd00::1/120", 253, 254},
+		{"10.0.0.0/24", "", 254, 0}, // the gateway is not a host address
+	}
+	for _, tt := range tests {
+		ipam, err := NewDualStackIPAM(tt.cidr, tt.cidr6, nil)
+		if err != nil {
+			t.Fatalf("NewDualStackIPAM(%q, %q) error: %v", tt.cidr, tt.cidr6, err)
+		}
+		if got := ipam.PoolSize(); got != tt.size {
+			t.Errorf("%s: PoolSize() = %d, want %d", tt.cidr, got, tt.size)
+		}
+		if got := ipam.PoolSize6(); got != tt.size6 {
+			t.Errorf("%s: PoolSize6() = %v, want %v", tt.cidr6, got, tt.size6)
+		}
+
+		ipam.Allocate("peer-a")
+		ipam.Allocate("peer-b")
+		ipam.Release("peer-a")
+		want6 := 0
+		if tt.cidr6 != "" {
+			want6 = 1
+		}
+		if v4, v6 := ipam.InUse(); v4 != 1 || v6 != want6 {
+			t.Errorf("%s: InUse() = %d, %d, want 1, %d", tt.cidr, v4, v6, want6)
+		}
 	}
 }
 
 func TestIPAMConcurrent(t *testing.T) {
-	ipam, err := NewIPAM("10.0.0.1/24")
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
 	if err != nil {
 		t.Fatalf("NewIPAM() error: %v", err)
 	}
@@ -160,3 +197,339 @@ func TestIPAMConcurrent(t *testing.T) {
 		seen[ip] = true
 	}
 }
+
+func TestIPAMPersistAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewPeerStore(dir)
+	if err != nil {
+		t.Fatalf("NewPeerStore() error: %v", err)
+	}
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+
+	ip1, _ := ipam.Allocate("pubkey1")
+	ip2, _ := ipam.Allocate("pubkey2")
+
+	// Simulate a restart with a fresh store and IPAM on the same directory
+	store2, err := NewPeerStore(dir)
+	if err != nil {
+		t.Fatalf("NewPeerStore() error: %v", err)
+	}
+	restored, err := NewIPAM("10.0.0.1/24", store2)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+
+	if got, ok := restored.GetAllocation("pubkey1"); !ok || !got.Equal(ip1) {
+		t.Errorf("pubkey1 restored as %v, want %s", got, ip1)
+	}
+	if got, ok := restored.GetAllocation("pubkey2"); !ok || !got.Equal(ip2) {
+		t.Errorf("pubkey2 restored as %v, want %s", got, ip2)
+	}
+
+	// New allocations must not collide with restored ones
+	ip3, err := restored.Allocate("pubkey3")
+	if err != nil {
+		t.Fatalf("Allocate() error: %v", err)
+	}
+	if ip3.Equal(ip1) || ip3.Equal(ip2) {
+		t.Errorf("new allocation %s collides with restored IP", ip3)
+	}
+}
+
+func TestIPAMReleasePersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	store, _ := NewPeerStore(dir)
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	ipam.Allocate("pubkey1")
+	ipam.Release("pubkey1")
+
+	restored, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if _, ok := restored.GetAllocation("pubkey1"); ok {
+		t.Error("released allocation was restored")
+	}
+}
+
+func TestIPAMLoadSkipsOutOfSubnet(t *testing.T) {
+	dir := t.TempDir()
+
+	store, _ := NewPeerStore(dir)
+	err := store.Save([]PeerRecord{
+		{PublicKey: "inside", IP: "10.0.0.7"},
+		{PublicKey: "outside", IP: "192.168.1.2"},
+		{PublicKey: "gateway", IP: "10.0.0.1"},
+		{PublicKey: "broadcast", IP: "10.0.0.255"},
+	})
+	if err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+
+	allocs := ipam.Allocations()
+	if len(allocs) != 1 {
+		t.Fatalf("restored %d allocations, want 1: %v", len(allocs), allocs)
+	}
+	if ip := allocs["inside"]; ip.String() != "10.0.0.7" {
+		t.Errorf("inside = %v, want 10.0.0.7", ip)
+	}
+}
+
+func TestPeerStoreMissingFile(t *testing.T) {
+	store, err := NewPeerStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewPeerStore() error: %v", err)
+	}
+	records, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("Load() returned %d records from missing file, want 0", len(records))
+	}
+}
+
+func TestIPAMPinPersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	store, _ := NewPeerStore(dir)
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	ipam.Allocate("pubkey1")
+
+	prev, err := ipam.Pin("pubkey1", net.ParseIP("10.0.0.100"))
+	if err != nil {
+		t.Fatalf("Pin() error: %v", err)
+	}
+	if prev.String() != "10.0.0.2" {
+		t.Errorf("Pin() previous IP = %v, want 10.0.0.2", prev)
+	}
+
+	// The old address is free again
+	if ip, _ := ipam.Allocate("pubkey2"); ip.String() == "10.0.0.100" {
+		t.Error("pinned IP was handed to another peer")
+	}
+
+	restored, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if !restored.IsStatic("pubkey1") {
+		t.Error("pin was not restored from store")
+	}
+	if ip, _ := restored.GetAllocation("pubkey1"); ip.String() != "10.0.0.100" {
+		t.Errorf("restored pinned IP = %v, want 10.0.0.100", ip)
+	}
+}
+
+func TestIPAMReleasePinnedPersisted(t *testing.T) {
+	store, _ := NewPeerStore(t.TempDir())
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if _, err := ipam.Pin("pubkey1", net.ParseIP("10.0.0.100")); err != nil {
+		t.Fatalf("Pin() error: %v", err)
+	}
+	ipam.Release("pubkey1")
+
+	// The pin keeps its IP, but the peer is marked as gone across restarts
+	restored, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if ip, _ := restored.GetAllocation("pubkey1"); ip.String() != "10.0.0.100" {
+		t.Errorf("released pinned IP = %v, want 10.0.0.100", ip)
+	}
+	if !restored.IsReleased("pubkey1") {
+		t.Error("release of pinned peer was not restored from store")
+	}
+	s := &Server{ipam: restored}
+	if peers := s.storedPeers(); len(peers) != 0 {
+		t.Errorf("storedPeers() = %v, want the released peer left off the device", peers)
+	}
+
+	// Registering again puts the peer back
+	if ip, err := restored.Allocate("pubkey1"); err != nil || ip.String() != "10.0.0.100" {
+		t.Fatalf("Allocate() = %v, %v, want the pinned 10.0.0.100", ip, err)
+	}
+	if restored.IsReleased("pubkey1") {
+		t.Error("peer still released after registering again")
+	}
+
+	// Unpinning a released peer frees its IP
+	restored.Release("pubkey1")
+	restored.Unpin("pubkey1")
+	if _, ok := restored.GetAllocation("pubkey1"); ok {
+		t.Error("allocation still present after unpinning a released peer")
+	}
+}
+
+func TestIPAMDualStackAllocate(t *testing.T) {
+	ipam, err := NewDualStackIPAM("10.0.0.1/24", "fd00::1/64", nil)
+	if err != nil {
+		t.Fatalf("NewDualStackIPAM() error: %v", err)
+	}
+
+	ipam.Allocate("pubkey1")
+	ipam.Allocate("pubkey2")
+
+	ip6, ok := ipam.GetAllocation6("pubkey2")
+	if !ok {
+		t.Fatal("pubkey2 has no IPv6 allocation")
+	}
+	if ip6.String() != "fd00::3" {
+		t.Errorf("second IPv6 allocation = %s, want fd00::3", ip6)
+	}
+
+	allowed := ipam.AllowedIPs("pubkey1")
+	want := []string{"10.0.0.2/32", "fd00::2/128"}
+	if fmt.Sprint(allowed) != fmt.Sprint(want) {
+		t.Errorf("AllowedIPs() = %v, want %v", allowed, want)
+	}
+	if ipam.PrefixLen6() != 64 {
+		t.Errorf("PrefixLen6() = %d, want 64", ipam.PrefixLen6())
+	}
+
+	// Releasing a peer frees both of its addresses
+	ipam.Release("pubkey1")
+	if _, ok := ipam.GetAllocation6("pubkey1"); ok {
+		t.Error("IPv6 allocation survived Release")
+	}
+}
+
+func TestIPAMDualStackInvalidPrefix(t *testing.T) {
+	for _, cidr := range []string{"10.1.0.1/24", "fd00::1/127", "not-a-cidr"} {
+		if _, err := NewDualStackIPAM("10.0.0.1/24", cidr, nil); err == nil {
+			t.Errorf("NewDualStackIPAM(%q) succeeded, want error", cidr)
+		}
+	}
+}
+
+func TestIPAMDualStackPersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	// Peers stored before IPv6 was enabled are given an IPv6 address on load
+	store, _ := NewPeerStore(dir)
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	ipam.Allocate("pubkey1")
+
+	upgraded, err := NewDualStackIPAM("10.0.0.1/24", "fd00::1/64", store)
+	if err != nil {
+		t.Fatalf("NewDualStackIPAM() error: %v", err)
+	}
+	first, ok := upgraded.GetAllocation6("pubkey1")
+	if !ok {
+		t.Fatal("existing peer was not given an IPv6 address")
+	}
+	upgraded.Allocate("pubkey2")
+
+	restored, err := NewDualStackIPAM("10.0.0.1/24", "fd00::1/64", store)
+	if err != nil {
+		t.Fatalf("NewDualStackIPAM() error: %v", err)
+	}
+	if ip6, _ := restored.GetAllocation6("pubkey1"); !ip6.Equal(first) {
+		t.Errorf("restored IPv6 = %v, want %s", ip6, first)
+	}
+	if ip6, _ := restored.GetAllocation6("pubkey2"); ip6.Equal(first) {
+		t.Errorf("pubkey2 restored with colliding IPv6 %v", ip6)
+	}
+}
+
+func TestIPAMNon24SubnetSkipsGateway(t *testing.T) {
+	ipam, err := NewIPAM("10.8.0.254/22", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if ipam.PrefixLen() != 22 {
+		t.Errorf("PrefixLen() = %d, want 22", ipam.PrefixLen())
+	}
+	if ipam.Gateway().String() != "10.8.0.254" {
+		t.Errorf("Gateway() = %s, want 10.8.0.254", ipam.Gateway())
+	}
+
+	// Allocations run past the first /24 and never hand out the gateway
+	for i := 0; i < 300; i++ {
+		ip, err := ipam.Allocate(fmt.Sprintf("pubkey%d", i))
+		if err != nil {
+			t.Fatalf("Allocate() error: %v", err)
+		}
+		if ip.String() == "10.8.0.254" {
+			t.Fatal("gateway address was allocated")
+		}
+	}
+}
+
+func TestIPAMAllocateForTokenLimit(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.1/24", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+
+	if _, err := ipam.AllocateForToken("pubkey1", "alice", 2); err != nil {
+		t.Fatalf("AllocateForToken() error: %v", err)
+	}
+	if _, err := ipam.AllocateForToken("pubkey2", "alice", 2); err != nil {
+		t.Fatalf("AllocateForToken() error: %v", err)
+	}
+	if _, err := ipam.AllocateForToken("pubkey3", "alice", 2); !errors.Is(err, ErrPeerLimit) {
+		t.Errorf("third AllocateForToken() error = %v, want ErrPeerLimit", err)
+	}
+
+	// Re-registering an existing peer does not count against the limit
+	if _, err := ipam.AllocateForToken("pubkey1", "alice", 2); err != nil {
+		t.Errorf("re-registration error: %v", err)
+	}
+
+	// Other tokens are unaffected, and releasing frees a slot
+	if _, err := ipam.AllocateForToken("pubkey3", "bob", 2); err != nil {
+		t.Errorf("AllocateForToken(bob) error: %v", err)
+	}
+	ipam.Release("pubkey2")
+	if _, err := ipam.AllocateForToken("pubkey4", "alice", 2); err != nil {
+		t.Errorf("AllocateForToken() after release error: %v", err)
+	}
+
+	if got := ipam.PeersForToken("alice"); len(got) != 2 || got[0] != "pubkey1" || got[1] != "pubkey4" {
+		t.Errorf("PeersForToken(alice) = %v, want [pubkey1 pubkey4]", got)
+	}
+}
+
+func TestIPAMTokenPersisted(t *testing.T) {
+	store, _ := NewPeerStore(t.TempDir())
+	ipam, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	ipam.AllocateForToken("pubkey1", "alice", 0)
+	ipam.Allocate("pubkey2")
+
+	restored, err := NewIPAM("10.0.0.1/24", store)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	if got := restored.Token("pubkey1"); got != "alice" {
+		t.Errorf("restored token = %q, want alice", got)
+	}
+	if got := restored.Token("pubkey2"); got != "" {
+		t.Errorf("untagged peer token = %q, want empty", got)
+	}
+}
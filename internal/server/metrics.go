@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the metrics listener serves Prometheus metrics.
+const MetricsPath = "/metrics"
+
+// Results of registration requests, as counted by shikvpn_registrations_total.
+const (
+	resultSuccess       = "success"
+	resultUnauthorized  = "unauthorized"
+	resultBadRequest    = "bad_request"
+	resultPoolExhausted = "ipam_exhausted"
+	resultPeerLimit     = "peer_limit"
+	resultError         = "error"
+)
+
+var (
+	ipamSizeDesc = prometheus.NewDesc("shikvpn_ipam_pool_size",
+		"Addresses the VPN subnet can assign to peers.", []string{"family"}, nil)
+	ipamUsedDesc = prometheus.NewDesc("shikvpn_ipam_pool_used",
+		"Addresses assigned to peers.", []string{"family"}, nil)
+	peersDesc = prometheus.NewDesc("shikvpn_peers",
+		"Peers configured on the WireGuard device.", nil, nil)
+	peersEvictedDesc = prometheus.NewDesc("shikvpn_peers_evicted_total",
+		"Peers removed by the idle peer reaper.", nil, nil)
+	peerRxDesc = prometheus.NewDesc("shikvpn_peer_receive_bytes_total",
+		"Bytes received from a peer.", []string{"public_key"}, nil)
+	peerTxDesc = prometheus.NewDesc("shikvpn_peer_transmit_bytes_total",
+		"Bytes sent to a peer.", []string{"public_key"}, nil)
+	peerHandshakeAgeDesc = prometheus.NewDesc("shikvpn_peer_last_handshake_age_seconds",
+		"Seconds since the last handshake with a peer; absent until the first one.", []string{"public_key"}, nil)
+)
+
+// apiMetrics instruments the registration API.
+type apiMetrics struct {
+	registrations *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+}
+
+func newAPIMetrics() *apiMetrics {
+	m := &apiMetrics{
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shikvpn_registrations_total",
+			Help: "Registration requests by result.",
+		}, []string{"result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shikvpn_api_request_duration_seconds",
+			Help:    "Time taken to serve API requests, by endpoint and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "code"}),
+	}
+	// Export every result from the start, so that rates of rare failures
+	// have a baseline
+	for _, result := range []string{resultSuccess, resultUnauthorized, resultBadRequest, resultPoolExhausted, resultPeerLimit, resultError} {
+		m.registrations.WithLabelValues(result)
+	}
+	return m
+}
+
+// instrument records how long handler takes to serve each request to endpoint.
+func (m *apiMetrics) instrument(endpoint string, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(m.latency.MustCurryWith(prometheus.Labels{"endpoint": endpoint}), handler)
+}
+
+// serverCollector reports the state of the IPAM pool and the WireGuard peers
+// when metrics are scraped.
+type serverCollector struct {
+	s *Server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{ipamSizeDesc, ipamUsedDesc, peersDesc, peersEvictedDesc, peerRxDesc, peerTxDesc, peerHandshakeAgeDesc} {
+		ch <- desc
+	}
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	ipam := c.s.ipam
+	used4, used6 := ipam.InUse()
+	ch <- prometheus.MustNewConstMetric(ipamSizeDesc, prometheus.GaugeValue, float64(ipam.PoolSize()), "ipv4")
+	ch <- prometheus.MustNewConstMetric(ipamUsedDesc, prometheus.GaugeValue, float64(used4), "ipv4")
+	if ipam.PrefixLen6() != 0 {
+		ch <- prometheus.MustNewConstMetric(ipamSizeDesc, prometheus.GaugeValue, ipam.PoolSize6(), "ipv6")
+		ch <- prometheus.MustNewConstMetric(ipamUsedDesc, prometheus.GaugeValue, float64(used6), "ipv6")
+	}
+	ch <- prometheus.MustNewConstMetric(peersEvictedDesc, prometheus.CounterValue, float64(c.s.PeersEvicted()))
+
+	stats, err := c.s.PeerStats()
+	if err != nil {
+		log.Printf("Warning: failed to read peer stats for metrics: %v", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(len(stats)))
+
+	now := time.Now()
+	for _, peer := range stats {
+		pubKey, err := crypto.HexToBase64(peer.PublicKeyHex)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(peerRxDesc, prometheus.CounterValue, float64(peer.RxBytes), pubKey)
+		ch <- prometheus.MustNewConstMetric(peerTxDesc, prometheus.CounterValue, float64(peer.TxBytes), pubKey)
+		if !peer.LastHandshake.IsZero() {
+			ch <- prometheus.MustNewConstMetric(peerHandshakeAgeDesc, prometheus.GaugeValue, now.Sub(peer.LastHandshake).Seconds(), pubKey)
+		}
+	}
+}
+
+// newMetricsRegistry gathers the server's metrics along with the Go runtime
+// and process metrics.
+func (s *Server) newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		s.api.metrics.registrations,
+		s.api.metrics.latency,
+		serverCollector{s: s},
+	)
+	return reg
+}
+
+// startMetrics serves MetricsPath on the metrics_listen address.
+func (s *Server) startMetrics() error {
+	ln, err := net.Listen("tcp", s.cfg.MetricsListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, s.MetricsHandler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	s.metricsServer = srv
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server error: %v", err)
+		}
+	}()
+	log.Printf("Metrics listening on %s%s", ln.Addr(), MetricsPath)
+	return nil
+}
+
+// stopMetrics shuts down the metrics listener, if it is running.
+func (s *Server) stopMetrics() {
+	if s.metricsServer == nil {
+		return
+	}
+	if err := s.metricsServer.Close(); err != nil {
+		log.Printf("Metrics server shutdown error: %v", err)
+	}
+	s.metricsServer = nil
+}
+
+// MetricsHandler returns the handler serving the server's Prometheus
+// metrics, or nil before Start.
+func (s *Server) MetricsHandler() http.Handler {
+	if s.metrics == nil {
+		return nil
+	}
+	return promhttp.HandlerFor(s.metrics, promhttp.HandlerOpts{ErrorLog: log.Default()})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/crypto"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// register posts a registration for a new key pair with apiKey.
+func register(t *testing.T, api *API, url, apiKey string) int {
+	t.Helper()
+
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, url+"/api/v1/register", bytes.NewReader(registerBody(t, api, kp)))
+	req.Header.Set("X-API-Key", apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST error: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegistrationMetrics(t *testing.T) {
+	api, server := setupTestAPIWithKey(t, "test-secret-key")
+	defer server.Close()
+
+	register(t, api, server.URL, "test-secret-key")
+	register(t, api, server.URL, "test-secret-key")
+	register(t, api, server.URL, "wrong")
+	resp, err := http.Get(server.URL + "/api/v1/register")
+	if err != nil {
+		t.Fatalf("GET error: %v", err)
+	}
+	resp.Body.Close()
+
+	for result, want := range map[string]float64{
+		resultSuccess:       2,
+		resultUnauthorized:  1,
+		resultBadRequest:    1,
+		resultPoolExhausted: 0,
+	} {
+		if got := testutil.ToFloat64(api.metrics.registrations.WithLabelValues(result)); got != want {
+			t.Errorf("registrations{result=%q} = %v, want %v", result, got, want)
+		}
+	}
+
+	// Every request is timed, whatever its outcome
+	if n := testutil.CollectAndCount(api.metrics.latency, "shikvpn_api_request_duration_seconds"); n != 3 {
+		t.Errorf("latency histograms = %d, want one per endpoint and status code (3)", n)
+	}
+}
+
+func TestRegistrationMetricsPoolExhausted(t *testing.T) {
+	// 10.0.0.0/30 has a single host address besides the gateway
+	ipam, err := NewIPAM("10.0.0.1/30", nil)
+	if err != nil {
+		t.Fatalf("NewIPAM() error: %v", err)
+	}
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error: %v", err)
+	}
+	noop := func(peer tunnel.PeerConfig) error { return nil }
+	noopRemove := func(publicKeyHex string) error { return nil }
+	api := NewAPI(ipam, kp.PrivateKey, crypto.KeyToBase64(kp.PublicKey), "1.2.3.4:51820",
+		nil, nil, 1420, "", nil, noop, noopRemove)
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	if status := register(t, api, server.URL, ""); status != http.StatusOK {
+		t.Fatalf("first registration status = %d, want 200", status)
+	}
+	if status := register(t, api, server.URL, ""); status != http.StatusInternalServerError {
+		t.Fatalf("registration in a full pool status = %d, want 500", status)
+	}
+	if got := testutil.ToFloat64(api.metrics.registrations.WithLabelValues(resultPoolExhausted)); got != 1 {
+		t.Errorf("registrations{result=%q} = %v, want 1", resultPoolExhausted, got)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+// peerReapInterval is how often the idle peer reaper inspects the device.
+const peerReapInterval = 30 * time.Second
+
+// peerReaper decides which peers have been idle for longer than a timeout.
+// Peers that have never completed a handshake are timed from the moment the
+// reaper first observed them, so freshly registered or restored peers get a
+// full timeout to connect.
+type peerReaper struct {
+	timeout   time.Duration
+	firstSeen map[string]time.Time // pubkey hex -> first time seen without a handshake
+}
+
+func newPeerReaper(timeout time.Duration) *peerReaper {
+	return &peerReaper{
+		timeout:   timeout,
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+// expired returns the peers from stats whose last activity is older than the timeout.
+func (r *peerReaper) expired(stats []tunnel.PeerStats, now time.Time) []tunnel.PeerStats {
+	var idle []tunnel.PeerStats
+	present := make(map[string]bool, len(stats))
+
+	for _, peer := range stats {
+		present[peer.PublicKeyHex] = true
+
+		lastActive := peer.LastHandshake
+		if lastActive.IsZero() {
+			seen, ok := r.firstSeen[peer.PublicKeyHex]
+			if !ok {
+				seen = now
+				r.firstSeen[peer.PublicKeyHex] = now
+			}
+			lastActive = seen
+		} else {
+			delete(r.firstSeen, peer.PublicKeyHex)
+		}
+
+		if now.Sub(lastActive) > r.timeout {
+			idle = append(idle, peer)
+			delete(r.firstSeen, peer.PublicKeyHex)
+		}
+	}
+
+	// Forget peers that were removed by other means
+	for key := range r.firstSeen {
+		if !present[key] {
+			delete(r.firstSeen, key)
+		}
+	}
+
+	return idle
+}
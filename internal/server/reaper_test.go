@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+)
+
+func TestReaperExpiresIdleHandshake(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newPeerReaper(5 * time.Minute)
+
+	stats := []tunnel.PeerStats{
+		{PublicKeyHex: "active", LastHandshake: now.Add(-1 * time.Minute)},
+		{PublicKeyHex: "idle", LastHandshake: now.Add(-10 * time.Minute)},
+	}
+
+	expired := r.expired(stats, now)
+	if len(expired) != 1 || expired[0].PublicKeyHex != "idle" {
+		t.Errorf("expired = %+v, want only idle peer", expired)
+	}
+}
+
+func TestReaperGivesNewPeersFullTimeout(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := newPeerReaper(5 * time.Minute)
+
+	stats := []tunnel.PeerStats{{PublicKeyHex: "fresh"}}
+
+	// First observation starts the clock
+	if expired := r.expired(stats, start); len(expired) != 0 {
+		t.Fatalf("peer without handshake expired on first sight: %+v", expired)
+	}
+	if expired := r.expired(stats, start.Add(4*time.Minute)); len(expired) != 0 {
+		t.Fatalf("peer expired before timeout: %+v", expired)
+	}
+	if expired := r.expired(stats, start.Add(6*time.Minute)); len(expired) != 1 {
+		t.Errorf("peer never handshaking was not expired after timeout")
+	}
+}
+
+func TestReaperResetsAfterHandshake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := newPeerReaper(5 * time.Minute)
+
+	r.expired([]tunnel.PeerStats{{PublicKeyHex: "p"}}, start)
+
+	// Peer completes a handshake shortly before the first-seen timer would fire
+	later := start.Add(6 * time.Minute)
+	stats := []tunnel.PeerStats{{PublicKeyHex: "p", LastHandshake: later.Add(-30 * time.Second)}}
+	if expired := r.expired(stats, later); len(expired) != 0 {
+		t.Errorf("recently handshaken peer was expired: %+v", expired)
+	}
+	if _, ok := r.firstSeen["p"]; ok {
+		t.Error("firstSeen entry not cleared after handshake")
+	}
+}
+
+func TestReaperForgetsRemovedPeers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newPeerReaper(5 * time.Minute)
+
+	r.expired([]tunnel.PeerStats{{PublicKeyHex: "gone"}}, now)
+	r.expired(nil, now.Add(time.Minute))
+
+	if len(r.firstSeen) != 0 {
+		t.Errorf("firstSeen still tracks removed peers: %v", r.firstSeen)
+	}
+}
@@ -1,24 +1,52 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gavsh/ShikVPN/internal/config"
 	"github.com/gavsh/ShikVPN/internal/crypto"
 	"github.com/gavsh/ShikVPN/internal/network"
+	"github.com/gavsh/ShikVPN/internal/transport"
 	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
+// tokenCheckInterval is how often the token store is checked for revocations.
+const tokenCheckInterval = 30 * time.Second
+
 // Server orchestrates the VPN server: tunnel, API, IPAM, and network config.
 type Server struct {
 	cfg       *config.ServerConfig
 	tunnel    *tunnel.Tunnel
 	api       *API
 	ipam      *IPAM
+	tokens    *TokenStore
 	netConfig network.InterfaceConfigurator
+
+	// bind and tnet are set when the tunnel runs on a userspace network
+	// stack; see UseNetstack
+	bind conn.Bind
+	tnet *netstack.Net
+
+	// streams serves the tcp or websocket transport next to UDP
+	streams *transport.ServerBind
+
+	metrics       *prometheus.Registry
+	metricsServer *http.Server // nil unless metrics_listen is set
+
+	done         chan struct{}
+	wg           sync.WaitGroup
+	peersEvicted atomic.Uint64
 }
 
 // New creates a new VPN server.
@@ -26,39 +54,85 @@ func New(cfg *config.ServerConfig) *Server {
 	return &Server{
 		cfg:       cfg,
 		netConfig: network.NewConfigurator(),
+		done:      make(chan struct{}),
 	}
 }
 
 // Start initializes and starts all server components.
 func (s *Server) Start() error {
+	// Open the peer store so allocations survive restarts
+	var store *PeerStore
+	if s.cfg.StateDir != "" {
+		var err error
+		store, err = NewPeerStore(s.cfg.StateDir)
+		if err != nil {
+			return fmt.Errorf("failed to open peer store: %w", err)
+		}
+		log.Printf("Using peer store %s", store.Path())
+	} else {
+		log.Println("WARNING: state_dir is not set; peer allocations will be lost on restart.")
+	}
+
 	// Initialize IPAM
-	ipam, err := NewIPAM(s.cfg.Address)
+	ipam, err := NewDualStackIPAM(s.cfg.Address, s.cfg.Address6, store)
 	if err != nil {
 		return fmt.Errorf("failed to create IPAM: %w", err)
 	}
 	s.ipam = ipam
 
-	// Create TUN device
-	tun, err := tunnel.CreateTunnel(s.cfg.InterfaceName, s.cfg.MTU, s.cfg.LogLevel)
-	if err != nil {
-		return fmt.Errorf("failed to create tunnel: %w", err)
+	// WireGuard always listens on UDP, and on a stream transport if configured
+	bind := s.bind
+	if bind == nil {
+		bind = conn.NewDefaultBind()
+	}
+	if s.cfg.Transport == config.TransportTCP || s.cfg.Transport == config.TransportWebSocket {
+		s.streams = transport.NewServerBind(bind)
+		bind = s.streams
+	}
+	if s.cfg.ObfuscationKey != "" {
+		key, err := crypto.KeyFromBase64(s.cfg.ObfuscationKey)
+		if err != nil {
+			return fmt.Errorf("invalid obfuscation key: %w", err)
+		}
+		bind = transport.NewObfuscatedBind(bind, key)
+		log.Println("Packet obfuscation enabled; clients need the same obfuscation_key")
+	}
+
+	// Create TUN device, or a userspace network stack
+	if s.bind != nil {
+		tun, tnet, err := s.createNetstackTunnel(bind)
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+		s.tunnel, s.tnet = tun, tnet
+		log.Println("Created userspace network stack")
+	} else {
+		tun, err := tunnel.CreateTunnel(s.cfg.InterfaceName, s.cfg.MTU, s.cfg.LogLevel, bind)
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+		s.tunnel = tun
+		log.Printf("Created TUN device: %s", tun.Name())
 	}
-	s.tunnel = tun
-	log.Printf("Created TUN device: %s", tun.Name())
 
 	// Convert private key to hex for UAPI
-	privKeyHex, err := crypto.Base64ToHex(s.cfg.PrivateKey)
+	privKey, err := crypto.KeyFromBase64(s.cfg.PrivateKey)
 	if err != nil {
 		s.tunnel.Close()
 		return fmt.Errorf("invalid server private key: %w", err)
 	}
+	privKeyHex := crypto.KeyToHex(privKey)
 
-	// Configure WireGuard device (no peers initially)
-	uapi := tunnel.BuildServerUAPIConfig(privKeyHex, s.cfg.ListenPort, nil)
+	// Configure WireGuard device with any peers restored from the store
+	peers := s.storedPeers()
+	uapi := tunnel.BuildServerUAPIConfig(privKeyHex, s.cfg.ListenPort, peers)
 	if err := s.tunnel.Configure(uapi); err != nil {
 		s.tunnel.Close()
 		return fmt.Errorf("failed to configure WireGuard: %w", err)
 	}
+	if len(peers) > 0 {
+		log.Printf("Restored %d peer(s) from peer store", len(peers))
+	}
 
 	// Bring device up
 	if err := s.tunnel.Up(); err != nil {
@@ -67,29 +141,151 @@ func (s *Server) Start() error {
 	}
 	log.Println("WireGuard device is up")
 
-	// Configure network interface
-	if err := s.configureNetwork(); err != nil {
-		s.tunnel.Close()
-		return fmt.Errorf("failed to configure network: %w", err)
+	// Configure network interface; a userspace stack has none
+	if s.tnet == nil {
+		if err := s.configureNetwork(); err != nil {
+			s.tunnel.Close()
+			return fmt.Errorf("failed to configure network: %w", err)
+		}
 	}
 
 	// Build server endpoint string
 	serverEndpoint := fmt.Sprintf("%s:%d", s.cfg.ExternalHost, s.cfg.ListenPort)
 
+	// Open the per-user token store
+	if s.cfg.TokenFile != "" {
+		tokens, err := NewTokenStore(s.cfg.TokenFile)
+		if err != nil {
+			s.closeTunnel()
+			return fmt.Errorf("failed to open token store: %w", err)
+		}
+		s.tokens = tokens
+		log.Printf("Using token store %s", tokens.Path())
+	}
+
 	// Create and start API
-	s.api = NewAPI(s.ipam, s.cfg.PublicKey, serverEndpoint, s.cfg.DNSServers, s.cfg.MTU, s.cfg.APIKey, s.addPeer)
+	s.api = NewAPI(s.ipam, privKey, s.cfg.PublicKey, serverEndpoint, s.cfg.DNSServers, s.cfg.Routes, s.cfg.MTU, s.cfg.APIKey, s.tokens, s.addPeer, s.removePeer)
+
+	if s.cfg.AdminAPIKey != "" || s.tokens != nil {
+		admin := NewAdminAPI(s.ipam, s.cfg.AdminAPIKey, s.tokens, s.tunnel.PeerStats, s.addPeer, s.removePeer)
+		s.api.Mount(AdminPrefix, s.api.metrics.instrument("admin", admin.Handler()))
+		log.Printf("Admin API enabled under %s", AdminPrefix)
+	}
+
+	s.metrics = s.newMetricsRegistry()
+	if s.cfg.MetricsListen != "" {
+		if err := s.startMetrics(); err != nil {
+			s.closeTunnel()
+			return err
+		}
+	}
 
 	apiAddr := fmt.Sprintf(":%d", s.cfg.APIPort)
-	go func() {
-		if err := s.api.ListenAndServe(apiAddr); err != nil {
-			log.Printf("API server error: %v", err)
+	serve := func() error { return s.api.ListenAndServe(apiAddr) }
+	var cert *tls.Certificate
+	if s.cfg.TLSEnabled() {
+		c, err := s.loadAPICertificate()
+		if err != nil {
+			s.stopMetrics()
+			s.closeTunnel()
+			return err
 		}
-	}()
+		cert = &c
+		serve = func() error { return s.api.ListenAndServeTLS(apiAddr, c) }
+	}
+
+	if s.streams != nil {
+		if err := s.startTransport(cert); err != nil {
+			s.stopMetrics()
+			s.closeTunnel()
+			return err
+		}
+	}
+	// With a userspace stack the caller serves APIHandler itself
+	if s.bind == nil {
+		go func() {
+			if err := serve(); err != nil {
+				log.Printf("API server error: %v", err)
+			}
+		}()
+	}
+
+	// Start the idle peer reaper
+	if s.cfg.PeerIdleTimeout > 0 {
+		timeout := time.Duration(s.cfg.PeerIdleTimeout) * time.Second
+		s.wg.Add(1)
+		go s.runReaper(timeout)
+		log.Printf("Idle peer reaper enabled (timeout: %v)", timeout)
+	}
+
+	// Disconnect peers whose token is revoked while the server runs
+	if s.tokens != nil {
+		s.evictRevokedPeers()
+		s.wg.Add(1)
+		go s.runTokenWatcher()
+	}
 
 	log.Printf("VPN server started (WG port: %d, API port: %d)", s.cfg.ListenPort, s.cfg.APIPort)
 	return nil
 }
 
+// startTransport serves the stream transport: WebSocket on the API's own
+// listener unless transport_port is set, otherwise a listener of its own,
+// which for WebSocket uses the API's certificate if there is one.
+func (s *Server) startTransport(cert *tls.Certificate) error {
+	if s.cfg.Transport == config.TransportWebSocket && s.cfg.TransportPort == 0 {
+		s.api.Mount(transport.WebSocketPath, s.streams.WebSocketHandler())
+		log.Printf("WireGuard over WebSocket served on the API port at %s", transport.WebSocketPath)
+		return nil
+	}
+
+	port := s.cfg.StreamPort()
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for the %s transport: %w", s.cfg.Transport, err)
+	}
+	serve := s.streams.Serve
+	if s.cfg.Transport == config.TransportWebSocket {
+		if cert != nil {
+			ln = tls.NewListener(ln, &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				MinVersion:   tls.VersionTLS12,
+			})
+		}
+		serve = s.streams.ServeWebSocket
+	}
+	go func() {
+		if err := serve(ln); err != nil {
+			log.Printf("Transport listener error: %v", err)
+		}
+	}()
+	log.Printf("WireGuard over %s listening on TCP port %d", s.cfg.Transport, port)
+	return nil
+}
+
+// loadAPICertificate returns the configured or self-signed API certificate
+// and logs its fingerprint for clients to pin with api_cert_sha256.
+func (s *Server) loadAPICertificate() (tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	if s.cfg.TLSSelfSigned {
+		cert, err = LoadOrCreateSelfSigned(s.cfg.StateDir, s.cfg.ExternalHost)
+		if err != nil {
+			return cert, fmt.Errorf("failed to create self-signed certificate: %w", err)
+		}
+		if s.cfg.StateDir == "" {
+			log.Println("WARNING: state_dir is not set; the self-signed API certificate changes on every restart.")
+		}
+	} else {
+		cert, err = tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			return cert, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
+	log.Printf("API certificate SHA-256: %s", crypto.CertFingerprint(cert.Certificate[0]))
+	return cert, nil
+}
+
 func (s *Server) configureNetwork() error {
 	ifaceName := s.tunnel.Name()
 
@@ -99,6 +295,13 @@ func (s *Server) configureNetwork() error {
 	}
 	log.Printf("Assigned address %s to %s", s.cfg.Address, ifaceName)
 
+	if s.cfg.Address6 != "" {
+		if err := s.netConfig.AssignAddress(ifaceName, s.cfg.Address6); err != nil {
+			return fmt.Errorf("failed to assign IPv6 address: %w", err)
+		}
+		log.Printf("Assigned address %s to %s", s.cfg.Address6, ifaceName)
+	}
+
 	// Set interface up
 	if err := s.netConfig.SetInterfaceUp(ifaceName); err != nil {
 		return fmt.Errorf("failed to set interface up: %w", err)
@@ -109,18 +312,98 @@ func (s *Server) configureNetwork() error {
 		log.Printf("Warning: failed to enable IP forwarding: %v", err)
 	}
 
-	// Configure NAT
-	// Extract network address from CIDR (e.g., "10.0.0.1/24" -> "10.0.0.0/24")
-	subnet := s.cfg.Address
-	if _, network, err := net.ParseCIDR(s.cfg.Address); err == nil {
-		subnet = network.String()
+	if s.cfg.Address6 != "" {
+		if err := s.netConfig.EnableIPv6Forwarding(); err != nil {
+			log.Printf("Warning: failed to enable IPv6 forwarding: %v", err)
+		}
 	}
 
-	if err := s.netConfig.ConfigureNAT(ifaceName, subnet); err != nil {
-		log.Printf("Warning: failed to configure NAT: %v", err)
+	s.configureNAT(ifaceName)
+	return nil
+}
+
+// vpnSubnets returns the tunnel subnets that are masqueraded.
+func (s *Server) vpnSubnets() []string {
+	subnets := []string{subnetOf(s.cfg.Address)}
+	if s.cfg.Address6 != "" {
+		subnets = append(subnets, subnetOf(s.cfg.Address6))
 	}
+	return subnets
+}
 
-	return nil
+// configureNAT masquerades VPN traffic with the configured backend. Failures
+// are logged rather than fatal, as the administrator may manage NAT already.
+func (s *Server) configureNAT(ifaceName string) {
+	switch s.cfg.NATBackend {
+	case config.NATBackendNone:
+		log.Println("NAT disabled (nat_backend = none)")
+	case config.NATBackendNFTables:
+		if err := network.EnableNFTablesNAT(s.cfg.WANInterface, s.vpnSubnets()); err != nil {
+			log.Printf("Warning: failed to configure NAT: %v", err)
+		}
+	default:
+		for _, subnet := range s.vpnSubnets() {
+			if err := s.netConfig.ConfigureNAT(ifaceName, subnet, s.cfg.WANInterface); err != nil {
+				log.Printf("Warning: failed to configure NAT for %s: %v", subnet, err)
+			}
+		}
+	}
+}
+
+// closeTunnel closes the tunnel, and removes its NAT rules, when Start fails
+// after configuring the network.
+func (s *Server) closeTunnel() {
+	if s.tnet == nil {
+		s.removeNAT(s.tunnel.Name())
+	}
+	s.tunnel.Close()
+}
+
+// removeNAT undoes configureNAT.
+func (s *Server) removeNAT(ifaceName string) {
+	switch s.cfg.NATBackend {
+	case config.NATBackendNone:
+	case config.NATBackendNFTables:
+		if err := network.DisableNFTablesNAT(); err != nil {
+			log.Printf("Warning: failed to remove NAT: %v", err)
+		}
+	default:
+		for _, subnet := range s.vpnSubnets() {
+			_ = s.netConfig.RemoveNAT(ifaceName, subnet, s.cfg.WANInterface)
+		}
+	}
+}
+
+// subnetOf returns the network address of a CIDR (e.g., "10.0.0.1/24" -> "10.0.0.0/24").
+// Unparseable input is returned unchanged.
+func subnetOf(cidr string) string {
+	if _, network, err := net.ParseCIDR(cidr); err == nil {
+		return network.String()
+	}
+	return cidr
+}
+
+// storedPeers builds WireGuard peer configs for every allocation held by IPAM.
+// Allocations with undecodable keys are released rather than replayed.
+func (s *Server) storedPeers() []tunnel.PeerConfig {
+	var peers []tunnel.PeerConfig
+	for pubKey := range s.ipam.Allocations() {
+		pubKeyHex, err := crypto.Base64ToHex(pubKey)
+		if err != nil {
+			log.Printf("Warning: releasing stored peer with invalid public key: %v", err)
+			s.ipam.Release(pubKey)
+			continue
+		}
+		// A kicked or evicted peer keeps its pinned IP, but not its place on the device
+		if s.ipam.IsReleased(pubKey) {
+			continue
+		}
+		peers = append(peers, tunnel.PeerConfig{
+			PublicKeyHex: pubKeyHex,
+			AllowedIPs:   s.ipam.AllowedIPs(pubKey),
+		})
+	}
+	return peers
 }
 
 // addPeer adds a new peer to the WireGuard device dynamically.
@@ -129,10 +412,169 @@ func (s *Server) addPeer(peer tunnel.PeerConfig) error {
 	return s.tunnel.Configure(uapi)
 }
 
+// removePeer removes a peer from the WireGuard device.
+func (s *Server) removePeer(publicKeyHex string) error {
+	return s.tunnel.Configure(tunnel.BuildRemovePeerUAPI(publicKeyHex))
+}
+
+// runReaper periodically evicts peers that have been idle longer than timeout.
+func (s *Server) runReaper(timeout time.Duration) {
+	defer s.wg.Done()
+
+	reaper := newPeerReaper(timeout)
+	ticker := time.NewTicker(peerReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.reapIdlePeers(reaper, now)
+		}
+	}
+}
+
+// reapIdlePeers removes idle peers from the device and releases their addresses.
+func (s *Server) reapIdlePeers(reaper *peerReaper, now time.Time) {
+	stats, err := s.tunnel.PeerStats()
+	if err != nil {
+		log.Printf("Warning: failed to read peer stats: %v", err)
+		return
+	}
+
+	for _, peer := range reaper.expired(stats, now) {
+		pubKey, err := crypto.HexToBase64(peer.PublicKeyHex)
+		if err != nil {
+			log.Printf("Warning: skipping idle peer with invalid key: %v", err)
+			continue
+		}
+		if err := s.removePeer(peer.PublicKeyHex); err != nil {
+			log.Printf("Warning: failed to evict idle peer %s...: %v", truncateKey(pubKey), err)
+			continue
+		}
+		s.ipam.Release(pubKey)
+		s.peersEvicted.Add(1)
+
+		lastSeen := "never"
+		if !peer.LastHandshake.IsZero() {
+			lastSeen = peer.LastHandshake.Format(time.RFC3339)
+		}
+		log.Printf("Evicted idle peer %s... (allowed IPs: %v, last handshake: %s)", truncateKey(pubKey), peer.AllowedIPs, lastSeen)
+	}
+}
+
+// runTokenWatcher periodically removes peers registered with revoked tokens.
+func (s *Server) runTokenWatcher() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.evictRevokedPeers()
+		}
+	}
+}
+
+// evictRevokedPeers removes every peer tagged with a revoked token from the
+// device and releases its address.
+func (s *Server) evictRevokedPeers() {
+	tokens, err := s.tokens.List()
+	if err != nil {
+		log.Printf("Warning: failed to read token store: %v", err)
+		return
+	}
+
+	for _, token := range tokens {
+		if !token.Revoked() {
+			continue
+		}
+		for _, pubKey := range s.ipam.PeersForToken(token.Name) {
+			pubKeyHex, err := crypto.Base64ToHex(pubKey)
+			if err != nil {
+				log.Printf("Warning: skipping peer with invalid key: %v", err)
+				continue
+			}
+			if err := s.removePeer(pubKeyHex); err != nil {
+				log.Printf("Warning: failed to remove peer %s... of revoked token %q: %v", truncateKey(pubKey), token.Name, err)
+				continue
+			}
+			s.ipam.Unpin(pubKey)
+			s.ipam.Release(pubKey)
+			log.Printf("Removed peer %s... registered with revoked token %q", truncateKey(pubKey), token.Name)
+		}
+	}
+}
+
+// UseNetstack makes Start run the tunnel on a userspace network stack that
+// sends WireGuard's packets through bind, instead of on a TUN device, and
+// leave the host's interfaces, forwarding and NAT alone. Start then does not
+// listen on the API port either; serve APIHandler instead. It must be called
+// before Start. In-process tests use it to run a server without privileges.
+func (s *Server) UseNetstack(bind conn.Bind) {
+	s.bind = bind
+}
+
+// Net returns the userspace network stack that owns the server's tunnel
+// addresses, or nil unless the server was started after UseNetstack.
+func (s *Server) Net() *netstack.Net {
+	return s.tnet
+}
+
+// APIHandler returns the handler serving the registration and admin API,
+// or nil before Start.
+func (s *Server) APIHandler() http.Handler {
+	if s.api == nil {
+		return nil
+	}
+	return s.api.Handler()
+}
+
+// PeerStats returns the runtime state of every peer on the tunnel.
+func (s *Server) PeerStats() ([]tunnel.PeerStats, error) {
+	return s.tunnel.PeerStats()
+}
+
+// createNetstackTunnel creates a tunnel on a userspace network stack that
+// owns the server's tunnel addresses.
+func (s *Server) createNetstackTunnel(bind conn.Bind) (*tunnel.Tunnel, *netstack.Net, error) {
+	var addresses []netip.Addr
+	for _, cidr := range []string{s.cfg.Address, s.cfg.Address6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address %q: %w", cidr, err)
+		}
+		addresses = append(addresses, prefix.Addr())
+	}
+	return tunnel.CreateNetstackTunnel(addresses, nil, s.cfg.MTU, s.cfg.LogLevel, bind)
+}
+
+// PeersEvicted returns the number of peers removed by the idle reaper.
+func (s *Server) PeersEvicted() uint64 {
+	return s.peersEvicted.Load()
+}
+
 // Stop gracefully shuts down the server.
 func (s *Server) Stop() {
 	log.Println("Stopping VPN server...")
 
+	// Stop background workers before tearing down the tunnel
+	close(s.done)
+	s.wg.Wait()
+
+	// Hijacked WebSocket streams are not closed by the API shutdown
+	if s.streams != nil {
+		s.streams.Shutdown()
+	}
+
 	// Gracefully shut down the API server
 	if s.api != nil {
 		if err := s.api.Shutdown(5 * time.Second); err != nil {
@@ -140,16 +582,12 @@ func (s *Server) Stop() {
 		}
 		log.Println("API server stopped")
 	}
+	s.stopMetrics()
 
 	if s.tunnel != nil {
-		ifaceName := s.tunnel.Name()
-
-		// Remove NAT
-		subnet := s.cfg.Address
-		if _, network, err := net.ParseCIDR(s.cfg.Address); err == nil {
-			subnet = network.String()
+		if s.tnet == nil {
+			s.removeNAT(s.tunnel.Name())
 		}
-		_ = s.netConfig.RemoveNAT(ifaceName, subnet)
 
 		s.tunnel.Close()
 		log.Println("Tunnel closed")
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// peerStoreFile is the name of the peer state file inside the state directory.
+const peerStoreFile = "peers.json"
+
+// PeerRecord is a single persisted peer allocation.
+type PeerRecord struct {
+	PublicKey string `json:"public_key"`
+	IP        string `json:"ip"`
+	IP6       string `json:"ip6,omitempty"`
+	Static    bool   `json:"static,omitempty"`
+	Released  bool   `json:"released,omitempty"` // pinned, but the peer was removed from the device
+	Token     string `json:"token,omitempty"`    // name of the API token that registered the peer
+}
+
+// peerStoreData is the on-disk layout of the peer state file.
+type peerStoreData struct {
+	Peers []PeerRecord `json:"peers"`
+}
+
+// PeerStore persists IPAM allocations to a JSON file so they survive restarts.
+type PeerStore struct {
+	path string
+}
+
+// NewPeerStore creates a store backed by peers.json inside stateDir.
+// The directory is created with restrictive permissions if it does not exist.
+func NewPeerStore(stateDir string) (*PeerStore, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %q: %w", stateDir, err)
+	}
+	return &PeerStore{path: filepath.Join(stateDir, peerStoreFile)}, nil
+}
+
+// Path returns the location of the peer state file.
+func (s *PeerStore) Path() string {
+	return s.path
+}
+
+// Load reads all persisted peer records. A missing file yields no records.
+func (s *PeerStore) Load() ([]PeerRecord, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read peer store: %w", err)
+	}
+
+	var stored peerStoreData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse peer store %s: %w", s.path, err)
+	}
+	return stored.Peers, nil
+}
+
+// Save atomically replaces the peer state file with the given records.
+func (s *PeerStore) Save(records []PeerRecord) error {
+	sorted := make([]PeerRecord, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PublicKey < sorted[j].PublicKey })
+
+	data, err := json.MarshalIndent(peerStoreData{Peers: sorted}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode peer store: %w", err)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated store
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), peerStoreFile+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp peer store: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write peer store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to sync peer store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close peer store: %w", err)
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to set peer store permissions: %w", err)
+	}
+	if err := os.Rename(tmpName, s.path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to replace peer store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Names of the generated certificate files inside the state directory.
+const (
+	selfSignedCertFile = "api-cert.pem"
+	selfSignedKeyFile  = "api-key.pem"
+)
+
+// selfSignedValidity is how long a generated API certificate is valid.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// LoadOrCreateSelfSigned returns a self-signed certificate for host. If
+// stateDir is non-empty the certificate is kept there so its fingerprint
+// stays stable across restarts; otherwise a new one is generated each time.
+func LoadOrCreateSelfSigned(stateDir, host string) (tls.Certificate, error) {
+	if stateDir != "" {
+		certPath := filepath.Join(stateDir, selfSignedCertFile)
+		keyPath := filepath.Join(stateDir, selfSignedKeyFile)
+		if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+			return cert, nil
+		} else if !os.IsNotExist(err) {
+			return tls.Certificate{}, fmt.Errorf("failed to load self-signed certificate: %w", err)
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(host)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if stateDir != "" {
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to create state directory %q: %w", stateDir, err)
+		}
+		if err := os.WriteFile(filepath.Join(stateDir, selfSignedKeyFile), keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write certificate key: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(stateDir, selfSignedCertFile), certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to write certificate: %w", err)
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateSelfSigned creates a PEM-encoded ECDSA certificate and key valid for host.
+func generateSelfSigned(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate serial: %w", err)
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"ShikVPN"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else if host != "" {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode certificate key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
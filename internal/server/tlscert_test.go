@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestLoadOrCreateSelfSignedIsStable(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := LoadOrCreateSelfSigned(dir, "203.0.113.10")
+	if err != nil {
+		t.Fatalf("LoadOrCreateSelfSigned() error: %v", err)
+	}
+	second, err := LoadOrCreateSelfSigned(dir, "203.0.113.10")
+	if err != nil {
+		t.Fatalf("LoadOrCreateSelfSigned() error: %v", err)
+	}
+	if string(first.Certificate[0]) != string(second.Certificate[0]) {
+		t.Error("certificate changed between loads from the same state dir")
+	}
+
+	leaf, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error: %v", err)
+	}
+	if err := leaf.VerifyHostname("203.0.113.10"); err != nil {
+		t.Errorf("certificate not valid for external host: %v", err)
+	}
+}
+
+func TestLoadOrCreateSelfSignedWithoutStateDir(t *testing.T) {
+	cert, err := LoadOrCreateSelfSigned("", "vpn.example.com")
+	if err != nil {
+		t.Fatalf("LoadOrCreateSelfSigned() error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error: %v", err)
+	}
+	if err := leaf.VerifyHostname("vpn.example.com"); err != nil {
+		t.Errorf("certificate not valid for external host: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes.
+const (
+	ScopeRegister = "register" // may register peers
+	ScopeAdmin    = "admin"    // may use the admin API
+)
+
+// tokenPrefix marks issued token secrets so they are recognisable in configs.
+const tokenPrefix = "shk_"
+
+// Errors returned by TokenStore.
+var (
+	ErrTokenInvalid = errors.New("unknown token")
+	ErrTokenExpired = errors.New("token has expired")
+	ErrTokenRevoked = errors.New("token has been revoked")
+	ErrTokenScope   = errors.New("token lacks the required scope")
+	ErrNotInvite    = errors.New("token is not an unused invite")
+)
+
+// Token is a named API credential. Only a hash of the secret is stored.
+type Token struct {
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxPeers  int        `json:"max_peers,omitempty"` // 0 means unlimited
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Invite marks a one-time invite code. Redeeming it replaces the secret
+	// with a regular token handed to the new client.
+	Invite     bool       `json:"invite,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+}
+
+// HasScope reports whether the token grants scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked reports whether the token has been revoked.
+func (t *Token) Revoked() bool {
+	return t.RevokedAt != nil
+}
+
+// Expired reports whether the token has expired at now.
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// tokenStoreData is the on-disk layout of the token file.
+type tokenStoreData struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// TokenStore keeps API tokens in a JSON file. The file is re-read whenever it
+// changes on disk, so tokens issued or revoked from the command line take
+// effect on a running server.
+type TokenStore struct {
+	mu     sync.Mutex
+	path   string
+	info   os.FileInfo // file last read, to detect changes
+	tokens []Token
+}
+
+// NewTokenStore opens the token file at path, creating its directory if needed.
+// A missing file is treated as an empty store.
+func NewTokenStore(path string) (*TokenStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create token directory: %w", err)
+	}
+	s := &TokenStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the location of the token file.
+func (s *TokenStore) Path() string {
+	return s.path
+}
+
+// reload re-reads the token file if it changed since the last read. Must be called with mu held.
+func (s *TokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tokens = nil
+			s.info = nil
+			return nil
+		}
+		return fmt.Errorf("failed to stat token file: %w", err)
+	}
+	// Saves replace the file, so a new inode means a change even if the
+	// modification time did not move
+	if s.info != nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+	var stored tokenStoreData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse token file %s: %w", s.path, err)
+	}
+	s.tokens = stored.Tokens
+	s.info = info
+	return nil
+}
+
+// save writes the tokens back to disk atomically. Must be called with mu held.
+func (s *TokenStore) save() error {
+	data, err := json.MarshalIndent(tokenStoreData{Tokens: s.tokens}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp token file: %w", err)
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close token file: %w", err)
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to set token file permissions: %w", err)
+	}
+	if err := os.Rename(tmpName, s.path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to replace token file: %w", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.info = info
+	}
+	return nil
+}
+
+// Issue creates a token and returns its secret, which is not stored and
+// cannot be recovered later. A zero expiresAt never expires; maxPeers of 0
+// allows any number of peers.
+func (s *TokenStore) Issue(name string, scopes []string, expiresAt time.Time, maxPeers int) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRegister && scope != ScopeAdmin {
+			return "", fmt.Errorf("unknown scope %q (valid: %s, %s)", scope, ScopeRegister, ScopeAdmin)
+		}
+	}
+	if maxPeers < 0 {
+		return "", fmt.Errorf("max peers must not be negative")
+	}
+	return s.add(Token{Name: name, Scopes: scopes, MaxPeers: maxPeers}, expiresAt)
+}
+
+// IssueInvite creates a single-use invite code that registers one peer.
+// When redeemed it turns into a regular register token of the same name.
+func (s *TokenStore) IssueInvite(name string, expiresAt time.Time) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("invite name is required")
+	}
+	return s.add(Token{Name: name, Scopes: []string{ScopeRegister}, MaxPeers: 1, Invite: true}, expiresAt)
+}
+
+// add stores tok under a fresh secret and returns the secret.
+func (s *TokenStore) add(tok Token, expiresAt time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", err
+	}
+	for _, t := range s.tokens {
+		if t.Name == tok.Name {
+			return "", fmt.Errorf("token %q already exists", tok.Name)
+		}
+	}
+
+	secret, err := newTokenSecret()
+	if err != nil {
+		return "", err
+	}
+	tok.Hash = hashToken(secret)
+	tok.CreatedAt = time.Now().UTC()
+	if !expiresAt.IsZero() {
+		exp := expiresAt.UTC()
+		tok.ExpiresAt = &exp
+	}
+
+	s.tokens = append(s.tokens, tok)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return "", err
+	}
+	return secret, nil
+}
+
+// Redeem consumes the named invite and returns the secret of the regular
+// token that replaces it. The invite code stops working immediately; the
+// new token never expires.
+func (s *TokenStore) Redeem(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", err
+	}
+	for i := range s.tokens {
+		t := &s.tokens[i]
+		if t.Name != name {
+			continue
+		}
+		if !t.Invite || t.Revoked() {
+			return "", ErrNotInvite
+		}
+
+		secret, err := newTokenSecret()
+		if err != nil {
+			return "", err
+		}
+		prev := *t
+		now := time.Now().UTC()
+		t.Hash = hashToken(secret)
+		t.Invite = false
+		t.ExpiresAt = nil
+		t.RedeemedAt = &now
+		if err := s.save(); err != nil {
+			*t = prev
+			return "", err
+		}
+		return secret, nil
+	}
+	return "", ErrNotInvite
+}
+
+// Revoke marks the named token as revoked.
+func (s *TokenStore) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for i := range s.tokens {
+		if s.tokens[i].Name != name {
+			continue
+		}
+		if s.tokens[i].Revoked() {
+			return fmt.Errorf("token %q is already revoked", name)
+		}
+		now := time.Now().UTC()
+		s.tokens[i].RevokedAt = &now
+		if err := s.save(); err != nil {
+			s.tokens[i].RevokedAt = nil
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("token %q not found", name)
+}
+
+// List returns all tokens sorted by name.
+func (s *TokenStore) List() ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	out := make([]Token, len(s.tokens))
+	copy(out, s.tokens)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Authenticate returns the token matching secret if it is usable for scope at now.
+func (s *TokenStore) Authenticate(secret, scope string, now time.Time) (Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Token{}, ErrTokenInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return Token{}, err
+	}
+
+	hash := hashToken(secret)
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		switch {
+		case t.Revoked():
+			return t, ErrTokenRevoked
+		case t.Expired(now):
+			return t, ErrTokenExpired
+		case !t.HasScope(scope):
+			return t, ErrTokenScope
+		}
+		return t, nil
+	}
+	return Token{}, ErrTokenInvalid
+}
+
+// newTokenSecret returns a random token secret.
+func newTokenSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashToken returns the hex SHA-256 of a token secret.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
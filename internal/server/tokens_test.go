@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenStore(t *testing.T) *TokenStore {
+	t.Helper()
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("NewTokenStore() error: %v", err)
+	}
+	return store
+}
+
+func TestTokenStoreIssueAndAuthenticate(t *testing.T) {
+	store := newTestTokenStore(t)
+
+	secret, err := store.Issue("alice-laptop", []string{ScopeRegister}, time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		t.Errorf("secret %q lacks prefix %q", secret, tokenPrefix)
+	}
+
+	tok, err := store.Authenticate(secret, ScopeRegister, time.Now())
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if tok.Name != "alice-laptop" || tok.MaxPeers != 2 {
+		t.Errorf("Authenticate() = %+v, want alice-laptop with max 2 peers", tok)
+	}
+
+	if _, err := store.Authenticate(secret, ScopeAdmin, time.Now()); !errors.Is(err, ErrTokenScope) {
+		t.Errorf("Authenticate(admin) error = %v, want ErrTokenScope", err)
+	}
+	if _, err := store.Authenticate(tokenPrefix+"bogus", ScopeRegister, time.Now()); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Authenticate(bogus) error = %v, want ErrTokenInvalid", err)
+	}
+}
+
+func TestTokenStoreDoesNotStoreSecret(t *testing.T) {
+	store := newTestTokenStore(t)
+	secret, _ := store.Issue("bob", []string{ScopeRegister}, time.Time{}, 0)
+
+	data, err := os.ReadFile(store.Path())
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Error("token file contains the plaintext secret")
+	}
+}
+
+func TestTokenStoreIssueValidation(t *testing.T) {
+	store := newTestTokenStore(t)
+
+	if _, err := store.Issue("", []string{ScopeRegister}, time.Time{}, 0); err == nil {
+		t.Error("expected error for empty name")
+	}
+	if _, err := store.Issue("x", []string{"superuser"}, time.Time{}, 0); err == nil {
+		t.Error("expected error for unknown scope")
+	}
+	if _, err := store.Issue("x", []string{ScopeRegister}, time.Time{}, -1); err == nil {
+		t.Error("expected error for negative max peers")
+	}
+	store.Issue("dup", []string{ScopeRegister}, time.Time{}, 0)
+	if _, err := store.Issue("dup", []string{ScopeRegister}, time.Time{}, 0); err == nil {
+		t.Error("expected error for duplicate name")
+	}
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	store := newTestTokenStore(t)
+	now := time.Now()
+	secret, _ := store.Issue("temp", []string{ScopeRegister}, now.Add(time.Hour), 0)
+
+	if _, err := store.Authenticate(secret, ScopeRegister, now); err != nil {
+		t.Errorf("Authenticate() before expiry error: %v", err)
+	}
+	if _, err := store.Authenticate(secret, ScopeRegister, now.Add(2*time.Hour)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Authenticate() after expiry error = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestTokenStoreRevokeSeenByOtherInstance(t *testing.T) {
+	store := newTestTokenStore(t)
+	secret, _ := store.Issue("carol", []string{ScopeRegister}, time.Time{}, 0)
+
+	// A running server holds its own store; revocation comes from the CLI
+	cli, err := NewTokenStore(store.Path())
+	if err != nil {
+		t.Fatalf("NewTokenStore() error: %v", err)
+	}
+	if err := cli.Revoke("carol"); err != nil {
+		t.Fatalf("Revoke() error: %v", err)
+	}
+
+	tok, err := store.Authenticate(secret, ScopeRegister, time.Now())
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Authenticate() error = %v, want ErrTokenRevoked", err)
+	}
+	if tok.Name != "carol" {
+		t.Errorf("revoked token name = %q, want carol", tok.Name)
+	}
+
+	if err := cli.Revoke("carol"); err == nil {
+		t.Error("expected error revoking twice")
+	}
+	if err := cli.Revoke("nobody"); err == nil {
+		t.Error("expected error revoking unknown token")
+	}
+}
+
+func TestTokenStoreList(t *testing.T) {
+	store := newTestTokenStore(t)
+	store.Issue("zed", []string{ScopeRegister}, time.Time{}, 0)
+	store.Issue("amy", []string{ScopeRegister, ScopeAdmin}, time.Time{}, 0)
+
+	tokens, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "amy" || tokens[1].Name != "zed" {
+		t.Errorf("List() = %+v, want amy then zed", tokens)
+	}
+	if !tokens[0].HasScope(ScopeAdmin) {
+		t.Error("amy should have the admin scope")
+	}
+}
+
+func TestTokenStoreRedeemInvite(t *testing.T) {
+	store := newTestTokenStore(t)
+	code, err := store.IssueInvite("dave", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("IssueInvite() error: %v", err)
+	}
+
+	tok, err := store.Authenticate(code, ScopeRegister, time.Now())
+	if err != nil {
+		t.Fatalf("Authenticate(invite) error: %v", err)
+	}
+	if !tok.Invite || tok.MaxPeers != 1 {
+		t.Errorf("invite token = %+v, want single-peer invite", tok)
+	}
+
+	secret, err := store.Redeem("dave")
+	if err != nil {
+		t.Fatalf("Redeem() error: %v", err)
+	}
+	if _, err := store.Authenticate(code, ScopeRegister, time.Now()); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Authenticate(used invite) error = %v, want ErrTokenInvalid", err)
+	}
+
+	// The replacement token outlives the invite's expiry
+	tok, err = store.Authenticate(secret, ScopeRegister, time.Now().Add(48*time.Hour))
+	if err != nil {
+		t.Fatalf("Authenticate(new token) error: %v", err)
+	}
+	if tok.Invite || tok.Name != "dave" || tok.RedeemedAt == nil {
+		t.Errorf("redeemed token = %+v, want regular token dave", tok)
+	}
+
+	if _, err := store.Redeem("dave"); !errors.Is(err, ErrNotInvite) {
+		t.Errorf("second Redeem() error = %v, want ErrNotInvite", err)
+	}
+}
@@ -0,0 +1,256 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// dialTimeout bounds connecting to the server, which WireGuard waits on
+// before its handshake goes out.
+const dialTimeout = 10 * time.Second
+
+// DialFunc opens a stream to the server for datagrams WireGuard sends to
+// endpoint. dialer carries the socket options set on the bind, such as the
+// firewall mark, and must be used for the underlying TCP connection.
+type DialFunc func(ctx context.Context, dialer *net.Dialer, endpoint netip.AddrPort) (net.Conn, error)
+
+// DialTCP returns a DialFunc that connects over TCP to the endpoint's
+// address. A non-zero port replaces the endpoint's own.
+func DialTCP(port uint16) DialFunc {
+	return func(ctx context.Context, dialer *net.Dialer, endpoint netip.AddrPort) (net.Conn, error) {
+		if port != 0 {
+			endpoint = netip.AddrPortFrom(endpoint.Addr(), port)
+		}
+		return dialer.DialContext(ctx, "tcp", endpoint.String())
+	}
+}
+
+// DialWebSocket returns a DialFunc that connects to the server's WebSocket
+// transport on port at the endpoint's address, so the stream takes the same
+// path as WireGuard over UDP would, and presents host as the server's name
+// in the request and the TLS handshake. With tlsConfig set the connection
+// uses wss.
+func DialWebSocket(host string, port uint16, tlsConfig *tls.Config) DialFunc {
+	scheme, origin := "ws", "http"
+	if tlsConfig != nil {
+		scheme, origin = "wss", "https"
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+	}
+	hostPort := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	return func(ctx context.Context, dialer *net.Dialer, endpoint netip.AddrPort) (net.Conn, error) {
+		cfg, err := websocket.NewConfig(scheme+"://"+hostPort+WebSocketPath, origin+"://"+hostPort)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := dialer.DialContext(ctx, "tcp", netip.AddrPortFrom(endpoint.Addr(), port).String())
+		if err != nil {
+			return nil, err
+		}
+		// The WebSocket handshake takes no context, so bound it with a deadline
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		if tlsConfig != nil {
+			c = tls.Client(c, tlsConfig)
+		}
+		ws, err := websocket.NewClient(cfg, c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		ws.PayloadType = websocket.BinaryFrame
+		return ws, nil
+	}
+}
+
+// ClientBind is a conn.Bind that sends WireGuard datagrams over a single
+// stream to the server, opened with a DialFunc on the first send and again
+// after the stream fails. The bind can be reopened after Close.
+type ClientBind struct {
+	dial  DialFunc
+	queue chan packet
+
+	// dialMu serializes dialing, so concurrent sends share one new stream
+	dialMu sync.Mutex
+
+	mu       sync.Mutex
+	mark     uint32
+	closed   chan struct{}      // nil while the bind is not open
+	cancel   context.CancelFunc // aborts a dial in progress on Close
+	ctx      context.Context
+	stream   *streamConn
+	endpoint netip.AddrPort // where stream was dialed for
+}
+
+var _ conn.Bind = (*ClientBind)(nil)
+
+// NewClientBind creates a bind that reaches the server through dial.
+func NewClientBind(dial DialFunc) *ClientBind {
+	return &ClientBind{
+		dial:  dial,
+		queue: make(chan packet, queueLen),
+	}
+}
+
+func (b *ClientBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.closed = make(chan struct{})
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return []conn.ReceiveFunc{newReceiveFunc(b.queue, b.closed)}, port, nil
+}
+
+func (b *ClientBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.cancel()
+	b.closed, b.ctx, b.cancel = nil, nil, nil
+	if b.stream != nil {
+		b.stream.conn.Close()
+		b.stream = nil
+	}
+	return nil
+}
+
+// SetMark sets the firewall mark of streams dialed from now on.
+func (b *ClientBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	b.mark = mark
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *ClientBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	dst, ok := ep.(clientEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	s, err := b.connect(netip.AddrPort(dst))
+	if err != nil {
+		return err
+	}
+	if err := s.writeFrames(bufs); err != nil {
+		b.drop(s)
+		return err
+	}
+	return nil
+}
+
+// current returns the open stream to endpoint, if any, and the context
+// dials must stop with.
+func (b *ClientBind) current(endpoint netip.AddrPort) (*streamConn, context.Context, uint32, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed == nil {
+		return nil, nil, 0, net.ErrClosed
+	}
+	if b.stream != nil && b.endpoint == endpoint {
+		return b.stream, nil, 0, nil
+	}
+	return nil, b.ctx, b.mark, nil
+}
+
+// connect returns the stream to endpoint, dialing it if there is none. A
+// stream to a previous endpoint is replaced.
+func (b *ClientBind) connect(endpoint netip.AddrPort) (*streamConn, error) {
+	b.dialMu.Lock()
+	defer b.dialMu.Unlock()
+
+	s, ctx, mark, err := b.current(endpoint)
+	if s != nil || err != nil {
+		return s, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	c, err := b.dial(ctx, newDialer(mark), endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+	s = &streamConn{conn: c}
+
+	b.mu.Lock()
+	if b.closed == nil {
+		b.mu.Unlock()
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	if b.stream != nil {
+		b.stream.conn.Close()
+	}
+	b.stream, b.endpoint = s, endpoint
+	b.mu.Unlock()
+
+	go func() {
+		s.readFrames(b.queue, clientEndpoint(endpoint))
+		b.drop(s)
+	}()
+	return s, nil
+}
+
+// drop closes s and forgets it if it is the current stream, so that the
+// next send dials again.
+func (b *ClientBind) drop(s *streamConn) {
+	b.mu.Lock()
+	if b.stream == s {
+		b.stream = nil
+	}
+	b.mu.Unlock()
+	s.conn.Close()
+}
+
+func (b *ClientBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return clientEndpoint(addr), nil
+}
+
+func (b *ClientBind) BatchSize() int {
+	return 1
+}
+
+// clientEndpoint is the server's WireGuard address as configured on the
+// client; the stream to it may go elsewhere, see DialWebSocket.
+type clientEndpoint netip.AddrPort
+
+func (e clientEndpoint) ClearSrc() {}
+
+func (e clientEndpoint) SrcToString() string { return "" }
+
+func (e clientEndpoint) DstToString() string { return netip.AddrPort(e).String() }
+
+func (e clientEndpoint) DstToBytes() []byte {
+	b, _ := netip.AddrPort(e).MarshalBinary()
+	return b
+}
+
+func (e clientEndpoint) DstIP() netip.Addr { return netip.AddrPort(e).Addr() }
+
+func (e clientEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
@@ -0,0 +1,28 @@
+package transport
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// newDialer returns a dialer whose sockets carry the firewall mark, so that
+// policy routing keeps the stream to the server off the tunnel.
+func newDialer(mark uint32) *net.Dialer {
+	d := &net.Dialer{}
+	if mark == 0 {
+		return d
+	}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+	return d
+}
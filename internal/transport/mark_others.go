@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transport
+
+import "net"
+
+// newDialer returns a plain dialer; firewall marks only exist on Linux.
+func newDialer(mark uint32) *net.Dialer {
+	return &net.Dialer{}
+}
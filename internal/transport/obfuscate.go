@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// obfuscationNonceLen is the size of the random nonce in front of every
+	// obfuscated packet, which is all the overhead data packets get.
+	obfuscationNonceLen = 8
+
+	// maxObfuscationPadding is the most padding added to a handshake or
+	// keepalive, so their sizes vary.
+	maxObfuscationPadding = 128
+)
+
+// errShortPacket is returned for packets too short to be WireGuard messages.
+var errShortPacket = errors.New("packet too short to obfuscate")
+
+// ObfuscatedBind wraps a conn.Bind so that WireGuard's packets no longer
+// match its well-known message types and sizes. Every packet is masked with
+// a ChaCha20 keystream derived from a shared key and a random per-packet
+// nonce, and handshakes and keepalives get random padding, whose length
+// travels in the reserved bytes of the WireGuard header. Packets that do not
+// unmask to a WireGuard header, such as plain WireGuard or probes, are
+// dropped.
+//
+// This hides WireGuard from pattern matching, not from a determined
+// observer; confidentiality still comes from WireGuard itself. Both ends
+// must use the same key.
+type ObfuscatedBind struct {
+	conn.Bind
+	key [chacha20.KeySize]byte
+}
+
+var _ conn.Bind = (*ObfuscatedBind)(nil)
+
+// NewObfuscatedBind wraps inner to obfuscate its packets with key.
+func NewObfuscatedBind(inner conn.Bind, key [chacha20.KeySize]byte) *ObfuscatedBind {
+	return &ObfuscatedBind{Bind: inner, key: key}
+}
+
+func (b *ObfuscatedBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, fn := range fns {
+		fns[i] = b.receiveFunc(fn)
+	}
+	return fns, actualPort, nil
+}
+
+// receiveFunc unmasks the packets fn receives in place. Packets that fail
+// to unmask get size zero, which WireGuard skips like any runt packet.
+func (b *ObfuscatedBind) receiveFunc(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(bufs, sizes, eps)
+		for i := 0; i < n; i++ {
+			sizes[i] = b.unmask(bufs[i][:sizes[i]])
+		}
+		return n, err
+	}
+}
+
+func (b *ObfuscatedBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	masked := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		m, err := b.mask(buf)
+		if err != nil {
+			return err
+		}
+		masked[i] = m
+	}
+	return b.Bind.Send(masked, ep)
+}
+
+// mask returns msg obfuscated: a nonce followed by the masked message and
+// its padding.
+func (b *ObfuscatedBind) mask(msg []byte) ([]byte, error) {
+	if len(msg) < 4 {
+		return nil, errShortPacket
+	}
+
+	padding := 0
+	msgType := binary.LittleEndian.Uint32(msg[:4])
+	if msgType != device.MessageTransportType || len(msg) == device.MessageKeepaliveSize {
+		padding = rand.IntN(maxObfuscationPadding + 1)
+	}
+
+	out := make([]byte, obfuscationNonceLen+len(msg)+padding)
+	binary.LittleEndian.PutUint64(out, rand.Uint64())
+	body := out[obfuscationNonceLen:]
+	copy(body, msg)
+	binary.LittleEndian.PutUint16(body[1:3], uint16(padding))
+	b.keystream(out[:obfuscationNonceLen]).XORKeyStream(body, body)
+	return out, nil
+}
+
+// unmask restores the WireGuard message in pkt to its start and returns its
+// length, or 0 if pkt is not an obfuscated WireGuard message.
+func (b *ObfuscatedBind) unmask(pkt []byte) int {
+	if len(pkt) < obfuscationNonceLen+4 {
+		return 0
+	}
+	body := pkt[obfuscationNonceLen:]
+	b.keystream(pkt[:obfuscationNonceLen]).XORKeyStream(body, body)
+
+	padding := int(binary.LittleEndian.Uint16(body[1:3]))
+	if body[0] < device.MessageInitiationType || body[0] > device.MessageTransportType ||
+		body[3] != 0 || padding > len(body)-4 {
+		return 0
+	}
+	body[1], body[2] = 0, 0
+	return copy(pkt, body[:len(body)-padding])
+}
+
+// keystream returns the cipher masking the packet with the given nonce.
+func (b *ObfuscatedBind) keystream(nonce []byte) *chacha20.Cipher {
+	var n [chacha20.NonceSize]byte
+	copy(n[:], nonce)
+	c, err := chacha20.NewUnauthenticatedCipher(b.key[:], n[:])
+	if err != nil {
+		panic(err) // the key and nonce sizes are fixed
+	}
+	return c
+}
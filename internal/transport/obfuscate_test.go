@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// message returns a fake WireGuard message of the given type and size.
+func message(msgType uint32, size int) []byte {
+	msg := make([]byte, size)
+	binary.LittleEndian.PutUint32(msg, msgType)
+	for i := 4; i < size; i++ {
+		msg[i] = byte(i)
+	}
+	return msg
+}
+
+// openMemoryPair opens a sender and a receiver bind on a memory network,
+// wrapped by wrapSender and wrapReceiver, and returns the sender, the
+// receiver's receive func and the receiver's endpoint.
+func openMemoryPair(t *testing.T, wrapSender, wrapReceiver func(conn.Bind) conn.Bind) (conn.Bind, conn.ReceiveFunc, conn.Endpoint) {
+	t.Helper()
+	network := tunnel.NewMemoryNetwork()
+	sender := wrapSender(network.Bind(netip.MustParseAddr("198.51.100.1")))
+	receiver := wrapReceiver(network.Bind(netip.MustParseAddr("192.0.2.1")))
+
+	if _, _, err := sender.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sender.Close() })
+	fns, _, err := receiver.Open(51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+
+	ep, err := sender.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, fns[0], ep
+}
+
+// receiveRaw reads one datagram from fn, which may have been dropped to
+// size zero.
+func receiveRaw(t *testing.T, fn conn.ReceiveFunc) []byte {
+	t.Helper()
+	bufs := [][]byte{make([]byte, 2048)}
+	sizes := make([]int, 1)
+	if _, err := fn(bufs, sizes, make([]conn.Endpoint, 1)); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	return bufs[0][:sizes[0]]
+}
+
+func TestObfuscatedBindRoundTrip(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	wrap := func(b conn.Bind) conn.Bind { return NewObfuscatedBind(b, key) }
+	sender, recv, ep := openMemoryPair(t, wrap, wrap)
+
+	msgs := [][]byte{
+		message(device.MessageInitiationType, device.MessageInitiationSize),
+		message(device.MessageResponseType, device.MessageResponseSize),
+		message(device.MessageTransportType, device.MessageKeepaliveSize),
+		message(device.MessageTransportType, 1452),
+	}
+	for _, msg := range msgs {
+		if err := sender.Send([][]byte{msg}, ep); err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+		if got := receiveRaw(t, recv); !bytes.Equal(got, msg) {
+			t.Errorf("received %d bytes of type %d, want the %d bytes sent", len(got), got[0], len(msg))
+		}
+	}
+}
+
+func TestObfuscatedBindHidesWireGuard(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	plain := func(b conn.Bind) conn.Bind { return b }
+	sender, recv, ep := openMemoryPair(t, func(b conn.Bind) conn.Bind { return NewObfuscatedBind(b, key) }, plain)
+
+	initiation := message(device.MessageInitiationType, device.MessageInitiationSize)
+	sizes := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		if err := sender.Send([][]byte{initiation}, ep); err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+		wire := receiveRaw(t, recv)
+		if len(wire) < obfuscationNonceLen+len(initiation) {
+			t.Fatalf("obfuscated initiation is %d bytes, shorter than the message", len(wire))
+		}
+		if bytes.Contains(wire, initiation[4:]) {
+			t.Fatal("obfuscated packet contains the plain message")
+		}
+		sizes[len(wire)] = true
+	}
+	// Random padding makes handshake sizes vary
+	if len(sizes) < 2 {
+		t.Errorf("20 handshakes all had the same size on the wire")
+	}
+}
+
+func TestObfuscatedBindDropsForeignPackets(t *testing.T) {
+	receiverKey := [32]byte{1, 2, 3}
+	wrapReceiver := func(b conn.Bind) conn.Bind { return NewObfuscatedBind(b, receiverKey) }
+
+	for name, wrapSender := range map[string]func(conn.Bind) conn.Bind{
+		"plain WireGuard": func(b conn.Bind) conn.Bind { return b },
+		"another key":     func(b conn.Bind) conn.Bind { return NewObfuscatedBind(b, [32]byte{9}) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			sender, recv, ep := openMemoryPair(t, wrapSender, wrapReceiver)
+			for i := 0; i < 20; i++ {
+				if err := sender.Send([][]byte{message(device.MessageInitiationType, device.MessageInitiationSize)}, ep); err != nil {
+					t.Fatalf("Send() error: %v", err)
+				}
+				if got := receiveRaw(t, recv); len(got) != 0 {
+					t.Fatalf("received a %d-byte packet, want it dropped", len(got))
+				}
+			}
+		})
+	}
+}
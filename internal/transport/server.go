@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// ServerBind is a conn.Bind that receives WireGuard datagrams both through
+// an inner bind, usually UDP sockets, and from the TCP and WebSocket streams
+// it serves. Replies to a peer go back over the stream it last sent from,
+// which WireGuard tracks as the peer's endpoint like any roaming address.
+//
+// Streams outlive the bind being closed and reopened by the device; they
+// end with the client's connection or with Shutdown.
+type ServerBind struct {
+	inner conn.Bind
+	queue chan packet
+
+	mu        sync.Mutex
+	closed    chan struct{} // nil while the bind is not open
+	listeners map[net.Listener]struct{}
+	streams   map[*streamConn]struct{}
+	shutdown  bool
+}
+
+var _ conn.Bind = (*ServerBind)(nil)
+
+// NewServerBind wraps inner, which keeps serving the device's UDP traffic.
+func NewServerBind(inner conn.Bind) *ServerBind {
+	return &ServerBind{
+		inner:     inner,
+		queue:     make(chan packet, queueLen),
+		listeners: make(map[net.Listener]struct{}),
+		streams:   make(map[*streamConn]struct{}),
+	}
+}
+
+// Serve accepts framed TCP streams on ln until ln is closed or Shutdown is
+// called.
+func (b *ServerBind) Serve(ln net.Listener) error {
+	if !b.track(ln) {
+		ln.Close()
+		return net.ErrClosed
+	}
+	defer b.untrack(ln)
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go b.ServeConn(c)
+	}
+}
+
+// ServeWebSocket serves WebSocket streams over HTTP on ln until ln is closed
+// or Shutdown is called. ln may be a TLS listener.
+func (b *ServerBind) ServeWebSocket(ln net.Listener) error {
+	if !b.track(ln) {
+		ln.Close()
+		return net.ErrClosed
+	}
+	defer b.untrack(ln)
+
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, b.WebSocketHandler())
+	err := http.Serve(ln, mux)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// WebSocketHandler returns a handler that accepts WebSocket streams, for
+// mounting on an existing HTTP server at WebSocketPath.
+func (b *ServerBind) WebSocketHandler() http.Handler {
+	// Without a Handshake func any Origin is accepted; clients are not
+	// browsers, and WireGuard authenticates every packet anyway
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		// An HTTP server's timeouts may have left deadlines on the connection
+		ws.SetDeadline(time.Time{})
+		// A server-side Conn reports the client's Origin as its remote address
+		b.serveStream(ws, ws.Request().RemoteAddr)
+	}}
+}
+
+// ServeConn carries datagrams over the framed stream c until it fails or
+// Shutdown is called, then closes it.
+func (b *ServerBind) ServeConn(c net.Conn) {
+	b.serveStream(c, c.RemoteAddr().String())
+}
+
+// serveStream serves c, whose client is at remote.
+func (b *ServerBind) serveStream(c net.Conn, remote string) {
+	s := &streamConn{conn: c}
+	ep := &serverEndpoint{stream: s}
+	if addr, err := netip.ParseAddrPort(remote); err == nil {
+		ep.remote = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	}
+
+	b.mu.Lock()
+	if b.shutdown {
+		b.mu.Unlock()
+		c.Close()
+		return
+	}
+	b.streams[s] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.streams, s)
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	if err := s.readFrames(b.queue, ep); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+		log.Printf("Transport stream from %s ended: %v", ep.remote, err)
+	}
+}
+
+// Shutdown stops every listener being served and closes every stream.
+func (b *ServerBind) Shutdown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.shutdown = true
+	for ln := range b.listeners {
+		ln.Close()
+	}
+	for s := range b.streams {
+		s.conn.Close()
+	}
+}
+
+// track records ln for Shutdown, unless the bind is already shut down.
+func (b *ServerBind) track(ln net.Listener) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shutdown {
+		return false
+	}
+	b.listeners[ln] = struct{}{}
+	return true
+}
+
+func (b *ServerBind) untrack(ln net.Listener) {
+	b.mu.Lock()
+	delete(b.listeners, ln)
+	b.mu.Unlock()
+}
+
+func (b *ServerBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	fns, actualPort, err := b.inner.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.closed = make(chan struct{})
+	return append(fns, newReceiveFunc(b.queue, b.closed)), actualPort, nil
+}
+
+func (b *ServerBind) Close() error {
+	b.mu.Lock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	b.mu.Unlock()
+	return b.inner.Close()
+}
+
+func (b *ServerBind) SetMark(mark uint32) error {
+	return b.inner.SetMark(mark)
+}
+
+func (b *ServerBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if sep, ok := ep.(*serverEndpoint); ok {
+		return sep.stream.writeFrames(bufs)
+	}
+	return b.inner.Send(bufs, ep)
+}
+
+func (b *ServerBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return b.inner.ParseEndpoint(s)
+}
+
+func (b *ServerBind) BatchSize() int {
+	return b.inner.BatchSize()
+}
+
+// serverEndpoint is a client reached over a stream.
+type serverEndpoint struct {
+	stream *streamConn
+	remote netip.AddrPort
+}
+
+func (e *serverEndpoint) ClearSrc() {}
+
+func (e *serverEndpoint) SrcToString() string { return "" }
+
+func (e *serverEndpoint) DstToString() string { return e.remote.String() }
+
+func (e *serverEndpoint) DstToBytes() []byte {
+	b, _ := e.remote.MarshalBinary()
+	return b
+}
+
+func (e *serverEndpoint) DstIP() netip.Addr { return e.remote.Addr() }
+
+func (e *serverEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
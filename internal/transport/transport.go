@@ -0,0 +1,104 @@
+// Package transport carries WireGuard over TCP or WebSocket streams for
+// networks that block UDP, and hides it from traffic fingerprinting. Its
+// stream conn.Bind implementations frame each WireGuard datagram with a
+// two-byte big-endian length, so the packets arrive intact however the
+// stream splits them; ObfuscatedBind masks the packets of any bind.
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// WebSocketPath is where servers accept WebSocket transport connections.
+	WebSocketPath = "/api/v1/tunnel"
+
+	// maxFrameLen is the largest datagram a length prefix can describe.
+	maxFrameLen = 1<<16 - 1
+
+	// queueLen is how many received datagrams a bind buffers before it
+	// drops new ones, as a full UDP socket would.
+	queueLen = 1024
+
+	// writeTimeout bounds a write to a stalled stream, so a dead peer
+	// cannot hold up WireGuard's sender.
+	writeTimeout = 10 * time.Second
+)
+
+// errFrameTooLarge is returned for datagrams that do not fit in a frame.
+var errFrameTooLarge = errors.New("datagram too large for the stream transport")
+
+// packet is a datagram received from a stream, with the endpoint replies
+// should go to.
+type packet struct {
+	data []byte
+	ep   conn.Endpoint
+}
+
+// streamConn is one framed stream carrying WireGuard datagrams.
+type streamConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	buf     []byte
+}
+
+// writeFrames sends bufs as consecutive frames in a single write.
+func (s *streamConn) writeFrames(bufs [][]byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.buf = s.buf[:0]
+	for _, b := range bufs {
+		if len(b) > maxFrameLen {
+			return errFrameTooLarge
+		}
+		s.buf = binary.BigEndian.AppendUint16(s.buf, uint16(len(b)))
+		s.buf = append(s.buf, b...)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := s.conn.Write(s.buf)
+	return err
+}
+
+// readFrames queues every frame read from the stream as coming from ep,
+// until the stream fails. Frames are dropped while queue is full.
+func (s *streamConn) readFrames(queue chan<- packet, ep conn.Endpoint) error {
+	var header [2]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			return err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return fmt.Errorf("truncated frame: %w", err)
+		}
+		select {
+		case queue <- packet{data: data, ep: ep}:
+		default:
+		}
+	}
+}
+
+// newReceiveFunc returns a conn.ReceiveFunc that takes datagrams from queue
+// until closed is closed.
+func newReceiveFunc(queue <-chan packet, closed <-chan struct{}) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case p := <-queue:
+			sizes[0] = copy(bufs[0], p.data)
+			eps[0] = p.ep
+			return 1, nil
+		}
+	}
+}
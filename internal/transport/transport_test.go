@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/bindtest"
+	"github.com/gavsh/ShikVPN/internal/tunnel"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// endpoint is the server's WireGuard address the client binds in these
+// tests send to; the streams go to the same host.
+const endpoint = "127.0.0.1:51820"
+
+// openServer opens a server bind on a memory network and returns the
+// receive func for its streams.
+func openServer(t *testing.T) (*ServerBind, conn.ReceiveFunc) {
+	t.Helper()
+	b := NewServerBind(tunnel.NewMemoryNetwork().Bind(netip.MustParseAddr("192.0.2.1")))
+	fns, _, err := b.Open(51820)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	t.Cleanup(func() {
+		b.Shutdown()
+		b.Close()
+	})
+	return b, fns[len(fns)-1]
+}
+
+// openClient opens a client bind that dials with dial.
+func openClient(t *testing.T, dial DialFunc) (*ClientBind, conn.ReceiveFunc) {
+	t.Helper()
+	b := NewClientBind(dial)
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, fns[0]
+}
+
+// exchange sends a datagram each way between client and server binds.
+func exchange(t *testing.T, client *ClientBind, clientRecv conn.ReceiveFunc, server *ServerBind, serverRecv conn.ReceiveFunc) {
+	t.Helper()
+	ep, err := client.ParseEndpoint(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send([][]byte{[]byte("ping"), []byte("ping2")}, ep); err != nil {
+		t.Fatalf("client Send() error: %v", err)
+	}
+	got, from := bindtest.Receive(t, serverRecv)
+	if got != "ping" {
+		t.Errorf("server received %q, want %q", got, "ping")
+	}
+	if got, _ := bindtest.Receive(t, serverRecv); got != "ping2" {
+		t.Errorf("server received %q, want %q", got, "ping2")
+	}
+
+	// The reply goes back over the stream the datagram came from
+	if err := server.Send([][]byte{[]byte("pong")}, from); err != nil {
+		t.Fatalf("server Send() error: %v", err)
+	}
+	got, replyFrom := bindtest.Receive(t, clientRecv)
+	if got != "pong" {
+		t.Errorf("client received %q, want %q", got, "pong")
+	}
+	if replyFrom.DstToString() != endpoint {
+		t.Errorf("reply endpoint = %s, want %s", replyFrom.DstToString(), endpoint)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	server, serverRecv := openServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	// The endpoint's address is dialed, on the listener's port
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	dial := func(ctx context.Context, dialer *net.Dialer, ep netip.AddrPort) (net.Conn, error) {
+		if ep.String() != endpoint {
+			t.Errorf("dialing for %s, want %s", ep, endpoint)
+		}
+		return DialTCP(port)(ctx, dialer, ep)
+	}
+	client, clientRecv := openClient(t, dial)
+	exchange(t, client, clientRecv, server, serverRecv)
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	server, serverRecv := openServer(t)
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, server.WebSocketHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	port := uint16(ts.Listener.Addr().(*net.TCPAddr).Port)
+	client, clientRecv := openClient(t, DialWebSocket("vpn.example.com", port, nil))
+	exchange(t, client, clientRecv, server, serverRecv)
+}
+
+func TestClientBindRedials(t *testing.T) {
+	server, serverRecv := openServer(t)
+
+	var mu sync.Mutex
+	var serverSides []net.Conn
+	dial := func(ctx context.Context, dialer *net.Dialer, ep netip.AddrPort) (net.Conn, error) {
+		c, s := net.Pipe()
+		mu.Lock()
+		serverSides = append(serverSides, s)
+		mu.Unlock()
+		go server.ServeConn(s)
+		return c, nil
+	}
+	client, clientRecv := openClient(t, dial)
+	exchange(t, client, clientRecv, server, serverRecv)
+
+	// The server drops the stream; the next send dials a new one
+	mu.Lock()
+	serverSides[0].Close()
+	mu.Unlock()
+	ep, _ := client.ParseEndpoint(endpoint)
+	for {
+		mu.Lock()
+		n := len(serverSides)
+		mu.Unlock()
+		if n > 1 {
+			break
+		}
+		client.Send([][]byte{[]byte("retry")}, ep)
+	}
+	if got, _ := bindtest.Receive(t, serverRecv); got != "retry" {
+		t.Errorf("server received %q after redial, want %q", got, "retry")
+	}
+}
+
+func TestClientBindClosed(t *testing.T) {
+	b := NewClientBind(func(ctx context.Context, dialer *net.Dialer, ep netip.AddrPort) (net.Conn, error) {
+		t.Error("a closed bind dialed")
+		return nil, net.ErrClosed
+	})
+	ep, _ := b.ParseEndpoint(endpoint)
+	if err := b.Send([][]byte{[]byte("x")}, ep); err == nil {
+		t.Error("Send() on a bind that is not open succeeded")
+	}
+}
@@ -1,13 +1,18 @@
 package tunnel
 
 import (
+	"bufio"
 	"fmt"
+	"net/netip"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 // PeerConfig holds configuration for a single WireGuard peer.
@@ -16,10 +21,21 @@ type PeerConfig struct {
 	PresharedKeyHex     string
 	Endpoint            string
 	AllowedIPs          []string
+	ReplaceAllowedIPs   bool // replace the peer's existing allowed IPs instead of appending
 	PersistentKeepalive int
 }
 
-// Tunnel wraps a WireGuard device with its TUN interface.
+// PeerStats holds the runtime state of a peer as reported by the WireGuard device.
+type PeerStats struct {
+	PublicKeyHex  string
+	Endpoint      string
+	AllowedIPs    []string
+	LastHandshake time.Time // zero if no handshake has completed yet
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// Tunnel wraps a WireGuard device with its TUN interface or userspace network stack.
 type Tunnel struct {
 	device    *device.Device
 	tunDevice tun.Device
@@ -28,9 +44,10 @@ type Tunnel struct {
 	closed    bool
 }
 
-// CreateTunnel creates a new TUN device and WireGuard device on top of it.
+// CreateTunnel creates a new TUN device and WireGuard device on top of it,
+// sending WireGuard's packets through bind, e.g. conn.NewDefaultBind().
 // logLevel controls WireGuard logging: "verbose", "error", or "silent".
-func CreateTunnel(name string, mtu int, logLevel string) (*Tunnel, error) {
+func CreateTunnel(name string, mtu int, logLevel string, bind conn.Bind) (*Tunnel, error) {
 	tunDevice, err := tun.CreateTUN(name, mtu)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TUN device %q: %w", name, err)
@@ -42,6 +59,26 @@ func CreateTunnel(name string, mtu int, logLevel string) (*Tunnel, error) {
 		return nil, fmt.Errorf("failed to get TUN device name: %w", err)
 	}
 
+	return newTunnel(tunDevice, bind, actualName, logLevel), nil
+}
+
+// CreateNetstackTunnel creates a WireGuard device on a userspace TCP/IP
+// stack instead of a TUN device, so it needs no privileges. The stack owns
+// addresses and resolves names with dnsServers; connections through the
+// tunnel are made with the returned Net.
+func CreateNetstackTunnel(addresses, dnsServers []netip.Addr, mtu int, logLevel string, bind conn.Bind) (*Tunnel, *netstack.Net, error) {
+	tunDevice, tnet, err := netstack.CreateNetTUN(addresses, dnsServers, mtu)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create netstack device: %w", err)
+	}
+	return newTunnel(tunDevice, bind, NetstackName, logLevel), tnet, nil
+}
+
+// NetstackName is the name reported by tunnels created with CreateNetstackTunnel.
+const NetstackName = "netstack"
+
+// newTunnel starts a WireGuard device on tunDevice.
+func newTunnel(tunDevice tun.Device, bind conn.Bind, name, logLevel string) *Tunnel {
 	level := device.LogLevelError
 	switch logLevel {
 	case "verbose":
@@ -50,15 +87,15 @@ func CreateTunnel(name string, mtu int, logLevel string) (*Tunnel, error) {
 		level = device.LogLevelSilent
 	}
 
-	log := device.NewLogger(level, fmt.Sprintf("(%s) ", actualName))
+	log := device.NewLogger(level, fmt.Sprintf("(%s) ", name))
 
-	wgDevice := device.NewDevice(tunDevice, conn.NewDefaultBind(), log)
+	wgDevice := device.NewDevice(tunDevice, bind, log)
 
 	return &Tunnel{
 		device:    wgDevice,
 		tunDevice: tunDevice,
-		name:      actualName,
-	}, nil
+		name:      name,
+	}
 }
 
 // Configure applies a UAPI configuration string to the WireGuard device.
@@ -121,6 +158,90 @@ func (t *Tunnel) Device() *device.Device {
 	return t.device
 }
 
+// PeerStats returns the current runtime state of every peer on the device.
+func (t *Tunnel) PeerStats() ([]PeerStats, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("tunnel is closed")
+	}
+	t.mu.Unlock()
+
+	out, err := t.device.IpcGet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device state: %w", err)
+	}
+	return ParsePeerStats(out)
+}
+
+// ParsePeerStats parses the peer sections of a UAPI "get" response.
+// Device-level keys preceding the first public_key are ignored.
+func ParsePeerStats(uapi string) ([]PeerStats, error) {
+	var (
+		peers         []PeerStats
+		cur           *PeerStats
+		handshakeSec  int64
+		handshakeNsec int64
+	)
+
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			cur.LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		peers = append(peers, *cur)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(uapi))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed UAPI line %q", line)
+		}
+
+		if key == "public_key" {
+			flush()
+			cur = &PeerStats{PublicKeyHex: value}
+			handshakeSec, handshakeNsec = 0, 0
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "endpoint":
+			cur.Endpoint = value
+		case "allowed_ip":
+			cur.AllowedIPs = append(cur.AllowedIPs, value)
+		case "last_handshake_time_sec":
+			handshakeSec, err = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			cur.RxBytes, err = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			cur.TxBytes, err = strconv.ParseUint(value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: %w", key, value, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return peers, nil
+}
+
 // BuildServerUAPIConfig builds a UAPI config string for the server.
 func BuildServerUAPIConfig(privateKeyHex string, listenPort int, peers []PeerConfig) string {
 	var b strings.Builder
@@ -181,6 +302,9 @@ func BuildAddPeerUAPI(peer PeerConfig) string {
 	if peer.Endpoint != "" {
 		b.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint))
 	}
+	if peer.ReplaceAllowedIPs {
+		b.WriteString("replace_allowed_ips=true\n")
+	}
 	for _, allowedIP := range peer.AllowedIPs {
 		b.WriteString(fmt.Sprintf("allowed_ip=%s\n", allowedIP))
 	}
@@ -190,3 +314,14 @@ func BuildAddPeerUAPI(peer PeerConfig) string {
 
 	return b.String()
 }
+
+// BuildFwmarkUAPI builds a UAPI config string that sets the firewall mark on
+// the device's outgoing packets. Zero removes the mark.
+func BuildFwmarkUAPI(mark uint32) string {
+	return fmt.Sprintf("fwmark=%d\n", mark)
+}
+
+// BuildRemovePeerUAPI builds a UAPI config string that removes a single peer.
+func BuildRemovePeerUAPI(publicKeyHex string) string {
+	return fmt.Sprintf("public_key=%s\nremove=true\n", publicKeyHex)
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gavsh/ShikVPN/internal/crypto"
 )
@@ -171,3 +172,108 @@ func TestMultiplePeersSerialized(t *testing.T) {
 		t.Errorf("expected 5 public_key entries, got %d", count)
 	}
 }
+
+func TestBuildRemovePeerUAPI(t *testing.T) {
+	kp, _ := crypto.GenerateKeyPair()
+	pubKeyHex := crypto.KeyToHex(kp.PublicKey)
+
+	result := BuildRemovePeerUAPI(pubKeyHex)
+
+	if !strings.Contains(result, "public_key="+pubKeyHex) {
+		t.Error("remove peer UAPI missing public_key")
+	}
+	if !strings.Contains(result, "remove=true") {
+		t.Error("remove peer UAPI missing remove=true")
+	}
+	if strings.Contains(result, "allowed_ip=") {
+		t.Error("remove peer UAPI should not contain allowed_ip")
+	}
+}
+
+func TestParsePeerStats(t *testing.T) {
+	uapi := "private_key=aa\n" +
+		"listen_port=51820\n" +
+		"public_key=11\n" +
+		"protocol_version=1\n" +
+		"endpoint=1.2.3.4:5555\n" +
+		"last_handshake_time_sec=1700000000\n" +
+		"last_handshake_time_nsec=500\n" +
+		"tx_bytes=100\n" +
+		"rx_bytes=200\n" +
+		"persistent_keepalive_interval=0\n" +
+		"allowed_ip=10.0.0.2/32\n" +
+		"public_key=22\n" +
+		"protocol_version=1\n" +
+		"last_handshake_time_sec=0\n" +
+		"last_handshake_time_nsec=0\n" +
+		"tx_bytes=0\n" +
+		"rx_bytes=0\n" +
+		"allowed_ip=10.0.0.3/32\n" +
+		"allowed_ip=10.0.0.4/32\n"
+
+	peers, err := ParsePeerStats(uapi)
+	if err != nil {
+		t.Fatalf("ParsePeerStats() error: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(peers))
+	}
+
+	p1 := peers[0]
+	if p1.PublicKeyHex != "11" || p1.Endpoint != "1.2.3.4:5555" {
+		t.Errorf("peer 1 = %+v, unexpected key or endpoint", p1)
+	}
+	if !p1.LastHandshake.Equal(time.Unix(1700000000, 500)) {
+		t.Errorf("peer 1 LastHandshake = %v", p1.LastHandshake)
+	}
+	if p1.RxBytes != 200 || p1.TxBytes != 100 {
+		t.Errorf("peer 1 rx/tx = %d/%d, want 200/100", p1.RxBytes, p1.TxBytes)
+	}
+
+	p2 := peers[1]
+	if !p2.LastHandshake.IsZero() {
+		t.Errorf("peer 2 LastHandshake = %v, want zero", p2.LastHandshake)
+	}
+	if len(p2.AllowedIPs) != 2 {
+		t.Errorf("peer 2 AllowedIPs = %v, want 2 entries", p2.AllowedIPs)
+	}
+}
+
+func TestParsePeerStatsMalformed(t *testing.T) {
+	if _, err := ParsePeerStats("public_key=11\nrx_bytes=abc\n"); err == nil {
+		t.Error("expected error for non-numeric rx_bytes")
+	}
+	if _, err := ParsePeerStats("garbage\n"); err == nil {
+		t.Error("expected error for line without '='")
+	}
+}
+
+func TestBuildAddPeerUAPIReplaceAllowedIPs(t *testing.T) {
+	kp, _ := crypto.GenerateKeyPair()
+
+	peer := PeerConfig{
+		PublicKeyHex:      crypto.KeyToHex(kp.PublicKey),
+		AllowedIPs:        []string{"10.0.0.50/32"},
+		ReplaceAllowedIPs: true,
+	}
+
+	result := BuildAddPeerUAPI(peer)
+
+	replaceIdx := strings.Index(result, "replace_allowed_ips=true")
+	allowedIdx := strings.Index(result, "allowed_ip=10.0.0.50/32")
+	if replaceIdx < 0 {
+		t.Fatal("add peer UAPI missing replace_allowed_ips")
+	}
+	if allowedIdx < replaceIdx {
+		t.Error("replace_allowed_ips must precede the new allowed_ip entries")
+	}
+	if strings.Contains(BuildAddPeerUAPI(PeerConfig{PublicKeyHex: "aa"}), "replace_allowed_ips") {
+		t.Error("replace_allowed_ips should only be emitted when requested")
+	}
+}
+
+func TestBuildFwmarkUAPI(t *testing.T) {
+	if got := BuildFwmarkUAPI(51820); got != "fwmark=51820\n" {
+		t.Errorf("BuildFwmarkUAPI(51820) = %q", got)
+	}
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// memoryQueueLen is how many datagrams a memory bind buffers before it
+// drops new ones, as a full UDP socket would.
+const memoryQueueLen = 1024
+
+// firstEphemeralPort is where ports picked for Open(0) start.
+const firstEphemeralPort = 40000
+
+// MemoryNetwork is an in-process datagram network. Tunnels whose binds come
+// from the same MemoryNetwork exchange WireGuard packets through channels
+// instead of UDP sockets, so tests can run several of them without
+// privileges or open ports.
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	ports    map[netip.AddrPort]chan memoryPacket
+	nextPort uint16
+}
+
+// memoryPacket is a datagram in flight on a MemoryNetwork.
+type memoryPacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+// NewMemoryNetwork creates an empty in-process network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		ports:    make(map[netip.AddrPort]chan memoryPacket),
+		nextPort: firstEphemeralPort,
+	}
+}
+
+// Bind returns a conn.Bind that sends and receives on ip. Like a UDP bind it
+// listens on the port the device asks for, or picks a free one for port 0.
+// The bind can be reopened after Close, so one bind can serve successive
+// tunnels.
+func (n *MemoryNetwork) Bind(ip netip.Addr) conn.Bind {
+	return &memoryBind{network: n, ip: ip}
+}
+
+// listen reserves ip:port and returns its receive queue.
+func (n *MemoryNetwork) listen(ip netip.Addr, port uint16) (netip.AddrPort, chan memoryPacket, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		for {
+			port = n.nextPort
+			n.nextPort++
+			if n.nextPort == 0 {
+				n.nextPort = firstEphemeralPort
+			}
+			if _, used := n.ports[netip.AddrPortFrom(ip, port)]; !used {
+				break
+			}
+		}
+	}
+	addr := netip.AddrPortFrom(ip, port)
+	if _, used := n.ports[addr]; used {
+		return addr, nil, fmt.Errorf("memory network address %s is in use", addr)
+	}
+	queue := make(chan memoryPacket, memoryQueueLen)
+	n.ports[addr] = queue
+	return addr, queue, nil
+}
+
+// release frees an address reserved by listen.
+func (n *MemoryNetwork) release(addr netip.AddrPort) {
+	n.mu.Lock()
+	delete(n.ports, addr)
+	n.mu.Unlock()
+}
+
+// deliver queues a copy of data for to. Datagrams to unknown addresses or
+// full queues are dropped.
+func (n *MemoryNetwork) deliver(from, to netip.AddrPort, data []byte) {
+	n.mu.Lock()
+	queue := n.ports[to]
+	n.mu.Unlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- memoryPacket{data: append([]byte(nil), data...), from: from}:
+	default:
+	}
+}
+
+// memoryBind is a conn.Bind on a MemoryNetwork.
+type memoryBind struct {
+	network *MemoryNetwork
+	ip      netip.Addr
+
+	mu     sync.Mutex
+	local  netip.AddrPort
+	closed chan struct{} // nil while the bind is not open
+}
+
+var _ conn.Bind = (*memoryBind)(nil)
+
+func (b *memoryBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	local, queue, err := b.network.listen(b.ip, port)
+	if err != nil {
+		return nil, 0, err
+	}
+	closed := make(chan struct{})
+	b.local, b.closed = local, closed
+
+	receive := func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case p := <-queue:
+			sizes[0] = copy(bufs[0], p.data)
+			eps[0] = memoryEndpoint(p.from)
+			return 1, nil
+		}
+	}
+	return []conn.ReceiveFunc{receive}, local.Port(), nil
+}
+
+func (b *memoryBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	b.closed = nil
+	b.network.release(b.local)
+	return nil
+}
+
+func (b *memoryBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *memoryBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	dst, ok := ep.(memoryEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	local, open := b.local, b.closed != nil
+	b.mu.Unlock()
+	if !open {
+		return net.ErrClosed
+	}
+
+	for _, buf := range bufs {
+		b.network.deliver(local, netip.AddrPort(dst), buf)
+	}
+	return nil
+}
+
+func (b *memoryBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return memoryEndpoint(addr), nil
+}
+
+func (b *memoryBind) BatchSize() int {
+	return 1
+}
+
+// memoryEndpoint is the address of a peer on a MemoryNetwork.
+type memoryEndpoint netip.AddrPort
+
+func (e memoryEndpoint) ClearSrc() {}
+
+func (e memoryEndpoint) SrcToString() string { return "" }
+
+func (e memoryEndpoint) DstToString() string { return netip.AddrPort(e).String() }
+
+func (e memoryEndpoint) DstToBytes() []byte {
+	b, _ := netip.AddrPort(e).MarshalBinary()
+	return b
+}
+
+func (e memoryEndpoint) DstIP() netip.Addr { return netip.AddrPort(e).Addr() }
+
+func (e memoryEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
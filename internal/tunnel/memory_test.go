@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/gavsh/ShikVPN/internal/bindtest"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestMemoryBindExchange(t *testing.T) {
+	network := NewMemoryNetwork()
+	a := network.Bind(netip.MustParseAddr("192.0.2.1"))
+	b := network.Bind(netip.MustParseAddr("198.51.100.1"))
+
+	aRecv, aPort, err := a.Open(51820)
+	if err != nil || aPort != 51820 {
+		t.Fatalf("Open(51820) = %d, %v", aPort, err)
+	}
+	defer a.Close()
+	bRecv, bPort, err := b.Open(0)
+	if err != nil || bPort == 0 {
+		t.Fatalf("Open(0) = %d, %v", bPort, err)
+	}
+	defer b.Close()
+
+	ep, err := b.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{[]byte("ping")}, ep); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	got, from := bindtest.Receive(t, aRecv[0])
+	if got != "ping" {
+		t.Errorf("received %q, want %q", got, "ping")
+	}
+	want := netip.AddrPortFrom(netip.MustParseAddr("198.51.100.1"), bPort).String()
+	if from.DstToString() != want {
+		t.Errorf("sender = %s, want %s", from.DstToString(), want)
+	}
+
+	// Replies go back to the sender's endpoint
+	if err := a.Send([][]byte{[]byte("pong")}, from); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if got, _ := bindtest.Receive(t, bRecv[0]); got != "pong" {
+		t.Errorf("received %q, want %q", got, "pong")
+	}
+}
+
+func TestMemoryBindReopen(t *testing.T) {
+	network := NewMemoryNetwork()
+	ip := netip.MustParseAddr("192.0.2.1")
+	a := network.Bind(ip)
+
+	recv, _, err := a.Open(51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := network.Bind(ip).Open(51820); err == nil {
+		t.Error("a second bind opened the same address")
+	}
+
+	a.Close()
+	bufs := [][]byte{make([]byte, 10)}
+	if _, err := recv[0](bufs, make([]int, 1), make([]conn.Endpoint, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after Close error = %v, want %v", err, net.ErrClosed)
+	}
+
+	// The address is free again, and the bind can be reopened on it
+	if _, _, err := a.Open(51820); err != nil {
+		t.Fatalf("reopening error: %v", err)
+	}
+	a.Close()
+}